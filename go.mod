@@ -1,8 +1,22 @@
-module wstunnel
+module github.com/loafoe/wstunnel
 
-go 1.15
+go 1.26.0
 
 require (
+	github.com/Microsoft/go-winio v0.4.16
 	github.com/armon/go-socks5 v0.0.0-20160902184237-e75332964ef5
-	golang.org/x/net v0.0.0-20201224014010-6772e930b67b
+	github.com/gorilla/websocket v1.4.2
+	github.com/hashicorp/yamux v0.1.1
+	github.com/quic-go/quic-go v0.63.0
+	github.com/quic-go/webtransport-go v0.13.0
+	golang.org/x/crypto v0.54.0
+	golang.org/x/net v0.56.0
+	gopkg.in/yaml.v2 v2.4.0
+)
+
+require (
+	github.com/dunglas/httpsfv v1.1.1 // indirect
+	github.com/quic-go/qpack v0.6.0 // indirect
+	golang.org/x/sys v0.47.0 // indirect
+	golang.org/x/text v0.40.0 // indirect
 )
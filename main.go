@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/loafoe/wstunnel/pkg/wstunnel"
+)
+
+// version and commit are set at build time, e.g. with -ldflags "-X main.version=v1.2.0 -X main.commit=abc123".
+var (
+	version = "dev"
+	commit  = ""
+)
+
+// The flags of the version command. Those of the client and server commands are in the wstunnel package.
+var (
+	versionFlags = newFlagSet("version", "Prints the version and build info.")
+
+	versionJSON = versionFlags.Bool("json", false, "Print the version and build info as JSON")
+)
+
+func newFlagSet(name, doc string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: wstunnel %s [flags]\n\n%s\n\nFlags:\n", name, doc)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+func usage() {
+	fmt.Fprint(os.Stderr, `Usage: wstunnel <command> [flags]
+
+Commands:
+  client   Listen for local connections and tunnel them to a server over websockets
+  server   Serve the tunnels of clients
+  version  Print the version and build info
+
+Run wstunnel <command> -h for the flags of a command. Flags can also be set by WSTUNNEL_ environment variables.
+`)
+}
+
+// clientMain runs the client command until it's signaled to shut down.
+func clientMain(args []string) {
+	wstunnel.ParseClientFlags(args)
+	wstunnel.NewFlagClient().Run()
+}
+
+// serverMain runs the server command until it's signaled to shut down.
+func serverMain(args []string) {
+	wstunnel.ParseServerFlags(args)
+	wstunnel.NewFlagServer().Run()
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	switch cmd, args := os.Args[1], os.Args[2:]; cmd {
+	case "client":
+		clientMain(args)
+	case "server":
+		serverMain(args)
+	case "version":
+		versionMain(args)
+	case "help", "-h", "-help", "--help":
+		usage()
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n", cmd)
+		usage()
+		os.Exit(2)
+	}
+}
+
+// buildInfo is the version and build info printed by the version command.
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	GoVersion string `json:"go_version"`
+	OS        string `json:"os"`
+	Arch      string `json:"arch"`
+}
+
+func versionMain(args []string) {
+	versionFlags.Parse(args)
+	info := buildInfo{Version: version, Commit: commit, GoVersion: runtime.Version(), OS: runtime.GOOS, Arch: runtime.GOARCH}
+	if bi, ok := debug.ReadBuildInfo(); ok && info.Version == "dev" && bi.Main.Version != "" && bi.Main.Version != "(devel)" {
+		// Installed with go install module@version.
+		info.Version = bi.Main.Version
+	}
+
+	if *versionJSON {
+		json.NewEncoder(os.Stdout).Encode(info)
+		return
+	}
+	fmt.Printf("wstunnel %s", info.Version)
+	if info.Commit != "" {
+		fmt.Printf(" (%s)", info.Commit)
+	}
+	fmt.Printf(" %s %s/%s\n", info.GoVersion, info.OS, info.Arch)
+}
@@ -0,0 +1,78 @@
+package wstunnel
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFDsStart is the first file descriptor systemd passes sockets from, as per sd_listen_fds(3).
+const listenFDsStart = 3
+
+// activatedSockets are the sockets passed by systemd socket activation not taken by a listener yet.
+var activatedSockets []*os.File
+
+// loadActivatedSockets takes the sockets systemd passed to the process, if it did, unsetting the
+// variables passing them so that processes started from here don't take them as theirs too.
+func loadActivatedSockets() {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if err != nil {
+		return
+	}
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("LISTEN_FD_%d", listenFDsStart+i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		activatedSockets = append(activatedSockets, os.NewFile(uintptr(listenFDsStart+i), name))
+	}
+}
+
+// takeActivatedSocket returns the next socket systemd passed, or nil if there's none left.
+func takeActivatedSocket() *os.File {
+	if len(activatedSockets) == 0 {
+		return nil
+	}
+	f := activatedSockets[0]
+	activatedSockets = activatedSockets[1:]
+	return f
+}
+
+// activatedListener returns a listener on the stream socket f passed by systemd.
+func activatedListener(f *os.File) (net.Listener, error) {
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("Failed using socket %s passed by systemd: %v", f.Name(), err)
+	}
+	logInfo("Listening on a socket passed by systemd", "name", f.Name(), "listen", ln.Addr())
+	return ln, nil
+}
+
+// activatedPacketConn returns a connection on the datagram socket f passed by systemd.
+func activatedPacketConn(f *os.File) (net.PacketConn, error) {
+	defer f.Close()
+	pc, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, fmt.Errorf("Failed using socket %s passed by systemd: %v", f.Name(), err)
+	}
+	logInfo("Listening on a socket passed by systemd", "name", f.Name(), "listen", pc.LocalAddr())
+	return pc, nil
+}
+
+// warnUnusedActivatedSockets logs the sockets systemd passed that no listener took.
+func warnUnusedActivatedSockets() {
+	for _, f := range activatedSockets {
+		logWarn("Ignoring socket passed by systemd, all listeners have one already", "name", f.Name())
+	}
+}
@@ -0,0 +1,87 @@
+package wstunnel
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// cidrFlags are the networks clients may connect from.
+type cidrFlags []*net.IPNet
+
+func (c *cidrFlags) String() string {
+	var s []string
+	for _, n := range *c {
+		s = append(s, n.String())
+	}
+	return strings.Join(s, ",")
+}
+
+func (c *cidrFlags) Set(v string) error {
+	_, n, err := net.ParseCIDR(v)
+	if err != nil {
+		if ip := net.ParseIP(v); ip != nil {
+			n = &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}
+		} else {
+			return fmt.Errorf("%q isn't an IP or CIDR network", v)
+		}
+	}
+	*c = append(*c, n)
+	return nil
+}
+
+var allowCIDRs cidrFlags
+
+func init() {
+	clientFlags.Var(&allowCIDRs, "allow_cidr", "Network in CIDR notation, or IP, that clients may connect to the listeners from, "+
+		"connections from elsewhere being rejected. Can be repeated. Without any, clients may connect from anywhere.")
+}
+
+// allowedSource returns whether -allow_cidr lets a client connect from addr. Unix socket clients are always allowed,
+// the socket's permissions decide who may connect.
+func allowedSource(addr net.Addr) bool {
+	if len(allowCIDRs) == 0 {
+		return true
+	}
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	default:
+		return true
+	}
+	for _, n := range allowCIDRs {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowListener is a net.Listener that closes the connections -allow_cidr, -allow_uid and -allow_gid don't allow
+// as it accepts them.
+type allowListener struct {
+	net.Listener
+}
+
+func (l allowListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if !allowedSource(conn.RemoteAddr()) {
+			logWarn("Rejecting connection not allowed by -allow_cidr", "remote", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		if ok, uid, gid := allowedPeer(conn); !ok {
+			logWarn("Rejecting connection not allowed by -allow_uid or -allow_gid", "uid", uid, "gid", gid)
+			conn.Close()
+			continue
+		}
+		return conn, nil
+	}
+}
@@ -0,0 +1,50 @@
+package wstunnel
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	reconnectBackoff    = clientFlags.Duration("reconnect_backoff", time.Second, "Delay before the first attempt to reestablish a lost persistent connection to the server, doubling with each failed attempt")
+	reconnectMaxBackoff = clientFlags.Duration("reconnect_max_backoff", time.Minute, "Maximum delay between attempts to reestablish a lost persistent connection to the server")
+	reconnectMaxRetries = clientFlags.Int("reconnect_max_retries", 0, "Failed attempts to reestablish a lost persistent connection to the server before giving up, or 0 for no limit")
+)
+
+var (
+	jitterMu sync.Mutex
+	jitter   = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// backoff paces the attempts to reestablish a persistent connection to the server, as set by the -reconnect_* flags.
+type backoff struct {
+	attempts int
+}
+
+// next returns the delay before the next attempt, or false if there are no attempts left. Delays are randomized
+// between half and all of their nominal value, so that clients that lost the server at once don't all come back at once.
+func (b *backoff) next() (time.Duration, bool) {
+	if *reconnectMaxRetries > 0 && b.attempts >= *reconnectMaxRetries {
+		return 0, false
+	}
+	d := *reconnectBackoff
+	for i := 0; i < b.attempts && d < *reconnectMaxBackoff; i++ {
+		d *= 2
+	}
+	if d > *reconnectMaxBackoff {
+		d = *reconnectMaxBackoff
+	}
+	b.attempts++
+	atomic.AddInt64(&reconnectAttempts, 1)
+
+	jitterMu.Lock()
+	defer jitterMu.Unlock()
+	return d/2 + time.Duration(jitter.Int63n(int64(d/2)+1)), true
+}
+
+// reset starts over after a successful attempt.
+func (b *backoff) reset() {
+	b.attempts = 0
+}
@@ -0,0 +1,160 @@
+package wstunnel
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var balance = clientFlags.String("balance", "round_robin", "How new tunnels are spread across the servers of a comma-separated "+
+	"-target_host: round_robin, or least_conns for the server with the fewest tunnels open. A tunnel that can't reach "+
+	"its server tries the others.")
+
+// balancedTargets are the servers of -target_host after the first, which tunnels are balanced across with it.
+var balancedTargets []string
+
+// splitTargets returns the first of the comma-separated servers of target, and the others.
+func splitTargets(target string) (string, []string) {
+	targets := strings.Split(target, ",")
+	for i := range targets {
+		targets[i] = strings.TrimSpace(targets[i])
+	}
+	return targets[0], targets[1:]
+}
+
+// balancer spreads the tunnels to a server across others serving the same, the first being the server itself.
+type balancer struct {
+	servers []*websocketConfig
+
+	mu      sync.Mutex
+	next    int         // The server next in turn.
+	active  []int       // The tunnels open to each server.
+	healthy []bool      // Whether each server passed its latest health check, see -health_check_interval.
+	failed  []time.Time // When each server last failed a health check or a tunnel, zero if never.
+}
+
+// getBalancer returns the balancer of wsConfig, the config of tunnel t, or nil if t has a single server.
+func getBalancer(t tunnelConfig, wsConfig *websocketConfig) (*balancer, error) {
+	if len(t.servers) == 0 {
+		return nil, nil
+	}
+	b := &balancer{servers: []*websocketConfig{wsConfig}}
+	for _, spec := range t.servers {
+		s := t
+		s.servers, s.Fallbacks = nil, nil
+		var err error
+		if s.TargetHost, s.url, err = targetURL(spec); err != nil {
+			return nil, err
+		}
+		config, err := getWsConfig(s)
+		if err != nil {
+			return nil, fmt.Errorf("Server %s: %v", spec, err)
+		}
+		b.servers = append(b.servers, config)
+	}
+	b.active = make([]int, len(b.servers))
+	b.healthy = make([]bool, len(b.servers))
+	b.failed = make([]time.Time, len(b.servers))
+	for i := range b.healthy {
+		b.healthy[i] = true
+	}
+	return b, nil
+}
+
+// order returns the servers to try for a new tunnel, in turn with -balance=round_robin, or the least busy first
+// with least_conns, ties going in turn. Servers failing their health checks come last, the one that failed
+// least recently first. While they all fail them, it returns none with -all_unhealthy=fail.
+func (b *balancer) order() []int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	order := make([]int, len(b.servers))
+	for i := range order {
+		order[i] = (b.next + i) % len(b.servers)
+	}
+	b.next = (b.next + 1) % len(b.servers)
+	if *balance == "least_conns" {
+		sort.SliceStable(order, func(i, j int) bool { return b.active[order[i]] < b.active[order[j]] })
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		if b.healthy[order[i]] || b.healthy[order[j]] {
+			return b.healthy[order[i]] && !b.healthy[order[j]]
+		}
+		return b.failed[order[i]].Before(b.failed[order[j]])
+	})
+	if *allUnhealthy == "fail" && b.degraded() {
+		return nil
+	}
+	return order
+}
+
+// open opens a tunnel for wsConfig, a config of the balancer's first server possibly with headers of its own,
+// on the server in turn, or the next one that works.
+func (b *balancer) open(wsConfig *websocketConfig) (*tunnel, error) {
+	order := b.order()
+	if order == nil {
+		return nil, errors.New("Every server failed its health check, see -all_unhealthy")
+	}
+	var errs []string
+	for _, i := range order {
+		config := b.servers[i]
+		if i == 0 {
+			config = wsConfig
+		} else if wsConfig != b.servers[0] {
+			copied := *config
+			copied.Header = wsConfig.Header
+			config = &copied
+		}
+		t, err := openTunnelTo(config)
+		if err != nil {
+			logWarn("Failed connecting to the server, trying the next one", "server", config.Location.Host, "error", err)
+			errs = append(errs, err.Error())
+			b.mu.Lock()
+			b.failed[i] = time.Now()
+			b.mu.Unlock()
+			continue
+		}
+		b.track(i, t)
+		return t, nil
+	}
+	return nil, fmt.Errorf("No server could be reached: %s", strings.Join(errs, "; "))
+}
+
+// track counts t as open to server i until it's closed.
+func (b *balancer) track(i int, t *tunnel) {
+	b.mu.Lock()
+	b.active[i]++
+	b.mu.Unlock()
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			b.mu.Lock()
+			b.active[i]--
+			b.mu.Unlock()
+		})
+	}
+	if t.ws != nil {
+		t.ws.onClose = release
+	} else {
+		t.conn = releasingConn{t.conn, release}
+	}
+}
+
+// releasingConn is a stream calling release once it's closed.
+type releasingConn struct {
+	net.Conn
+	release func()
+}
+
+func (c releasingConn) CloseWrite() error {
+	closeWrite(c.Conn)
+	return nil
+}
+
+func (c releasingConn) Close() error {
+	c.release()
+	return c.Conn.Close()
+}
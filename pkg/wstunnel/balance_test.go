@@ -0,0 +1,93 @@
+package wstunnel
+
+import (
+	"net"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// fakeBalancer returns a balancer of n servers, each with a pool holding a tunnel over an in-memory pipe.
+func fakeBalancer(t *testing.T, n int) *balancer {
+	b := &balancer{active: make([]int, n), healthy: make([]bool, n), failed: make([]time.Time, n)}
+	for i := 0; i < n; i++ {
+		config := &websocketConfig{Location: &url.URL{Scheme: "ws", Host: net.JoinHostPort("faythe.com", strconv.Itoa(i+1))}}
+		config.Pool = &tunnelPool{config: config, tunnels: make(chan pooledTunnel, 1), free: make(chan struct{}, 1)}
+		a, c := net.Pipe()
+		t.Cleanup(func() { a.Close(); c.Close() })
+		config.Pool.tunnels <- pooledTunnel{&tunnel{conn: a}, time.Now()}
+		b.servers = append(b.servers, config)
+		b.healthy[i] = true
+	}
+	return b
+}
+
+// failAll has every server of b fail its health check, the one at index i having failed the offset at i
+// after the others.
+func failAll(b *balancer, offsets ...time.Duration) {
+	for i := range b.servers {
+		b.setHealthy(i, net.ErrClosed)
+	}
+	now := time.Now()
+	for i, d := range offsets {
+		b.failed[i] = now.Add(d)
+	}
+}
+
+// opened returns the index of the server whose pool a tunnel was taken from, or -1 if none.
+func opened(b *balancer) int {
+	for i, s := range b.servers {
+		if len(s.Pool.tunnels) == 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestAllUnhealthyTryAnyway(t *testing.T) {
+	defer func(s string) { *allUnhealthy = s }(*allUnhealthy)
+	*allUnhealthy = "try_anyway"
+	b := fakeBalancer(t, 3)
+	failAll(b, 2*time.Second, time.Second, 3*time.Second)
+	if !b.isDegraded() {
+		t.Fatal("The balancer isn't degraded with every server unhealthy")
+	}
+	if _, err := b.open(b.servers[0]); err != nil {
+		t.Fatalf("open() = %v with -all_unhealthy=try_anyway", err)
+	}
+	if i := opened(b); i != 1 {
+		t.Errorf("The tunnel went to server %d, want the one that failed least recently, 1", i)
+	}
+
+	b.setHealthy(2, nil)
+	if b.isDegraded() {
+		t.Error("The balancer is still degraded with a server healthy again")
+	}
+	if order := b.order(); order[0] != 2 {
+		t.Errorf("order() = %v, want the healthy server 2 first", order)
+	}
+}
+
+func TestAllUnhealthyFail(t *testing.T) {
+	defer func(s string) { *allUnhealthy = s }(*allUnhealthy)
+	*allUnhealthy = "fail"
+	b := fakeBalancer(t, 2)
+	b.setHealthy(0, net.ErrClosed)
+	if _, err := b.open(b.servers[0]); err != nil {
+		t.Fatalf("open() = %v with a server healthy", err)
+	}
+	if i := opened(b); i != 1 {
+		t.Errorf("The tunnel went to server %d, want the healthy one, 1", i)
+	}
+
+	failAll(b)
+	if _, err := b.open(b.servers[0]); err == nil {
+		t.Fatal("open() succeeded with every server unhealthy and -all_unhealthy=fail")
+	}
+	for i, s := range b.servers {
+		if i != 1 && len(s.Pool.tunnels) == 0 {
+			t.Errorf("Server %d was tried with -all_unhealthy=fail", i)
+		}
+	}
+}
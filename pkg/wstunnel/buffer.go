@@ -0,0 +1,36 @@
+package wstunnel
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+var bufferSize = sharedFlags.Int("buffer_size", 32*1024, "Size in bytes of the buffers tunneled data is copied through, "+
+	"which is also the most a websocket message carries. Larger ones trade memory for throughput on fast links.")
+
+var (
+	// copyBuffers are the buffers of the copies in progress, reused across connections rather than
+	// allocated for each, which adds up to a lot of garbage with thousands of them.
+	copyBuffers = sync.Pool{New: func() interface{} {
+		b := make([]byte, *bufferSize)
+		return &b
+	}}
+	// wsWriteBuffers are the buffers websocket messages are written through, which connections only hold
+	// while writing one rather than for their whole life.
+	wsWriteBuffers = &sync.Pool{}
+)
+
+// copyData is io.Copy through a buffer from copyBuffers, or with the kernel moving the data itself
+// where both ends are TCP connections, which Linux splices.
+func copyData(dst io.Writer, src io.Reader) (int64, error) {
+	if d, ok := dst.(*net.TCPConn); ok {
+		if s, ok := src.(*net.TCPConn); ok {
+			return d.ReadFrom(s)
+		}
+	}
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+	// Hides ReadFrom and WriteTo, which copy through buffers of their own otherwise.
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, *buf)
+}
@@ -0,0 +1,167 @@
+package wstunnel
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Names certificate files are looked up by in a certs directory, in order of preference. Besides our
+// own names, these cover the ones of Kubernetes TLS secrets.
+var (
+	caCertNames = []string{"cacert.pem", "ca.crt", "ca.pem"}
+	certNames   = []string{"cert.pem", "tls.crt", "tls.pem"}
+	keyNames    = []string{"key.pem", "tls.key"}
+)
+
+// findCertFile returns the path of the first of names that exists in dir, or "" if none does.
+func findCertFile(dir string, names []string) string {
+	for _, name := range names {
+		if _, err := os.Stat(path.Join(dir, name)); err == nil {
+			return path.Join(dir, name)
+		}
+	}
+	return ""
+}
+
+// caCertFile returns the path of the CA certificate in dir, defaulting to cacert.pem if there's none.
+func caCertFile(dir string) string {
+	if f := findCertFile(dir, caCertNames); f != "" {
+		return f
+	}
+	return path.Join(dir, caCertNames[0])
+}
+
+// loadKeyPair loads the certificate and key in dir. Without a separate key file, the key is expected
+// in the certificate file, as a combined PEM.
+func loadKeyPair(dir string) (tls.Certificate, error) {
+	cert := findCertFile(dir, certNames)
+	if cert == "" {
+		cert = path.Join(dir, certNames[0])
+	}
+	key := findCertFile(dir, keyNames)
+	if key == "" {
+		key = cert
+	}
+	return tls.LoadX509KeyPair(cert, key)
+}
+
+var certsReloadInterval = sharedFlags.Duration("certs_reload_interval", 0, "Interval to reload the certificates from their "+
+	"certs directories at, so that they can rotate without a restart, or 0 to only reload them on SIGHUP")
+
+// certStore holds the certificate and CA certificate of a certs directory as of their latest reload, for the
+// TLS configs of connections to use.
+type certStore struct {
+	dir        string
+	optionalCA bool // Whether the CA certificate may be missing, leaving the pool nil.
+
+	mu   sync.RWMutex
+	cert tls.Certificate
+	ca   []byte
+	pool *x509.CertPool
+}
+
+// certStores are the stores to reload on SIGHUP or every -certs_reload_interval.
+var certStores []*certStore
+
+func newCertStore(dir string, optionalCA bool) (*certStore, error) {
+	s := &certStore{dir: dir, optionalCA: optionalCA}
+	if _, err := s.reload(); err != nil {
+		return nil, err
+	}
+	certStores = append(certStores, s)
+	return s, nil
+}
+
+// reload loads the certificates from the directory again, returning whether they changed.
+func (s *certStore) reload() (bool, error) {
+	cert, err := loadKeyPair(s.dir)
+	if err != nil {
+		return false, fmt.Errorf("Failed reading certificate from %s: %v", s.dir, err)
+	}
+	var ca []byte
+	var pool *x509.CertPool
+	if f := findCertFile(s.dir, caCertNames); f != "" || !s.optionalCA {
+		if ca, err = ioutil.ReadFile(caCertFile(s.dir)); err != nil {
+			return false, fmt.Errorf("Failed reading CA certificate: %v", err)
+		}
+		pool = x509.NewCertPool()
+		pool.AppendCertsFromPEM(ca)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := !bytes.Equal(ca, s.ca) || len(cert.Certificate) != len(s.cert.Certificate)
+	for i := 0; !changed && i < len(cert.Certificate); i++ {
+		changed = !bytes.Equal(cert.Certificate[i], s.cert.Certificate[i])
+	}
+	s.cert, s.ca, s.pool = cert, ca, pool
+	return changed, nil
+}
+
+// caPool returns the pool of the CA certificate, nil if there's none.
+func (s *certStore) caPool() *x509.CertPool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.pool
+}
+
+// clientConfig returns a copy of base presenting the latest certificate, and verifying servers against the latest CA.
+func (s *certStore) clientConfig(base *tls.Config) *tls.Config {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	cfg := base.Clone()
+	cfg.Certificates = []tls.Certificate{s.cert}
+	cfg.RootCAs = s.pool
+	return cfg
+}
+
+// serverConfig returns a copy of base presenting the latest certificate, and verifying clients against the latest CA.
+// It's reloaded on every handshake.
+func (s *certStore) serverConfig(base *tls.Config) *tls.Config {
+	s.mu.RLock()
+	cfg := base.Clone()
+	cfg.Certificates = []tls.Certificate{s.cert}
+	cfg.ClientCAs = s.pool
+	s.mu.RUnlock()
+	cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		return s.serverConfig(base), nil
+	}
+	return cfg
+}
+
+// watchCertStores reloads the certificates on SIGHUP, and every -certs_reload_interval if set.
+func watchCertStores() {
+	if len(certStores) == 0 {
+		return
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	var tick <-chan time.Time
+	if *certsReloadInterval > 0 {
+		tick = time.NewTicker(*certsReloadInterval).C
+	}
+	go func() {
+		for {
+			select {
+			case <-hup:
+			case <-tick:
+			}
+			for _, s := range certStores {
+				if changed, err := s.reload(); err != nil {
+					logError("Failed reloading certificates, keeping the previous ones", "dir", s.dir, "error", err)
+				} else if changed {
+					logInfo("Reloaded certificates", "dir", s.dir)
+				}
+			}
+		}
+	}()
+}
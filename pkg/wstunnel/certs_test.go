@@ -0,0 +1,76 @@
+package wstunnel
+
+import (
+	"bytes"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// moveCert moves the file from of the certs directory src to to in dst.
+func moveCert(t *testing.T, src, from, dst, to string) {
+	if err := os.Rename(filepath.Join(src, from), filepath.Join(dst, to)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// loadCertStore returns the store of dir, without adding it to the ones reloaded.
+func loadCertStore(t *testing.T, dir string) *certStore {
+	defer func(stores []*certStore) { certStores = stores }(certStores)
+	s, err := newCertStore(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestCertsKubernetesNames(t *testing.T) {
+	cert, _ := selfSigned(t)
+	dir := writeCertsDir(t, cert)
+	moveCert(t, dir, "cacert.pem", dir, "ca.crt")
+	moveCert(t, dir, "cert.pem", dir, "tls.crt")
+	moveCert(t, dir, "key.pem", dir, "tls.key")
+
+	s := loadCertStore(t, dir)
+	if !bytes.Equal(s.cert.Certificate[0], cert.Certificate[0]) {
+		t.Error("Didn't load the certificate from tls.crt and tls.key")
+	}
+	if _, err := cert.Leaf.Verify(x509.VerifyOptions{Roots: s.caPool()}); err != nil {
+		t.Errorf("Didn't load the CA certificate from ca.crt: %v", err)
+	}
+}
+
+func TestCertsCombinedPEM(t *testing.T) {
+	cert, _ := selfSigned(t)
+	dir := writeCertsDir(t, cert)
+	var combined []byte
+	for _, name := range []string{"cert.pem", "key.pem"} {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		combined = append(combined, b...)
+		os.Remove(filepath.Join(dir, name))
+	}
+	if err := os.WriteFile(filepath.Join(dir, "tls.pem"), combined, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if s := loadCertStore(t, dir); !bytes.Equal(s.cert.Certificate[0], cert.Certificate[0]) {
+		t.Error("Didn't load the certificate and key from the combined tls.pem")
+	}
+}
+
+func TestCertsPreferOwnNames(t *testing.T) {
+	ours, _ := selfSigned(t)
+	theirs, _ := selfSigned(t)
+	dir := writeCertsDir(t, ours)
+	theirDir := writeCertsDir(t, theirs)
+	moveCert(t, theirDir, "cert.pem", dir, "tls.crt")
+	moveCert(t, theirDir, "key.pem", dir, "tls.key")
+
+	if s := loadCertStore(t, dir); !bytes.Equal(s.cert.Certificate[0], ours.Certificate[0]) {
+		t.Error("Loaded tls.crt rather than cert.pem, want cert.pem first")
+	}
+}
@@ -0,0 +1,663 @@
+package wstunnel
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/net/proxy"
+)
+
+// readerConn is a net.Conn reading from Reader.
+type readerConn struct {
+	net.Conn
+	io.Reader
+}
+
+func (c readerConn) Read(b []byte) (int, error) {
+	return c.Reader.Read(b)
+}
+
+// oneByteReader returns a byte per read, to split frames at every point.
+type oneByteReader struct{ io.Reader }
+
+func (r oneByteReader) Read(b []byte) (int, error) {
+	return r.Reader.Read(b[:1])
+}
+
+func TestFrameValidator(t *testing.T) {
+	const handshake = "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n\r\n"
+	for _, tc := range []struct {
+		name  string
+		frame []byte
+		want  error
+	}{
+		{"binary", []byte{0x82, 3, 'a', 'b', 'c'}, nil},
+		{"fragmented", []byte{0x02, 1, 'a', 0x80, 1, 'b'}, nil},
+		{"long", append([]byte{0x82, 126, 0x01, 0x00}, make([]byte, 256)...), nil},
+		{"ping", []byte{0x89, 0}, nil},
+		{"close", []byte{0x88, 2, 0x03, 0xe8}, nil},
+		{"bad opcode", []byte{0x83, 0}, errBadOpcode},
+		{"reserved bits", []byte{0xa2, 0}, errReservedBits},
+		{"masked", []byte{0x82, 0x81, 1, 2, 3, 4, 'a'}, errMaskedFrame},
+		{"fragmented ping", []byte{0x09, 0}, errBadControlFrame},
+		{"oversized ping", append([]byte{0x89, 126, 0x00, 0x7e}, make([]byte, 126)...), errBadControlFrame},
+		{"close status 1005", []byte{0x88, 2, 0x03, 0xed}, errBadCloseStatus},
+		{"close status 999", []byte{0x88, 2, 0x03, 0xe7}, errBadCloseStatus},
+		{"truncated close status", []byte{0x88, 1, 0x03}, errBadCloseStatus},
+	} {
+		stream := append([]byte(handshake), tc.frame...)
+		for _, r := range []io.Reader{bytes.NewReader(stream), oneByteReader{bytes.NewReader(stream)}} {
+			_, err := io.ReadAll(&frameValidator{Conn: readerConn{Reader: r}})
+			if err != tc.want {
+				t.Errorf("%s: reading %x = %v, want %v", tc.name, tc.frame, err, tc.want)
+			}
+		}
+	}
+}
+
+func TestValidCloseStatus(t *testing.T) {
+	for code, want := range map[uint16]bool{
+		1000: true, 1001: true, 1011: true, 3000: true, 4999: true,
+		0: false, 999: false, 1004: false, 1005: false, 1006: false, 1015: false, 2999: false, 5000: false,
+	} {
+		if got := validCloseStatus(code); got != want {
+			t.Errorf("validCloseStatus(%d) = %v, want %v", code, got, want)
+		}
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	defer func(b *circuitBreaker) { breaker = b }(breaker)
+	b := &circuitBreaker{threshold: 3, window: time.Minute, cooldown: 50 * time.Millisecond}
+	breaker = b
+
+	for i := 0; i < 2; i++ {
+		if !b.allow() {
+			t.Fatalf("Attempt %d was rejected before reaching the threshold", i+1)
+		}
+		b.failure()
+	}
+	if !b.allow() {
+		t.Fatal("Attempt 3 was rejected before reaching the threshold")
+	}
+	b.failure()
+	if b.allow() {
+		t.Fatal("The breaker allowed an attempt after 3 consecutive failures")
+	}
+	if got := scrapeBreaker(t); got != "open" {
+		t.Errorf("The breaker metric reports %s, want open", got)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if !b.allow() {
+		t.Fatal("The breaker didn't allow a trial attempt after its cooldown")
+	}
+	if b.allow() {
+		t.Error("The breaker allowed a second attempt while half-open")
+	}
+	if got := scrapeBreaker(t); got != "half-open" {
+		t.Errorf("The breaker metric reports %s, want half-open", got)
+	}
+	b.failure()
+	if b.allow() {
+		t.Fatal("The breaker allowed an attempt after its trial attempt failed")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if !b.allow() {
+		t.Fatal("The breaker didn't allow a trial attempt after its second cooldown")
+	}
+	b.success()
+	if got := scrapeBreaker(t); got != "closed" {
+		t.Errorf("The breaker metric reports %s, want closed", got)
+	}
+	b.failure()
+	b.failure()
+	if !b.allow() {
+		t.Error("The breaker counted the failures from before it closed")
+	}
+}
+
+func TestCircuitBreakerWindow(t *testing.T) {
+	b := &circuitBreaker{threshold: 2, window: 20 * time.Millisecond, cooldown: time.Minute}
+	b.failure()
+	time.Sleep(30 * time.Millisecond)
+	b.failure()
+	if !b.allow() {
+		t.Error("The breaker opened on failures further apart than its window")
+	}
+	b.failure()
+	if b.allow() {
+		t.Error("The breaker didn't open on failures within its window")
+	}
+}
+
+// scrapeBreaker returns the state the metrics report the breaker in.
+func scrapeBreaker(t *testing.T) string {
+	state := ""
+	for sample, v := range scrape(t) {
+		if v == 1 && strings.HasPrefix(sample, "wstunnel_circuit_breaker_state{") {
+			state = strings.TrimSuffix(strings.TrimPrefix(sample, `wstunnel_circuit_breaker_state{state="`), `"}`)
+		}
+	}
+	return state
+}
+
+func TestPathToken(t *testing.T) {
+	defer func(helper, path string) { *pathTokenHelper, *targetPath = helper, path }(*pathTokenHelper, *targetPath)
+	*pathTokenHelper, *targetPath = "echo a/b c", "/tunnel/{token}"
+	paths := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths <- r.URL.EscapedPath()
+		websocketHandler(func(conn *wsConn) {}).ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	config, err := getWsConfig(tunnelConfig{TargetHost: server.Listener.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tunnel, err := dialTunnel(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunnel.data().Close()
+	if path := <-paths; path != "/tunnel/a%2Fb%20c" {
+		t.Errorf("The server saw the path %q, want /tunnel/a%%2Fb%%20c", path)
+	}
+}
+
+func TestPathTokenBlankHelper(t *testing.T) {
+	defer func(helper string) { *pathTokenHelper = helper }(*pathTokenHelper)
+	*pathTokenHelper = " "
+	if token, err := pathToken(); err == nil {
+		t.Errorf("pathToken() = %q with a blank -path_token_helper, want an error", token)
+	}
+}
+
+// tlsTunnelServer returns a wss:// server, valid for example.com, reporting the server name of every handshake
+// on names, and the websocket config of a client trusting it.
+func tlsTunnelServer(t *testing.T, tlscfg *tls.Config) (*websocketConfig, <-chan string) {
+	names := make(chan string, 10)
+	server := httptest.NewUnstartedServer(websocketHandler(func(conn *wsConn) {}))
+	server.TLS = tlscfg
+	if server.TLS == nil {
+		server.TLS = &tls.Config{}
+	}
+	server.TLS.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		names <- hello.ServerName
+		return nil, nil
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	client, err := NewClient(ClientConfig{ServerURL: "wss://" + server.Listener.Addr().String() + "/",
+		TLSConfig: &tls.Config{RootCAs: roots}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client.wsConfigs[0], names
+}
+
+func TestSNINames(t *testing.T) {
+	defer func(names string) { *sniNames = names }(*sniNames)
+	*sniNames = "faythe.com,example.com,example.org"
+	config, names := tlsTunnelServer(t, nil)
+
+	tunnel, err := dialTunnel(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunnel.data().Close()
+	if first, second := <-names, <-names; first != "faythe.com" || second != "example.com" {
+		t.Errorf("Handshakes for %q then %q, want faythe.com then example.com", first, second)
+	}
+	select {
+	case name := <-names:
+		t.Errorf("Handshake for %q after one succeeded", name)
+	default:
+	}
+
+	*sniNames = "faythe.com,faythe.org"
+	if _, err := dialTunnel(config); err == nil {
+		t.Error("dialTunnel() succeeded with none of -sni_names valid")
+	}
+}
+
+// stalledTunnel tunnels a client to a server answering the handshake with header, then sending nothing, and
+// returns how long handleConnection took to close the tunnel, or 0 if it's still open after a second.
+// With clientDone, the client is done sending from the start, leaving the tunnel half-closed.
+func stalledTunnel(t *testing.T, header http.Header, clientDone bool) time.Duration {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, header)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		<-release
+	}))
+	defer server.Close()
+	var once sync.Once
+	stop := func() { once.Do(func() { close(release) }) }
+	defer stop()
+	config, err := getWsConfig(tunnelConfig{TargetHost: server.Listener.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.metrics = &tunnelMetrics{}
+
+	client, conn := net.Pipe()
+	defer client.Close()
+	if clientDone {
+		client.Close()
+	}
+	done := make(chan time.Duration, 1)
+	start := time.Now()
+	go func() {
+		handleConnection(config, "", conn)
+		done <- time.Since(start)
+	}()
+	select {
+	case d := <-done:
+		return d
+	case <-time.After(time.Second):
+		client.Close()
+		stop()
+		<-done
+		return 0
+	}
+}
+
+func TestHalfCloseTimeout(t *testing.T) {
+	defer func(d time.Duration) { *halfCloseTimeout = d }(*halfCloseTimeout)
+	*halfCloseTimeout = 0
+	if d := stalledTunnel(t, nil, true); d != 0 {
+		t.Errorf("Half-closed tunnel closed after %v without -half_close_timeout, want it left open", d)
+	}
+	*halfCloseTimeout = 200 * time.Millisecond
+	if d := stalledTunnel(t, nil, true); d < *halfCloseTimeout || d >= time.Second {
+		t.Errorf("Half-closed tunnel closed after %v with -half_close_timeout=%v, want it closed at the timeout", d, *halfCloseTimeout)
+	}
+}
+
+func TestRequireTLSVersion(t *testing.T) {
+	defer func(version string) { *requireTLSVersion = version }(*requireTLSVersion)
+	config, _ := tlsTunnelServer(t, &tls.Config{MaxVersion: tls.VersionTLS12})
+
+	for _, tt := range []struct {
+		require string
+		ok      bool
+	}{
+		{"", true},
+		{"1.2", true},
+		{"1.3", false},
+	} {
+		*requireTLSVersion = tt.require
+		tunnel, err := dialTunnel(config)
+		if err == nil {
+			tunnel.data().Close()
+		}
+		if (err == nil) != tt.ok {
+			t.Errorf("dialTunnel() = %v with -require_tls_version=%q to a TLS 1.2 server, want success %v", err, tt.require, tt.ok)
+		}
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wstunnel.sock")
+	func(unix, mode string) { t.Cleanup(func() { *listenUnix, *listenMode = unix, mode }) }(*listenUnix, *listenMode)
+	*listenUnix, *listenMode = path, "0600"
+	client := startTunnel(t, ClientConfig{})
+	target := startTarget(t).Addr().String()
+
+	if _, answer, err := pingThrough(t, client, target); err != nil || answer != "pong!" {
+		t.Errorf("Ping through the TCP listener = %q, %v, want pong!", answer, err)
+	}
+	d, err := proxy.SOCKS5("unix", path, nil, proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := d.Dial("tcp", target)
+	if err != nil {
+		t.Fatalf("Failed connecting through -listen_unix: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("ping"))
+	answer := make([]byte, len("pong!"))
+	if _, err := io.ReadFull(conn, answer); string(answer) != "pong!" {
+		t.Errorf("Ping through -listen_unix = %q, %v, want pong!", answer, err)
+	}
+
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("-listen_unix socket has mode %v, %v, want the -listen_mode 0600", info.Mode().Perm(), err)
+	}
+}
+
+func TestAdminCloseSentinel(t *testing.T) {
+	defer func(sentinel string) { *adminCloseSentinel = sentinel }(*adminCloseSentinel)
+	*adminCloseSentinel = "CLOSE"
+	release := make(chan struct{})
+	server := httptest.NewServer(websocketHandler(func(conn *wsConn) {
+		conn.WriteMessage(websocket.BinaryMessage, []byte("hello "))
+		conn.WriteMessage(websocket.TextMessage, []byte("CLOSED "))
+		conn.WriteMessage(websocket.TextMessage, []byte("CLOSE"))
+		conn.WriteMessage(websocket.BinaryMessage, []byte("after"))
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+	config, err := getWsConfig(tunnelConfig{TargetHost: server.Listener.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.metrics = &tunnelMetrics{}
+	var info ConnInfo
+	config.OnClose = func(i ConnInfo) { info = i }
+
+	client, conn := net.Pipe()
+	defer client.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		b, _ := io.ReadAll(client)
+		received <- b
+	}()
+	handleConnection(config, "", conn)
+	if info.Err != errAdminClose {
+		t.Errorf("Tunnel closed with %v after the sentinel, want %v", info.Err, errAdminClose)
+	}
+	if got := string(<-received); got != "hello CLOSED " {
+		t.Errorf("Client received %q, want what the server sent before the sentinel", got)
+	}
+}
+
+func TestProxyConnectErrors(t *testing.T) {
+	defer func(user string) { *proxyUser = user }(*proxyUser)
+	*proxyUser = ""
+	for _, tt := range []struct {
+		name      string
+		user      *url.Userinfo
+		status    int
+		challenge string
+		want      string
+	}{
+		{"forbidden", nil, http.StatusForbidden, "", "refused CONNECT to faythe.com:443: 403 Forbidden"},
+		{"no credentials", nil, http.StatusProxyAuthRequired, `Basic realm="proxy"`,
+			`requires authentication (Proxy-Authenticate: Basic realm="proxy")`},
+		{"other scheme", url.UserPassword("alice", "password"), http.StatusProxyAuthRequired, "Negotiate",
+			"doesn't offer Basic authentication (Proxy-Authenticate: Negotiate)"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			proxyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.challenge != "" {
+					w.Header().Set("Proxy-Authenticate", tt.challenge)
+				}
+				w.WriteHeader(tt.status)
+			}))
+			defer proxyServer.Close()
+			proxyURL := &url.URL{Scheme: "http", Host: proxyServer.Listener.Addr().String(), User: tt.user}
+			conn, err := dialThroughProxy(getDialer(), proxyURL, "faythe.com:443")
+			if err == nil {
+				conn.Close()
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("dialThroughProxy() = %v, want an error with %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyConnectEarlyData(t *testing.T) {
+	proxyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// The server's first bytes arrive along with the response.
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\nhello"))
+	}))
+	defer proxyServer.Close()
+	conn, err := dialThroughProxy(getDialer(), &url.URL{Scheme: "http", Host: proxyServer.Listener.Addr().String()}, "faythe.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if b, err := io.ReadAll(conn); string(b) != "hello" {
+		t.Errorf("Read %q, %v through the proxy, want what followed its response", b, err)
+	}
+}
+
+func TestWarnInsecure(t *testing.T) {
+	defer func(understood bool) { *iUnderstandInsecure = understood }(*iUnderstandInsecure)
+	tunnel := tunnelConfig{Name: "plain", TargetHost: "faythe.com:80"}
+	config, err := getWsConfig(tunnel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name       string
+		config     *websocketConfig
+		understood bool
+		warned     bool
+	}{
+		{"ws://", config, false, true},
+		{"ws:// with -i_understand_insecure", config, true, false},
+		{"wss://", &websocketConfig{TlsConfig: &tls.Config{}}, false, false},
+	} {
+		*iUnderstandInsecure = tt.understood
+		line := captureLog("logfmt", func() { warnInsecure(tunnel, tt.config) })
+		if warned := strings.Contains(line, "level=warn") && strings.Contains(line, "tunnel=plain"); warned != tt.warned {
+			t.Errorf("%s: logged %q, want a warning %v", tt.name, line, tt.warned)
+		}
+	}
+}
+
+func TestIPVersion(t *testing.T) {
+	defer func(version string) { *ipVersion = version }(*ipVersion)
+	useResolver(t, stubDNS(t))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	// The stub resolves server.test to 127.0.0.1 only.
+	for _, tt := range []struct {
+		version string
+		ok      bool
+	}{
+		{"auto", true},
+		{"4", true},
+		{"6", false},
+	} {
+		*ipVersion = tt.version
+		conn, err := getProxiedConn(url.URL{Scheme: "ws", Host: "server.test:" + port})
+		if err == nil {
+			conn.Close()
+		}
+		if (err == nil) != tt.ok {
+			t.Errorf("getProxiedConn() = %v with -ip_version=%s to an IPv4 server, want success %v", err, tt.version, tt.ok)
+		}
+	}
+}
+
+func TestMaxPending(t *testing.T) {
+	func(max int, slots chan struct{}) {
+		t.Cleanup(func() { *maxPending, pendingSlots = max, slots })
+	}(*maxPending, pendingSlots)
+	*maxPending = 2
+	pendingSlots = make(chan struct{}, *maxPending)
+	// Tests calling handleConnection directly leave the counts off, as serve doesn't count their connections.
+	pending, reached := atomic.LoadInt64(&pendingTunnels), atomic.LoadInt64(&pendingLimitReached)
+
+	// The server holds the handshakes back until released.
+	handshakes := make(chan struct{}, 3)
+	release := make(chan struct{})
+	handler := websocketHandler(func(conn *wsConn) {})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handshakes <- struct{}{}
+		<-release
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	client := startTunnel(t, ClientConfig{ServerURL: "ws://" + server.Listener.Addr().String() + "/"})
+
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", client.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+	}
+	for i := 0; i < 2; i++ {
+		<-handshakes
+	}
+	select {
+	case <-handshakes:
+		t.Error("A third connection was accepted while -max_pending=2 were connecting")
+	case <-time.After(100 * time.Millisecond):
+	}
+	samples := scrape(t)
+	if got := samples["wstunnel_pending_tunnels"]; got != float64(pending+2) {
+		t.Errorf("wstunnel_pending_tunnels = %v, want %d", got, pending+2)
+	}
+	if got := samples["wstunnel_pending_limit_reached_total"]; got != float64(reached+1) {
+		t.Errorf("wstunnel_pending_limit_reached_total = %v, want %d", got, reached+1)
+	}
+
+	close(release)
+	select {
+	case <-handshakes:
+	case <-time.After(time.Second):
+		t.Error("The third connection wasn't accepted once the others were done connecting")
+	}
+}
+
+func TestNoHalfClose(t *testing.T) {
+	defer func(no bool, d time.Duration) { *noHalfClose, *halfCloseTimeout = no, d }(*noHalfClose, *halfCloseTimeout)
+	*noHalfClose, *halfCloseTimeout = true, 0
+	if d := stalledTunnel(t, nil, true); d == 0 || d >= 200*time.Millisecond {
+		t.Errorf("Tunnel closed after %v once the client was done sending with -no_half_close, want it closed at once", d)
+	}
+}
+
+func TestMaxLifetime(t *testing.T) {
+	defer func(d time.Duration) { *maxLifetime = d }(*maxLifetime)
+	for _, tt := range []struct {
+		name     string
+		lifetime time.Duration
+		header   string
+		want     time.Duration // 0 for no limit.
+	}{
+		{"no limit", 0, "", 0},
+		{"-max_lifetime", 200 * time.Millisecond, "", 200 * time.Millisecond},
+		{"header", 0, "200ms", 200 * time.Millisecond},
+		{"shorter header", 500 * time.Millisecond, "200ms", 200 * time.Millisecond},
+		{"longer header", 200 * time.Millisecond, "60", 200 * time.Millisecond},
+		{"invalid header", 0, "soon", 0},
+	} {
+		*maxLifetime = tt.lifetime
+		var header http.Header
+		if tt.header != "" {
+			header = http.Header{"X-Tunnel-Max-Duration": {tt.header}}
+		}
+		d := stalledTunnel(t, header, false)
+		if tt.want == 0 && d != 0 || tt.want != 0 && (d < tt.want || d >= 2*tt.want) {
+			t.Errorf("%s: tunnel closed after %v, want it closed after %v, or never if 0", tt.name, d, tt.want)
+		}
+	}
+}
+
+func TestOneway(t *testing.T) {
+	defer func(o bool, grace time.Duration) { *oneway, *onewayGrace = o, grace }(*oneway, *onewayGrace)
+	*oneway, *onewayGrace = true, 200*time.Millisecond
+
+	// The server reads what the client streams, and never answers.
+	received := make(chan string, 1)
+	release := make(chan struct{})
+	server := httptest.NewServer(websocketHandler(func(conn *wsConn) {
+		b := make([]byte, len("log line\n"))
+		_, err := io.ReadFull(conn, b)
+		if err != nil {
+			t.Error(err)
+		}
+		received <- string(b)
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+	config, err := getWsConfig(tunnelConfig{TargetHost: server.Listener.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.metrics = &tunnelMetrics{}
+
+	client, conn := net.Pipe()
+	go func() {
+		client.Write([]byte("log line\n"))
+		client.Close()
+	}()
+	start := time.Now()
+	handleConnection(config, "", conn)
+	if d := time.Since(start); d < *onewayGrace || d >= time.Second {
+		t.Errorf("Write-only tunnel closed after %v with -oneway, want it closed after -oneway_grace=%v", d, *onewayGrace)
+	}
+	if got := <-received; got != "log line\n" {
+		t.Errorf("The server received %q, want what the client wrote", got)
+	}
+}
+
+// rejectedWith returns what client writes to a connection before closing it.
+func rejectedWith(t *testing.T, client *Client) string {
+	conn, err := net.Dial("tcp", client.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	b, err := io.ReadAll(conn)
+	if err != nil {
+		t.Errorf("Connection wasn't closed after %q: %v", b, err)
+	}
+	return string(b)
+}
+
+func TestRejectionBanners(t *testing.T) {
+	func(capacity, open string, b *circuitBreaker, slots chan struct{}) {
+		t.Cleanup(func() { *capacityBanner, *breakerBanner, breaker, connSlots = capacity, open, b, slots })
+	}(*capacityBanner, *breakerBanner, breaker, connSlots)
+	*capacityBanner, *breakerBanner = "busy, try later\n", "server unavailable\n"
+	connSlots = make(chan struct{}, 1) // -max_conns=1
+	breaker = &circuitBreaker{threshold: 1, cooldown: time.Minute}
+	client := startTunnel(t, ClientConfig{})
+
+	breaker.failure()
+	if got := rejectedWith(t, client); got != *breakerBanner {
+		t.Errorf("Connection rejected by the open circuit breaker got %q, want -breaker_banner", got)
+	}
+	breaker.success()
+
+	// Waits for the rejected connection to give its slot back.
+	connSlots <- struct{}{}
+	if got := rejectedWith(t, client); got != *capacityBanner {
+		t.Errorf("Connection over -max_conns got %q, want -capacity_banner", got)
+	}
+}
@@ -0,0 +1,120 @@
+package wstunnel
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+var coalesceWindow = clientFlags.Duration("coalesce_window", 0, "Time to wait after a read from a client for more data to send "+
+	"to the server along with it, in a single websocket message, e.g. 2ms for protocols making many small writes, or 0 to send every read as is")
+
+// coalesceBuckets are the upper bounds of the buckets of the batch size histogram, in reads per message.
+var coalesceBuckets = []int64{1, 2, 4, 8, 16, 32, 64}
+
+// coalesceStats count the batches of reads from clients sent to the server as single messages with -coalesce_window.
+// A read is what a client wrote at once, and would have been a websocket frame of its own without it.
+type coalesceStats struct {
+	flushes, frames, bytes int64
+	batches                [8]int64 // Flushes by batch size, in the buckets of coalesceBuckets then one for larger ones.
+}
+
+// record counts a flush of frames reads adding up to n bytes.
+func (s *coalesceStats) record(frames, n int) {
+	atomic.AddInt64(&s.flushes, 1)
+	atomic.AddInt64(&s.frames, int64(frames))
+	atomic.AddInt64(&s.bytes, int64(n))
+	i := 0
+	for i < len(coalesceBuckets) && int64(frames) > coalesceBuckets[i] {
+		i++
+	}
+	atomic.AddInt64(&s.batches[i], 1)
+}
+
+// averages returns the frames per flush and bytes per frame so far, 0 before any flush.
+func (s *coalesceStats) averages() (framesPerFlush, bytesPerFrame float64) {
+	flushes, frames := atomic.LoadInt64(&s.flushes), atomic.LoadInt64(&s.frames)
+	if flushes == 0 || frames == 0 {
+		return 0, 0
+	}
+	return float64(frames) / float64(flushes), float64(atomic.LoadInt64(&s.bytes)) / float64(frames)
+}
+
+// writeCoalesceMetrics writes the coalescing stats of every tunnel in the Prometheus text format.
+func writeCoalesceMetrics(w io.Writer) {
+	perTunnel := func(name, typ, help string, value func(s *coalesceStats) string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+		for _, m := range allTunnelMetrics {
+			fmt.Fprintf(w, "%s{tunnel=%s} %s\n", name, labelValue(m.name), value(&m.coalesce))
+		}
+	}
+	perTunnel("wstunnel_coalesce_flushes_total", "counter", "Websocket messages sent to the server with -coalesce_window.",
+		func(s *coalesceStats) string { return fmt.Sprint(atomic.LoadInt64(&s.flushes)) })
+	perTunnel("wstunnel_coalesce_frames_total", "counter", "Reads from clients batched into those messages.",
+		func(s *coalesceStats) string { return fmt.Sprint(atomic.LoadInt64(&s.frames)) })
+	perTunnel("wstunnel_coalesce_frames_per_flush", "gauge", "Average reads from clients batched into a message.",
+		func(s *coalesceStats) string { perFlush, _ := s.averages(); return fmt.Sprint(perFlush) })
+	perTunnel("wstunnel_coalesce_bytes_per_frame", "gauge", "Average bytes of the reads from clients batched into messages.",
+		func(s *coalesceStats) string { _, perFrame := s.averages(); return fmt.Sprint(perFrame) })
+
+	const batch = "wstunnel_coalesce_batch_frames"
+	fmt.Fprintf(w, "# HELP %s Reads from clients batched into each message sent to the server.\n# TYPE %s histogram\n", batch, batch)
+	for _, m := range allTunnelMetrics {
+		var count int64
+		for i := range m.coalesce.batches {
+			count += atomic.LoadInt64(&m.coalesce.batches[i])
+			le := "+Inf"
+			if i < len(coalesceBuckets) {
+				le = fmt.Sprint(coalesceBuckets[i])
+			}
+			fmt.Fprintf(w, "%s_bucket{tunnel=%s,le=\"%s\"} %d\n", batch, labelValue(m.name), le, count)
+		}
+		fmt.Fprintf(w, "%s_sum{tunnel=%s} %d\n%s_count{tunnel=%s} %d\n", batch, labelValue(m.name), atomic.LoadInt64(&m.coalesce.frames),
+			batch, labelValue(m.name), count)
+	}
+}
+
+// coalesceAverages returns the frames per flush and bytes per frame across tunnels, for the periodic stats.
+func coalesceAverages() (framesPerFlush, bytesPerFrame float64) {
+	var total coalesceStats
+	for _, m := range allTunnelMetrics {
+		total.flushes += atomic.LoadInt64(&m.coalesce.flushes)
+		total.frames += atomic.LoadInt64(&m.coalesce.frames)
+		total.bytes += atomic.LoadInt64(&m.coalesce.bytes)
+	}
+	return total.averages()
+}
+
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// readBatch reads from src into buf, then, with a window, goes on reading what src gets within it of the first
+// read, until buf is full, so that the many small writes of chatty protocols are sent as a single message.
+// It returns the bytes read, and the reads they took.
+func readBatch(src io.Reader, buf []byte, window time.Duration) (n, reads int, err error) {
+	n, err = src.Read(buf)
+	d, ok := src.(readDeadliner)
+	if window <= 0 || !ok || n == 0 || err != nil {
+		return n, 1, err
+	}
+	d.SetReadDeadline(time.Now().Add(window))
+	defer d.SetReadDeadline(time.Time{})
+	reads = 1
+	for n < len(buf) {
+		m, err := src.Read(buf[n:])
+		if m > 0 {
+			n += m
+			reads++
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return n, reads, nil
+		}
+		if err != nil {
+			return n, reads, err
+		}
+	}
+	return n, reads, nil
+}
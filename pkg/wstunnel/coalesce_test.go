@@ -0,0 +1,94 @@
+package wstunnel
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeRecorder records the writes made to it.
+type writeRecorder struct {
+	writes []int
+}
+
+func (w *writeRecorder) Write(b []byte) (int, error) {
+	w.writes = append(w.writes, len(b))
+	return len(b), nil
+}
+
+// copyBursts copies to the server what a client writes in bursts of 8-byte writes, a burst of 8 then one of 1,
+// with window, and returns the sizes of the messages sent.
+func copyBursts(t *testing.T, window time.Duration, stats *coalesceStats) []int {
+	client, conn := net.Pipe()
+	go func() {
+		defer client.Close()
+		for _, burst := range []int{8, 1} {
+			for i := 0; i < burst; i++ {
+				client.Write([]byte("abcdefgh"))
+			}
+			time.Sleep(3 * window)
+		}
+	}()
+	var w writeRecorder
+	var pending, sent int64
+	c := make(chan error, 1)
+	copyToServer(&w, conn, &pending, counters{&sent}, window, stats, c)
+	if err := <-c; err != nil {
+		t.Fatal(err)
+	}
+	if sent != 9*8 {
+		t.Errorf("Sent %d bytes, want %d", sent, 9*8)
+	}
+	return w.writes
+}
+
+func TestCoalesce(t *testing.T) {
+	defer func(w time.Duration) { *coalesceWindow = w }(*coalesceWindow)
+	*coalesceWindow = 100 * time.Millisecond
+	defer func(m []*tunnelMetrics) { allTunnelMetrics = m }(allTunnelMetrics)
+	config := &websocketConfig{}
+	registerTunnelMetrics("chatty", config)
+
+	if got := copyBursts(t, 0, &config.metrics.coalesce); len(got) != 9 {
+		t.Errorf("Sent %v without -coalesce_window, want every write as is", got)
+	}
+	if got := copyBursts(t, *coalesceWindow, &config.metrics.coalesce); len(got) != 2 || got[0] != 64 || got[1] != 8 {
+		t.Errorf("Sent %v with -coalesce_window, want a message for each burst", got)
+	}
+
+	samples := scrape(t)
+	for name, want := range map[string]float64{
+		`wstunnel_coalesce_flushes_total{tunnel="chatty"}`:                 2,
+		`wstunnel_coalesce_frames_total{tunnel="chatty"}`:                  9,
+		`wstunnel_coalesce_frames_per_flush{tunnel="chatty"}`:              4.5,
+		`wstunnel_coalesce_bytes_per_frame{tunnel="chatty"}`:               8,
+		`wstunnel_coalesce_batch_frames_bucket{tunnel="chatty",le="1"}`:    1,
+		`wstunnel_coalesce_batch_frames_bucket{tunnel="chatty",le="4"}`:    1,
+		`wstunnel_coalesce_batch_frames_bucket{tunnel="chatty",le="8"}`:    2,
+		`wstunnel_coalesce_batch_frames_bucket{tunnel="chatty",le="+Inf"}`: 2,
+		`wstunnel_coalesce_batch_frames_sum{tunnel="chatty"}`:              9,
+		`wstunnel_coalesce_batch_frames_count{tunnel="chatty"}`:            2,
+	} {
+		if got, ok := samples[name]; !ok || got != want {
+			t.Errorf("%s = %v, want %v", name, got, want)
+		}
+	}
+
+	line := captureLog("logfmt", logStatsLine)
+	if !strings.Contains(line, "coalesce_frames_per_flush=4.50 coalesce_bytes_per_frame=8") {
+		t.Errorf("Periodic stats %q lack the coalescing averages", line)
+	}
+}
+
+func TestReadBatchFillsBuffer(t *testing.T) {
+	client, conn := net.Pipe()
+	defer client.Close()
+	go client.Write(bytes.Repeat([]byte("x"), 100))
+	buf := make([]byte, 40)
+	n, _, err := readBatch(conn, buf, time.Second)
+	if n != len(buf) || err != nil {
+		t.Errorf("readBatch() = %d, %v, want the buffer filled without waiting out the window", n, err)
+	}
+}
@@ -0,0 +1,298 @@
+package wstunnel
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+var configFile = clientFlags.String("config", "", "YAML file defining more tunnels to run alongside the one defined by flags, see README.md. "+
+	"The one defined by flags only runs if -target_host is set then.")
+
+// tunnelConfig defines a tunnel: where it listens, and how it reaches the server.
+type tunnelConfig struct {
+	Name       string `yaml:"name"`
+	Listen     string `yaml:"listen"` // host:port, unix:/path for a Unix socket, or \\.\pipe\name for a named pipe.
+	TargetHost string `yaml:"target_host"`
+	CertsDir   string `yaml:"certs_dir"`
+	ServerName string `yaml:"server_name"`
+	// Forward is the host:port the server connects the tunnel to, or empty for the client to send SOCKS5 requests itself.
+	Forward string `yaml:"forward"`
+	// UDP has the tunnel forward UDP rather than TCP, which requires Forward.
+	UDP bool `yaml:"udp"`
+	// Proxy is the URL of a SOCKS5 or HTTP proxy to reach the server through, instead of those from the environment.
+	Proxy string `yaml:"proxy"`
+	// Fallbacks are the servers to try in order when TargetHost can't be reached, as TargetHost.
+	Fallbacks []string `yaml:"fallbacks"`
+	// AuthToken and BasicAuth, or the files to read them from on every handshake, authenticate the tunnel's
+	// handshakes instead of -auth_token and -basic_auth if any is set.
+	AuthToken     string `yaml:"auth_token"`
+	AuthTokenFile string `yaml:"auth_token_file"`
+	BasicAuth     string `yaml:"basic_auth"`
+	BasicAuthFile string `yaml:"basic_auth_file"`
+
+	// url is the websocket URL TargetHost was given as, if it was, its path and query then taking
+	// precedence over -target_path and adding to -target_query.
+	url *url.URL
+	// servers are the other servers TargetHost was given with, comma-separated, to balance tunnels across.
+	servers []string
+}
+
+// targetURL returns the host:port of target, and target parsed as a websocket URL if it's
+// one rather than a host:port, in which case the port defaults to that of its scheme.
+func targetURL(target string) (string, *url.URL, error) {
+	if !strings.Contains(target, "://") {
+		if _, _, err := net.SplitHostPort(target); target != "" && err != nil {
+			return "", nil, fmt.Errorf("Target %q isn't host:port, with IPv6 addresses in brackets like [2001:db8::1]:443", target)
+		}
+		return target, nil, nil
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", nil, fmt.Errorf("Failed parsing target %q: %v", target, err)
+	}
+	port := ""
+	switch u.Scheme {
+	case "ws":
+		port = "80"
+	case "wss":
+		port = "443"
+	default:
+		return "", nil, fmt.Errorf("Target %q isn't a ws:// or wss:// URL", target)
+	}
+	if u.Port() != "" {
+		port = u.Port()
+	}
+	return net.JoinHostPort(u.Hostname(), port), u, nil
+}
+
+// forwardFlags are SSH-style port forwards, each run as a tunnel of its own: [bind_address:]port:host:hostport
+// for local ones, or [bind_address:]port for dynamic ones, where clients pick their target with SOCKS5.
+type forwardFlags struct {
+	dynamic bool
+	specs   []string
+}
+
+func forwardsFlag(name string, dynamic bool, usage string) *forwardFlags {
+	f := &forwardFlags{dynamic: dynamic}
+	clientFlags.Var(f, name, usage)
+	return f
+}
+
+func (f *forwardFlags) String() string {
+	return strings.Join(f.specs, ",")
+}
+
+func (f *forwardFlags) Set(v string) error {
+	_, target, err := parseForward(v, "")
+	if err != nil {
+		return err
+	}
+	if f.dynamic && target != "" {
+		return fmt.Errorf("Dynamic port forward %q isn't [bind_address:]port", v)
+	}
+	if !f.dynamic && target == "" {
+		return fmt.Errorf("Port forward %q isn't [bind_address:]port:host:hostport", v)
+	}
+	f.specs = append(f.specs, v)
+	return nil
+}
+
+var (
+	forwards = forwardsFlag("L", false, "Port forward as [bind_address:]port:host:hostport, like SSH's, listening on -listen_addr "+
+		"if no bind_address is given. Can be repeated. The listener of -port only runs alongside if -port is set explicitly.")
+	dynamicForwards = forwardsFlag("D", true, "Dynamic port forward as [bind_address:]port, like SSH's, where clients pick their "+
+		"target with SOCKS5 as on -port. Can be repeated, and -L's notes apply.")
+)
+
+// parseForward returns the address to listen on and the one to forward to of an SSH-style port forward,
+// the latter being empty for a dynamic one. Addresses may be [bracketed] IPv6 ones.
+func parseForward(s, defaultBind string) (listen, target string, err error) {
+	var fields []string
+	for rest := s; ; {
+		var f string
+		if strings.HasPrefix(rest, "[") {
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return "", "", fmt.Errorf("Unterminated [ in port forward %q", s)
+			}
+			f, rest = rest[1:end], rest[end+1:]
+		} else if i := strings.IndexByte(rest, ':'); i >= 0 {
+			f, rest = rest[:i], rest[i:]
+		} else {
+			f, rest = rest, ""
+		}
+		fields = append(fields, f)
+		if rest == "" {
+			break
+		}
+		if rest[0] != ':' {
+			return "", "", fmt.Errorf("Invalid port forward %q", s)
+		}
+		rest = rest[1:]
+	}
+
+	bind := defaultBind
+	if len(fields) == 2 || len(fields) == 4 {
+		bind, fields = fields[0], fields[1:]
+	}
+	if len(fields) != 1 && len(fields) != 3 {
+		return "", "", fmt.Errorf("Port forward %q isn't [bind_address:]port[:host:hostport]", s)
+	}
+	for i := 0; i < len(fields); i += 2 {
+		if _, err := strconv.ParseUint(fields[i], 10, 16); err != nil {
+			return "", "", fmt.Errorf("Invalid port %q in port forward %q", fields[i], s)
+		}
+	}
+	listen = net.JoinHostPort(bind, fields[0])
+	if len(fields) == 3 {
+		target = net.JoinHostPort(fields[1], fields[2])
+	}
+	return listen, target, nil
+}
+
+// forwardTunnels returns the tunnels of the -L and -D port forwards, which reach the server as the one defined by flags.
+func forwardTunnels() []tunnelConfig {
+	var tunnels []tunnelConfig
+	for _, f := range []*forwardFlags{forwards, dynamicForwards} {
+		name := "-L "
+		if f.dynamic {
+			name = "-D "
+		}
+		for _, spec := range f.specs {
+			listen, target, _ := parseForward(spec, *listenAddr)
+			t := flagTunnel()
+			t.Name, t.Listen, t.Forward, t.UDP = name+spec, listen, target, *udp && target != ""
+			tunnels = append(tunnels, t)
+		}
+	}
+	return tunnels
+}
+
+// tunnelProxies are the proxies set by tunnels, by the host:port of the server they reach through them.
+var tunnelProxies = map[string]*url.URL{}
+
+// targetHostURL is the websocket URL -target_host was given as, if it was.
+var targetHostURL *url.URL
+
+// flagTunnel returns the tunnel defined by flags.
+func flagTunnel() tunnelConfig {
+	t := tunnelConfig{
+		Name:       "flags",
+		Listen:     *listen,
+		TargetHost: *targetHost,
+		CertsDir:   *certsDir,
+		ServerName: *serverName,
+		Fallbacks:  fallbacks,
+		url:        targetHostURL,
+		servers:    balancedTargets,
+	}
+	if t.Listen == "" {
+		t.Listen = net.JoinHostPort(*listenAddr, fmt.Sprint(*port))
+	}
+	return t
+}
+
+// loadTunnels returns the tunnels defined in file, with the settings they leave empty taken from flags.
+func loadTunnels(file string) ([]tunnelConfig, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var config struct {
+		Tunnels    []tunnelConfig   `yaml:"tunnels"`
+		rateLimits `yaml:",inline"` // See loadRateLimits.
+	}
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return nil, fmt.Errorf("Failed parsing %s: %v", file, err)
+	}
+
+	defaults := flagTunnel()
+	names := map[string]bool{defaults.Name: true}
+	// Proxies are looked up by server, so tunnels to the same server must agree on theirs.
+	proxies := map[string]string{}
+	if defaults.TargetHost != "" {
+		proxies[defaults.TargetHost] = ""
+	}
+	for i := range config.Tunnels {
+		t := &config.Tunnels[i]
+		if t.Name == "" {
+			return nil, fmt.Errorf("Tunnel #%d in %s has no name", i+1, file)
+		}
+		if names[t.Name] {
+			return nil, fmt.Errorf("Tunnel name %q in %s is already taken", t.Name, file)
+		}
+		names[t.Name] = true
+		if t.Listen == "" {
+			return nil, fmt.Errorf("Tunnel %q in %s has no listen address", t.Name, file)
+		}
+		if t.TargetHost == "" {
+			t.TargetHost, t.url, t.servers = defaults.TargetHost, defaults.url, defaults.servers
+		} else {
+			t.TargetHost, t.servers = splitTargets(t.TargetHost)
+			if t.TargetHost, t.url, err = targetURL(t.TargetHost); err != nil {
+				return nil, fmt.Errorf("Tunnel %q in %s: %v", t.Name, file, err)
+			}
+			for _, s := range t.servers {
+				if _, _, err := targetURL(s); err != nil {
+					return nil, fmt.Errorf("Tunnel %q in %s: %v", t.Name, file, err)
+				}
+			}
+		}
+		if t.TargetHost == "" {
+			return nil, fmt.Errorf("Tunnel %q in %s has no target_host, and -target_host isn't set", t.Name, file)
+		}
+		if t.CertsDir == "" {
+			t.CertsDir = defaults.CertsDir
+		}
+		if t.ServerName == "" {
+			t.ServerName = defaults.ServerName
+		}
+		if t.Fallbacks == nil {
+			t.Fallbacks = defaults.Fallbacks
+		}
+		for _, f := range t.Fallbacks {
+			if _, _, err := targetURL(f); err != nil {
+				return nil, fmt.Errorf("Tunnel %q in %s: %v", t.Name, file, err)
+			}
+		}
+		if (t.AuthToken != "" || t.AuthTokenFile != "") && (t.BasicAuth != "" || t.BasicAuthFile != "") {
+			return nil, fmt.Errorf("Tunnel %q in %s has both an auth token and basic auth", t.Name, file)
+		}
+		if t.BasicAuth != "" && !strings.Contains(t.BasicAuth, ":") {
+			return nil, fmt.Errorf("Tunnel %q in %s has basic_auth that isn't user:password", t.Name, file)
+		}
+		if network, _ := splitNetwork(t.Listen); t.UDP && network != "tcp" {
+			return nil, fmt.Errorf("Tunnel %q in %s is UDP, which can only listen on host:port", t.Name, file)
+		}
+		if t.UDP && t.Forward == "" {
+			return nil, fmt.Errorf("Tunnel %q in %s is UDP, which requires forward", t.Name, file)
+		}
+		hosts := []string{t.TargetHost}
+		for _, s := range t.servers {
+			host, _, _ := targetURL(s)
+			hosts = append(hosts, host)
+		}
+		for _, host := range hosts {
+			if p, ok := proxies[host]; ok && p != t.Proxy {
+				return nil, fmt.Errorf("Tunnel %q in %s reaches %s through a different proxy than another tunnel", t.Name, file, host)
+			}
+			proxies[host] = t.Proxy
+		}
+		if t.Proxy != "" {
+			p, err := url.Parse(t.Proxy)
+			if err != nil {
+				return nil, fmt.Errorf("Tunnel %q in %s: Failed parsing proxy: %v", t.Name, file, err)
+			}
+			for _, host := range hosts {
+				tunnelProxies[host] = p
+			}
+		}
+	}
+	return config.Tunnels, nil
+}
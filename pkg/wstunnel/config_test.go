@@ -0,0 +1,175 @@
+package wstunnel
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeFile writes content to a file in a temporary directory, and returns its path.
+func writeFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPerTunnelAuth(t *testing.T) {
+	defer func(token string) { *authToken.value = token }(*authToken.value)
+	*authToken.value = "global"
+	got := make(chan string, 1)
+	handler := websocketHandler(func(*wsConn) {})
+	newServer := func() *httptest.Server {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got <- r.Header.Get("Authorization")
+			handler.ServeHTTP(w, r)
+		}))
+		t.Cleanup(s.Close)
+		return s
+	}
+	bearer, basic, global := newServer(), newServer(), newServer()
+	tokenFile := writeFile(t, "token", "s3cret\n")
+	file := writeFile(t, "tunnels.yaml", `tunnels:
+  - name: bearer
+    listen: 127.0.0.1:0
+    target_host: `+bearer.Listener.Addr().String()+`
+    auth_token_file: `+tokenFile+`
+  - name: basic
+    listen: 127.0.0.1:0
+    target_host: `+basic.Listener.Addr().String()+`
+    basic_auth: alice:password
+  - name: global
+    listen: 127.0.0.1:0
+    target_host: `+global.Listener.Addr().String()+`
+`)
+	tunnels, err := loadTunnels(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, want := range []string{
+		"Bearer s3cret",
+		"Basic " + base64.StdEncoding.EncodeToString([]byte("alice:password")),
+		"Bearer global",
+	} {
+		wsConfig, err := getWsConfig(tunnels[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		tun, err := dialTunnelOnce(wsConfig)
+		if err != nil {
+			t.Fatalf("Tunnel %q: %v", tunnels[i].Name, err)
+		}
+		tun.data().Close()
+		if auth := <-got; auth != want {
+			t.Errorf("Tunnel %q sent Authorization %q, want %q", tunnels[i].Name, auth, want)
+		}
+	}
+}
+
+func TestPerTunnelAuthConflict(t *testing.T) {
+	for _, tunnel := range []string{
+		"auth_token: a\n    basic_auth: alice:password",
+		"auth_token_file: /token\n    basic_auth_file: /creds",
+		"basic_auth: alice",
+	} {
+		file := writeFile(t, "tunnels.yaml", "tunnels:\n  - name: faythe\n    listen: 127.0.0.1:0\n    target_host: faythe.com:443\n    "+tunnel+"\n")
+		if _, err := loadTunnels(file); err == nil {
+			t.Errorf("loadTunnels() accepted %q", tunnel)
+		}
+	}
+}
+
+func TestParseForward(t *testing.T) {
+	for _, tc := range []struct {
+		spec, listen, target string
+	}{
+		{"8080", "localhost:8080", ""},
+		{"0.0.0.0:8080", "0.0.0.0:8080", ""},
+		{"[::1]:8080", "[::1]:8080", ""},
+		{":8080", ":8080", ""},
+		{"8080:bob.com:22", "localhost:8080", "bob.com:22"},
+		{"127.0.0.2:8080:bob.com:22", "127.0.0.2:8080", "bob.com:22"},
+		{"8080:[2001:db8::1]:22", "localhost:8080", "[2001:db8::1]:22"},
+		{"[::1]:8080:[2001:db8::1]:22", "[::1]:8080", "[2001:db8::1]:22"},
+	} {
+		listen, target, err := parseForward(tc.spec, "localhost")
+		if err != nil || listen != tc.listen || target != tc.target {
+			t.Errorf("parseForward(%q) = %q, %q, %v, want %q, %q", tc.spec, listen, target, err, tc.listen, tc.target)
+		}
+	}
+	for _, spec := range []string{"", "http", "70000", "8080:bob.com", "8080:bob.com:ssh", "a:b:8080:bob.com:22",
+		"[::1:8080", "[::1]8080", "8080:[2001:db8::1]22"} {
+		if listen, target, err := parseForward(spec, "localhost"); err == nil {
+			t.Errorf("parseForward(%q) = %q, %q, want an error", spec, listen, target)
+		}
+	}
+}
+
+func TestForwardFlags(t *testing.T) {
+	local := &forwardFlags{}
+	if err := local.Set("8080"); err == nil {
+		t.Error("-L accepted a dynamic port forward")
+	}
+	if err := local.Set("8080:bob.com:22"); err != nil {
+		t.Error(err)
+	}
+	dynamic := &forwardFlags{dynamic: true}
+	if err := dynamic.Set("8080:bob.com:22"); err == nil {
+		t.Error("-D accepted a local port forward")
+	}
+	if err := dynamic.Set("1080"); err != nil {
+		t.Error(err)
+	}
+	if local.String() != "8080:bob.com:22" || dynamic.String() != "1080" {
+		t.Errorf("The flags hold %q and %q", local, dynamic)
+	}
+}
+
+func TestTargetURL(t *testing.T) {
+	for _, tc := range []struct {
+		target, host, url string
+	}{
+		{"faythe.com:443", "faythe.com:443", ""},
+		{"[2001:db8::1]:443", "[2001:db8::1]:443", ""},
+		{"", "", ""},
+		{"ws://faythe.com/tunnel", "faythe.com:80", "ws://faythe.com/tunnel"},
+		{"wss://faythe.com/tunnel?tenant=alice", "faythe.com:443", "wss://faythe.com/tunnel?tenant=alice"},
+		{"wss://faythe.com:8443", "faythe.com:8443", "wss://faythe.com:8443"},
+		{"wss://[2001:db8::1]/", "[2001:db8::1]:443", "wss://[2001:db8::1]/"},
+	} {
+		host, u, err := targetURL(tc.target)
+		got := ""
+		if u != nil {
+			got = u.String()
+		}
+		if err != nil || host != tc.host || got != tc.url {
+			t.Errorf("targetURL(%q) = %q, %q, %v, want %q, %q", tc.target, host, got, err, tc.host, tc.url)
+		}
+	}
+	for _, target := range []string{"faythe.com", "2001:db8::1:443", "https://faythe.com/", "wss://faythe.com:%zz/"} {
+		if host, _, err := targetURL(target); err == nil {
+			t.Errorf("targetURL(%q) = %q, want an error", target, host)
+		}
+	}
+}
+
+func TestTargetURLPathAndQuery(t *testing.T) {
+	defer func(q queryFlags) { targetQuery = q }(targetQuery)
+	targetQuery = queryFlags{"token": {"secret"}}
+	host, u, err := targetURL("ws://faythe.com/tunnel?tenant=alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := getWsConfig(tunnelConfig{Name: "faythe", TargetHost: host, url: u})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := config.Location.String(), "ws://faythe.com:80/tunnel?tenant=alice&token=secret"; got != want {
+		t.Errorf("The handshake goes to %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,71 @@
+package wstunnel
+
+import (
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	drainTimeout = sharedFlags.Duration("drain_timeout", 10*time.Second, "Time tunnels still active at shutdown get to finish "+
+		"before they're cut off, or 0 to cut them off right away. A second signal cuts them off right away too.")
+	predrainDelay = sharedFlags.Duration("predrain_delay", 0, "Time between a shutdown signal and no longer taking new connections, "+
+		"during which the client's /readyz reports not ready so that load balancers stop sending them, or 0 for none")
+)
+
+// notReady is 1 once a shutdown signal arrived, for /readyz. Accessed atomically.
+var notReady int32
+
+// predrain marks the process as not ready, and waits for -predrain_delay, or until another signal arrives
+// on sig, in which case it returns false.
+func predrain(sig <-chan os.Signal) bool {
+	atomic.StoreInt32(&notReady, 1)
+	if *predrainDelay <= 0 {
+		return true
+	}
+	logInfo("Reporting not ready before no longer taking connections", "delay", *predrainDelay)
+	select {
+	case <-time.After(*predrainDelay):
+		return true
+	case s := <-sig:
+		logWarn("Cutting off tunnels", "signal", s)
+		return false
+	}
+}
+
+// shutdown closes listeners once predrain is done, and drains the count of active tunnels, unless another signal
+// arrives on sig meanwhile.
+func shutdown(listeners []io.Closer, active *int64, sig <-chan os.Signal) {
+	cont := predrain(sig)
+	for _, ln := range listeners {
+		ln.Close()
+	}
+	if cont {
+		drain(active, sig)
+	}
+}
+
+// drain waits for the count of active tunnels to drop to 0, for at most -drain_timeout or until another signal arrives on sig.
+func drain(active *int64, sig <-chan os.Signal) {
+	if atomic.LoadInt64(active) == 0 || *drainTimeout <= 0 {
+		return
+	}
+	logInfo("Draining tunnels", "active", atomic.LoadInt64(active), "timeout", *drainTimeout)
+
+	deadline := time.After(*drainTimeout)
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+	for atomic.LoadInt64(active) > 0 {
+		select {
+		case <-tick.C:
+		case <-deadline:
+			logWarn("Cutting off tunnels still active after -drain_timeout", "active", atomic.LoadInt64(active))
+			return
+		case s := <-sig:
+			logWarn("Cutting off tunnels still active", "signal", s, "active", atomic.LoadInt64(active))
+			return
+		}
+	}
+	logInfo("Drained all tunnels")
+}
@@ -0,0 +1,73 @@
+package wstunnel
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func readyz() int {
+	w := httptest.NewRecorder()
+	serveReadyz(w, httptest.NewRequest("GET", "/readyz", nil))
+	return w.Code
+}
+
+func TestPredrainReportsNotReadyFirst(t *testing.T) {
+	defer func(d time.Duration) { *predrainDelay = d }(*predrainDelay)
+	defer atomic.StoreInt32(&notReady, 0)
+	*predrainDelay = 200 * time.Millisecond
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if code := readyz(); code != http.StatusOK {
+		t.Fatalf("/readyz returned %d before shutting down, want 200", code)
+	}
+
+	var active int64
+	done := make(chan struct{})
+	go func() {
+		shutdown([]io.Closer{ln}, &active, make(chan os.Signal))
+		close(done)
+	}()
+	for deadline := time.Now().Add(time.Second); readyz() == http.StatusOK; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("/readyz didn't report not ready")
+		}
+	}
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("The listener was closed as soon as /readyz reported not ready: %v", err)
+	}
+	conn.Close()
+
+	<-done
+	if conn, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+		conn.Close()
+		t.Error("The listener still took connections after shutdown")
+	}
+	if code := readyz(); code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz returned %d after shutdown, want 503", code)
+	}
+}
+
+func TestPredrainCutShort(t *testing.T) {
+	defer func(d time.Duration) { *predrainDelay = d }(*predrainDelay)
+	defer atomic.StoreInt32(&notReady, 0)
+	*predrainDelay = time.Hour
+	sig := make(chan os.Signal, 1)
+	sig <- os.Interrupt
+	start := time.Now()
+	if predrain(sig) {
+		t.Error("predrain() = true after a second signal, want false")
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("predrain() took %v after a second signal", time.Since(start))
+	}
+}
@@ -0,0 +1,71 @@
+package wstunnel
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+
+	socks5 "github.com/armon/go-socks5"
+	"github.com/hashicorp/yamux"
+)
+
+// echoResolver resolves every name, as the echo server doesn't really connect anywhere.
+type echoResolver struct{}
+
+func (echoResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	return ctx, net.IPv4zero, nil
+}
+
+// echoConn reports TCP addresses, as go-socks5 expects them of the connections it dials.
+type echoConn struct {
+	net.Conn
+}
+
+func (echoConn) LocalAddr() net.Addr  { return &net.TCPAddr{IP: net.IPv4zero} }
+func (echoConn) RemoteAddr() net.Addr { return &net.TCPAddr{IP: net.IPv4zero} }
+
+// dialEcho returns a connection echoing back whatever is written to it, whatever the address.
+func dialEcho(ctx context.Context, network, addr string) (net.Conn, error) {
+	c, echo := net.Pipe()
+	go func() {
+		io.Copy(echo, echo)
+		echo.Close()
+	}()
+	return echoConn{c}, nil
+}
+
+// startEchoServer starts a websocket server at addr speaking the same protocol as the real server,
+// except that every connection made through it echoes, and returns its listener. It's meant for benchmarking
+// the client without external dependencies, not for production.
+func startEchoServer(addr string) (net.Listener, error) {
+	socks, err := socks5.New(&socks5.Config{Dial: dialEcho, Resolver: echoResolver{}})
+	if err != nil {
+		return nil, err
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	logWarn("Running a loopback echo server, for performance testing only", "listen", ln.Addr())
+	go http.Serve(ln, websocketHandler(func(conn *wsConn) {
+		if conn.Request().Header.Get(muxHeader) == "" {
+			socks.ServeConn(conn)
+			return
+		}
+		session, err := yamux.Server(conn, nil)
+		if err != nil {
+			return
+		}
+		defer session.Close()
+		for {
+			stream, err := session.Accept()
+			if err != nil {
+				return
+			}
+			go socks.ServeConn(stream)
+		}
+	}))
+	return ln, nil
+}
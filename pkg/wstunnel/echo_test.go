@@ -0,0 +1,42 @@
+package wstunnel
+
+import (
+	"io"
+	"testing"
+
+	"golang.org/x/net/proxy"
+)
+
+func TestEchoServer(t *testing.T) {
+	ln, err := startEchoServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client := startTunnel(t, ClientConfig{ServerURL: "ws://" + ln.Addr().String() + "/"})
+
+	d, err := proxy.SOCKS5("tcp", client.Addr().String(), nil, proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Whatever the target, nothing is connected to but the echo.
+	conn, err := d.Dial("tcp", "faythe.invalid:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, len("hello"))
+	if _, err := io.ReadFull(conn, b); err != nil || string(b) != "hello" {
+		t.Errorf("Read %q, %v through the echo server, want hello", b, err)
+	}
+
+	// It's what -probe_addr is meant to be run against.
+	var perr error
+	captureStdout(t, func() { perr = probe(client.wsConfigs[0], "faythe.invalid:7", 256, 3) })
+	if perr != nil {
+		t.Errorf("Probe against the echo server failed: %v", perr)
+	}
+}
@@ -0,0 +1,352 @@
+// Package wstunnel tunnels SOCKS5 over websockets. It's what the wstunnel command runs: NewFlagClient and
+// NewFlagServer return the client and server of the command, configured by its flags, while NewClient and
+// NewServer return ones configured in code, for programs embedding the tunnel.
+package wstunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	socks5 "github.com/armon/go-socks5"
+)
+
+// ClientConfig configures a Client.
+type ClientConfig struct {
+	// ListenAddr is the host:port to accept SOCKS5 connections on, e.g. 127.0.0.1:8080.
+	ListenAddr string
+	// ServerURL is the ws:// or wss:// URL of the server, e.g. wss://faythe.com/.
+	ServerURL string
+	// CertsDir is a directory of certificates as the client command's -certs_dir: the CA to verify the server
+	// against, and the certificate to authenticate the client with.
+	CertsDir string
+	// ServerName is the name to verify the server's certificate against, or empty for the host of ServerURL.
+	ServerName string
+	// TLSConfig, if set, is used to connect to wss:// URLs rather than the one made for CertsDir. See
+	// ClientTLSConfig for the settings filled in.
+	TLSConfig *tls.Config
+	// Header is added to every websocket handshake request, e.g. for authentication.
+	Header http.Header
+	// Origin is the Origin header of the websocket handshake requests, or empty for http://localhost/.
+	Origin string
+	// OnClose, if set, is called with the details of every connection once it's closed. It's called from the
+	// connection's goroutine, so it should return quickly.
+	OnClose func(ConnInfo)
+	// OnStateChange, if set, is called as every connection enters each of its states, from its goroutine
+	// like OnClose.
+	OnStateChange func(StateEvent)
+}
+
+// ConnInfo describes a connection tunneled by a Client, once it's closed.
+type ConnInfo struct {
+	// ClientAddr is the address of the program that connected to the client.
+	ClientAddr net.Addr
+	// ServerURL is the URL of the server the connection was tunneled to.
+	ServerURL string
+	// BytesToServer and BytesToClient count the data tunneled each way.
+	BytesToServer, BytesToClient int64
+	// Started is when the connection was accepted, and Duration how long it lasted.
+	Started  time.Time
+	Duration time.Duration
+	// Err is why the connection failed, or nil if it was tunneled until either side closed it.
+	Err error
+}
+
+// Client accepts connections on local listeners, and tunnels each of them to a server.
+type Client struct {
+	tunnels   []tunnelConfig
+	wsConfigs []*websocketConfig // The websocket config of each tunnel.
+	started   time.Time
+
+	mu        sync.Mutex
+	listeners []io.Closer           // The listeners of the tunnels.
+	closers   []io.Closer           // The other listeners, e.g. of -metrics_addr.
+	conns     map[net.Conn]struct{} // The connections being tunneled, nil once closed.
+	wg        sync.WaitGroup        // The connections being tunneled, and the loops accepting them.
+}
+
+func newClient(tunnels []tunnelConfig, wsConfigs []*websocketConfig) *Client {
+	return &Client{tunnels: tunnels, wsConfigs: wsConfigs, started: time.Now(), conns: map[net.Conn]struct{}{}}
+}
+
+// tunnel returns the config of the tunnel of a client for config.
+func (config ClientConfig) tunnel() (tunnelConfig, error) {
+	host, u, err := targetURL(config.ServerURL)
+	if err != nil {
+		return tunnelConfig{}, err
+	}
+	if u == nil {
+		return tunnelConfig{}, fmt.Errorf("Server URL %q isn't ws:// or wss://", config.ServerURL)
+	}
+	return tunnelConfig{Name: config.ListenAddr, Listen: config.ListenAddr, TargetHost: host, CertsDir: config.CertsDir,
+		ServerName: config.ServerName, url: u}, nil
+}
+
+// tlsConfig returns the TLS config of tunnel t of a client for config, as getTlsConfig does.
+func (config ClientConfig) tlsConfig(t tunnelConfig) (*tls.Config, *certStore, error) {
+	if config.TLSConfig == nil || t.url.Scheme != "wss" {
+		return getTlsConfig(t)
+	}
+	tlscfg := config.TLSConfig.Clone()
+	// Clone shares the Certificates slice, so that changing the copy's would change config.TLSConfig's.
+	tlscfg.Certificates = append([]tls.Certificate(nil), tlscfg.Certificates...)
+	if tlscfg.ServerName == "" {
+		tlscfg.ServerName = t.ServerName
+	}
+	if tlscfg.ServerName == "" {
+		tlscfg.ServerName = t.url.Hostname()
+	}
+	if tlscfg.MinVersion == 0 {
+		tlscfg.MinVersion = tls.VersionTLS12
+	}
+	return tlscfg, nil, nil
+}
+
+// ClientTLSConfig returns the TLS config a Client for config connects to the server with, or nil for a ws:// URL
+// without CertsDir, without connecting. It's the one the client command makes for -certs_dir, or config.TLSConfig
+// with the server name and a minimum version of TLS 1.2 filled in unless they are set already.
+// Each call returns a new copy, which the caller may change.
+func ClientTLSConfig(config ClientConfig) (*tls.Config, error) {
+	t, err := config.tunnel()
+	if err != nil {
+		return nil, err
+	}
+	tlscfg, _, err := config.tlsConfig(t)
+	return tlscfg, err
+}
+
+// NewClient returns a Client for config, to be started with Start. What config has no field for is set by the
+// client command's flags, as ParseClientFlags left them, their defaults otherwise.
+func NewClient(config ClientConfig) (*Client, error) {
+	t, err := config.tunnel()
+	if err != nil {
+		return nil, err
+	}
+	wsConfig, err := getWsConfig(t)
+	if err != nil {
+		return nil, err
+	}
+	if wsConfig.TlsConfig, wsConfig.Certs, err = config.tlsConfig(t); err != nil {
+		return nil, err
+	}
+	if wsConfig.TlsConfig != nil {
+		wsConfig.Location.Scheme = "wss"
+	}
+	if config.Origin != "" {
+		wsConfig.Origin = config.Origin
+	}
+	for k, v := range config.Header {
+		wsConfig.Header[k] = v
+	}
+	wsConfig.OnClose, wsConfig.OnStateChange = config.OnClose, config.OnStateChange
+	wsConfig.metrics = &tunnelMetrics{name: t.Name, balancer: wsConfig.Balancer}
+	return newClient([]tunnelConfig{t}, []*websocketConfig{wsConfig}), nil
+}
+
+// Start starts listening, and tunneling the connections accepted until ctx is done or Close is called.
+func (c *Client) Start(ctx context.Context) error {
+	if err := c.listen(ctx); err != nil {
+		c.Close()
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		c.Close()
+	}()
+	return nil
+}
+
+// Addr returns the address the first tunnel of the client listens on, once started.
+func (c *Client) Addr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, l := range c.listeners {
+		switch l := l.(type) {
+		case net.Listener:
+			return l.Addr()
+		case net.PacketConn:
+			return l.LocalAddr()
+		}
+	}
+	return nil
+}
+
+// Close stops listening and closes the connections being tunneled, waiting for them to be done.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	var err error
+	for _, l := range append(c.listeners, c.closers...) {
+		if cerr := l.Close(); err == nil {
+			err = cerr
+		}
+	}
+	c.listeners, c.closers = nil, nil
+	for conn := range c.conns {
+		conn.Close()
+	}
+	c.conns = nil
+	c.mu.Unlock()
+	c.wg.Wait()
+	return err
+}
+
+// addListener adds a listener of the client's tunnels, addCloser one of its other listeners.
+func (c *Client) addListener(l io.Closer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.listeners = append(c.listeners, l)
+}
+
+func (c *Client) addCloser(l io.Closer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closers = append(c.closers, l)
+}
+
+// track adds conn to the connections being tunneled until untrack is called, unless the client was closed
+// in the meantime, in which case it returns false.
+func (c *Client) track(conn net.Conn) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conns == nil {
+		return false
+	}
+	c.conns[conn] = struct{}{}
+	c.wg.Add(1)
+	return true
+}
+
+func (c *Client) untrack(conn net.Conn) {
+	c.mu.Lock()
+	delete(c.conns, conn)
+	c.mu.Unlock()
+	c.wg.Done()
+}
+
+// ServerConfig configures a Server.
+type ServerConfig struct {
+	// ListenAddr is the host:port to accept websocket connections on, e.g. :443.
+	ListenAddr string
+	// TLSConfig makes the server serve wss:// with it, or ws:// if nil.
+	TLSConfig *tls.Config
+	// Rules decides which SOCKS5 requests and UDP targets are served, or nil to serve all of them.
+	Rules socks5.RuleSet
+}
+
+// Server serves the SOCKS5 requests tunneled to it over websockets.
+type Server struct {
+	listenAddr string
+	tlsConfig  *tls.Config
+	rules      socks5.RuleSet
+	socks      *socks5.Server
+	// The servers of -http_port and -https_port, nil for an embedded Server.
+	httpServer, httpsServer *http.Server
+
+	mu    sync.Mutex
+	http  *http.Server
+	ln    net.Listener
+	conns map[*wsConn]struct{} // The tunnels being served, nil once closed.
+	wg    sync.WaitGroup
+}
+
+func newServer(rules socks5.RuleSet) (*Server, error) {
+	socksConfig := &socks5.Config{Rules: rules}
+	if resolver != nil {
+		socksConfig.Resolver = targetResolver{resolver}
+	}
+	socks, err := socks5.New(socksConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{rules: rules, socks: socks, conns: map[*wsConn]struct{}{}}, nil
+}
+
+// NewServer returns a Server for config, to be started with Start. What config has no field for is set by the
+// server command's flags, as ParseServerFlags left them, their defaults otherwise.
+func NewServer(config ServerConfig) (*Server, error) {
+	rules := config.Rules
+	if rules == nil {
+		rules = &RuleSet{}
+	}
+	s, err := newServer(rules)
+	if err != nil {
+		return nil, err
+	}
+	s.listenAddr, s.tlsConfig = config.ListenAddr, config.TLSConfig
+	return s, nil
+}
+
+// Start starts listening, and serving the tunnels connecting until ctx is done or Close is called.
+func (s *Server) Start(ctx context.Context) error {
+	var lc net.ListenConfig
+	ln, err := lc.Listen(ctx, "tcp", s.listenAddr)
+	if err != nil {
+		return err
+	}
+	if s.tlsConfig != nil {
+		ln = tls.NewListener(ln, s.tlsConfig)
+	}
+	s.mu.Lock()
+	s.ln = ln
+	s.http = &http.Server{Handler: websocketHandler(s.serveTunnel)}
+	s.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		s.Close()
+	}()
+	go s.http.Serve(ln)
+	return nil
+}
+
+// Addr returns the address the server listens on, once started.
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ln == nil {
+		return nil
+	}
+	return s.ln.Addr()
+}
+
+// Close stops listening and closes the tunnels being served, waiting for them to be done.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	var err error
+	if s.http != nil {
+		err = s.http.Close()
+	}
+	// Tunnels are hijacked connections, which the http.Server no longer tracks.
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+// track adds conn to the tunnels being served until untrack is called, unless the server was closed
+// in the meantime, in which case it returns false.
+func (s *Server) track(conn *wsConn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns == nil {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+func (s *Server) untrack(conn *wsConn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	s.wg.Done()
+}
@@ -0,0 +1,353 @@
+package wstunnel
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// startTarget starts a server answering "pong!" to the "ping" of each connection, then closing it.
+func startTarget(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := io.ReadFull(conn, make([]byte, len("ping"))); err == nil {
+					conn.Write([]byte("pong!"))
+				}
+			}()
+		}
+	}()
+	return ln
+}
+
+// startTunnel starts a Server, and a Client configured by config, of that server unless config has a ServerURL.
+func startTunnel(t *testing.T, config ClientConfig) *Client {
+	return startTunnelTo(t, ServerConfig{}, config)
+}
+
+// startTunnelTo is startTunnel with the Server configured by serverConfig.
+func startTunnelTo(t *testing.T, serverConfig ServerConfig, config ClientConfig) *Client {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	serverConfig.ListenAddr = "127.0.0.1:0"
+	server, err := NewServer(serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+
+	config.ListenAddr = "127.0.0.1:0"
+	if config.ServerURL == "" {
+		config.ServerURL = "ws://" + server.Addr().String() + "/"
+	}
+	client, err := NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// selfSigned returns a certificate for 127.0.0.1, and a pool of CAs trusting it.
+func selfSigned(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, roots
+}
+
+// writeCertsDir returns a directory of certificates as -certs_dir wants, presenting cert and trusting it as the CA.
+func writeCertsDir(t *testing.T, cert tls.Certificate) string {
+	dir := t.TempDir()
+	key, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	for name, content := range map[string][]byte{
+		"cacert.pem": certPEM,
+		"cert.pem":   certPEM,
+		"key.pem":    pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key}),
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), content, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// pingThrough sends a ping to target through the SOCKS5 listener of client, and returns the local address
+// of the connection to client, and the answer.
+func pingThrough(t *testing.T, client *Client, target string) (net.Addr, string, error) {
+	var local net.Addr
+	d, err := proxy.SOCKS5("tcp", client.Addr().String(), nil, dialFunc(func(network, addr string) (net.Conn, error) {
+		conn, err := net.Dial(network, addr)
+		if err == nil {
+			local = conn.LocalAddr()
+		}
+		return conn, err
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := d.Dial("tcp", target)
+	if err != nil {
+		return local, "", err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		return local, "", err
+	}
+	answer := make([]byte, len("pong!"))
+	_, err = io.ReadFull(conn, answer)
+	return local, string(answer), err
+}
+
+type dialFunc func(network, addr string) (net.Conn, error)
+
+func (f dialFunc) Dial(network, addr string) (net.Conn, error) {
+	return f(network, addr)
+}
+
+func TestClient(t *testing.T) {
+	target := startTarget(t)
+	client := startTunnel(t, ClientConfig{})
+
+	if _, answer, err := pingThrough(t, client, target.Addr().String()); err != nil || answer != "pong!" {
+		t.Fatalf("Got %q, %v through the tunnel, want pong!", answer, err)
+	}
+	addr := client.Addr().String()
+	client.Close()
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		conn.Close()
+		t.Error("Accepted a connection after Close")
+	}
+}
+
+func TestOnClose(t *testing.T) {
+	target := startTarget(t)
+	closed := make(chan ConnInfo, 1)
+	client := startTunnel(t, ClientConfig{OnClose: func(info ConnInfo) { closed <- info }})
+	start := time.Now()
+
+	local, answer, err := pingThrough(t, client, target.Addr().String())
+	if err != nil || answer != "pong!" {
+		t.Fatalf("Got %q, %v through the tunnel, want pong!", answer, err)
+	}
+	var info ConnInfo
+	select {
+	case info = <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnClose wasn't called")
+	}
+
+	if info.ClientAddr.String() != local.String() {
+		t.Errorf("ClientAddr = %v, want %v", info.ClientAddr, local)
+	}
+	if want := client.wsConfigs[0].Location.String(); info.ServerURL != want {
+		t.Errorf("ServerURL = %q, want %q", info.ServerURL, want)
+	}
+	// The SOCKS5 greeting and CONNECT request, then the ping.
+	if want := int64(3 + 10 + len("ping")); info.BytesToServer != want {
+		t.Errorf("BytesToServer = %d, want %d", info.BytesToServer, want)
+	}
+	// The SOCKS5 method and CONNECT reply, then the answer.
+	if want := int64(2 + 10 + len("pong!")); info.BytesToClient != want {
+		t.Errorf("BytesToClient = %d, want %d", info.BytesToClient, want)
+	}
+	if info.Started.Before(start) || info.Duration <= 0 || info.Duration > time.Since(start) {
+		t.Errorf("Started = %v, Duration = %v, want within the %v since %v", info.Started, info.Duration, time.Since(start), start)
+	}
+	if info.Err != nil {
+		t.Errorf("Err = %v, want nil", info.Err)
+	}
+}
+
+func TestOnCloseFailedDial(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nothing listens there anymore.
+	unreachable := "ws://" + ln.Addr().String() + "/"
+	ln.Close()
+	closed := make(chan ConnInfo, 1)
+	client := startTunnel(t, ClientConfig{ServerURL: unreachable, OnClose: func(info ConnInfo) { closed <- info }})
+
+	pingThrough(t, client, "127.0.0.1:1")
+	select {
+	case info := <-closed:
+		if info.Err == nil || info.BytesToServer != 0 || info.BytesToClient != 0 {
+			t.Errorf("Got %+v, want an error and no bytes", info)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnClose wasn't called")
+	}
+}
+
+func TestClientTLSConfig(t *testing.T) {
+	roots := x509.NewCertPool()
+	cert := tls.Certificate{Certificate: [][]byte{[]byte("client certificate")}}
+	base := &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{cert}}
+	for _, tt := range []struct {
+		name       string
+		config     ClientConfig
+		serverName string
+		minVersion uint16
+	}{
+		{"defaults", ClientConfig{ServerURL: "wss://faythe.com:8443/", TLSConfig: base}, "faythe.com", tls.VersionTLS12},
+		{"set", ClientConfig{ServerURL: "wss://10.0.0.1/", TLSConfig: &tls.Config{
+			RootCAs: roots, Certificates: []tls.Certificate{cert}, ServerName: "faythe.com", MinVersion: tls.VersionTLS13,
+		}}, "faythe.com", tls.VersionTLS13},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ClientTLSConfig(tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got == tt.config.TLSConfig {
+				t.Error("ClientTLSConfig() returned the config passed in, want a copy")
+			}
+			if got.RootCAs != roots {
+				t.Error("RootCAs aren't the ones configured")
+			}
+			if len(got.Certificates) != 1 || string(got.Certificates[0].Certificate[0]) != "client certificate" {
+				t.Errorf("Certificates = %v, want the one configured", got.Certificates)
+			}
+			if got.ServerName != tt.serverName {
+				t.Errorf("ServerName = %q, want %q", got.ServerName, tt.serverName)
+			}
+			if got.MinVersion != tt.minVersion {
+				t.Errorf("MinVersion = %x, want %x", got.MinVersion, tt.minVersion)
+			}
+		})
+	}
+
+	got, _ := ClientTLSConfig(ClientConfig{ServerURL: "wss://faythe.com/", TLSConfig: base})
+	got.ServerName = "mallory.com"
+	got.Certificates[0] = tls.Certificate{}
+	if base.ServerName != "" || string(base.Certificates[0].Certificate[0]) != "client certificate" {
+		t.Error("Changing the returned config changed the one passed in")
+	}
+
+	if got, err := ClientTLSConfig(ClientConfig{ServerURL: "ws://faythe.com/", TLSConfig: base}); got != nil || err != nil {
+		t.Errorf("ClientTLSConfig() = %v, %v for ws://, want nil", got, err)
+	}
+	if _, err := ClientTLSConfig(ClientConfig{ServerURL: "https://faythe.com/"}); err == nil {
+		t.Error("ClientTLSConfig() accepted an https:// URL")
+	}
+}
+
+func TestClientTLSConfigCertsDir(t *testing.T) {
+	cert, roots := selfSigned(t)
+	dir := writeCertsDir(t, cert)
+	for _, tt := range []struct {
+		name       string
+		config     ClientConfig
+		serverName string
+	}{
+		{"wss", ClientConfig{ServerURL: "wss://127.0.0.1:8443/", CertsDir: dir}, "127.0.0.1"},
+		{"ws", ClientConfig{ServerURL: "ws://127.0.0.1:8080/", CertsDir: dir}, "127.0.0.1"},
+		{"server name", ClientConfig{ServerURL: "wss://10.0.0.1/", CertsDir: dir, ServerName: "faythe.com"}, "faythe.com"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ClientTLSConfig(tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// As the client command makes it for -certs_dir.
+			if len(got.Certificates) != 1 || !reflect.DeepEqual(got.Certificates[0].Certificate, cert.Certificate) {
+				t.Error("Certificates aren't the one in the certs dir")
+			}
+			if got.RootCAs == nil || !got.RootCAs.Equal(roots) {
+				t.Error("RootCAs aren't the CA in the certs dir")
+			}
+			if got.ServerName != tt.serverName {
+				t.Errorf("ServerName = %q, want %q", got.ServerName, tt.serverName)
+			}
+			if want := []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.CurveP256}; !reflect.DeepEqual(got.CurvePreferences, want) {
+				t.Errorf("CurvePreferences = %v, want %v", got.CurvePreferences, want)
+			}
+			if want := []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}; !reflect.DeepEqual(got.CipherSuites, want) {
+				t.Errorf("CipherSuites = %v, want %v", got.CipherSuites, want)
+			}
+			if got.MinVersion != tls.VersionTLS12 || got.InsecureSkipVerify {
+				t.Errorf("MinVersion = %x, InsecureSkipVerify = %v, want TLS 1.2 and verifying", got.MinVersion, got.InsecureSkipVerify)
+			}
+		})
+	}
+
+	if _, err := ClientTLSConfig(ClientConfig{ServerURL: "wss://faythe.com/", CertsDir: t.TempDir()}); err == nil {
+		t.Error("ClientTLSConfig() accepted a certs dir without certificates")
+	}
+}
+
+func TestClientCertsDir(t *testing.T) {
+	cert, roots := selfSigned(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	server, err := NewServer(ServerConfig{ListenAddr: "127.0.0.1:0", TLSConfig: &tls.Config{
+		Certificates: []tls.Certificate{cert}, ClientCAs: roots, ClientAuth: tls.RequireAndVerifyClientCert,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+
+	// The server requires the client certificate, and the client verifies the server's.
+	target := startTarget(t)
+	client := startTunnel(t, ClientConfig{ServerURL: "wss://" + server.Addr().String() + "/", CertsDir: writeCertsDir(t, cert)})
+	if _, answer, err := pingThrough(t, client, target.Addr().String()); err != nil || answer != "pong!" {
+		t.Fatalf("Got %q, %v through the tunnel, want pong!", answer, err)
+	}
+}
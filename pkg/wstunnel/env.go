@@ -0,0 +1,37 @@
+package wstunnel
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// envPrefix starts the names of the environment variables setting flags, e.g. WSTUNNEL_TARGET_HOST for -target_host.
+const envPrefix = "WSTUNNEL_"
+
+// parseFlags parses args with the flags of a subcommand, along with those the client and server share,
+// then sets the flags args didn't from their environment variables, if set.
+// Repeatable flags take a single value from their variable.
+func parseFlags(fs *flag.FlagSet, args []string) {
+	sharedFlags.VisitAll(func(f *flag.Flag) { fs.Var(f.Value, f.Name, f.Usage) })
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fmt.Fprintf(fs.Output(), "Unexpected argument: %s\n", fs.Arg(0))
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	fs.VisitAll(func(f *flag.Flag) {
+		env := envPrefix + strings.ToUpper(f.Name)
+		v, ok := os.LookupEnv(env)
+		if !ok || set[f.Name] {
+			return
+		}
+		if err := fs.Set(f.Name, v); err != nil {
+			panic(fmt.Sprintf("Invalid %s=%q: %v", env, v, err))
+		}
+	})
+}
@@ -0,0 +1,56 @@
+package wstunnel
+
+import (
+	"flag"
+	"testing"
+	"time"
+)
+
+func TestParseFlagsFromEnv(t *testing.T) {
+	fs := flag.NewFlagSet("client", flag.ContinueOnError)
+	targetHost := fs.String("target_host", "", "")
+	port := fs.Int("port", 8080, "")
+	insecure := fs.Bool("insecure", false, "")
+	timeout := fs.Duration("timeout", time.Minute, "")
+	query := queryFlags{}
+	fs.Var(query, "target_query", "")
+
+	t.Setenv("WSTUNNEL_TARGET_HOST", "faythe.com:443")
+	t.Setenv("WSTUNNEL_PORT", "9090")
+	t.Setenv("WSTUNNEL_INSECURE", "true")
+	t.Setenv("WSTUNNEL_TIMEOUT", "5s")
+	t.Setenv("WSTUNNEL_TARGET_QUERY", "tenant=alice")
+	parseFlags(fs, []string{"-port=8080", "-timeout", "10s"})
+
+	if *targetHost != "faythe.com:443" || !*insecure {
+		t.Errorf("-target_host=%q -insecure=%v, want them from the environment", *targetHost, *insecure)
+	}
+	if *port != 8080 || *timeout != 10*time.Second {
+		t.Errorf("-port=%d -timeout=%v, want the arguments to take precedence over the environment", *port, *timeout)
+	}
+	if got := query.String(); got != "tenant=alice" {
+		t.Errorf("-target_query=%q, want the value of the environment", got)
+	}
+}
+
+func TestParseFlagsInvalidEnv(t *testing.T) {
+	fs := flag.NewFlagSet("client", flag.ContinueOnError)
+	fs.Int("port", 8080, "")
+	t.Setenv("WSTUNNEL_PORT", "http")
+	defer func() {
+		if recover() == nil {
+			t.Error("parseFlags() accepted WSTUNNEL_PORT=http")
+		}
+	}()
+	parseFlags(fs, nil)
+}
+
+func TestSecretFromEnv(t *testing.T) {
+	fs := flag.NewFlagSet("client", flag.ContinueOnError)
+	s := &secret{name: "basic_auth", value: fs.String("basic_auth", "", ""), file: fs.String("basic_auth_file", "", "")}
+	t.Setenv("WSTUNNEL_BASIC_AUTH", "alice:password")
+	parseFlags(fs, nil)
+	if v, err := s.Get(); err != nil || v != "alice:password" {
+		t.Errorf("Get() = %q, %v, want the value of WSTUNNEL_BASIC_AUTH", v, err)
+	}
+}
@@ -0,0 +1,106 @@
+package wstunnel
+
+import (
+	"encoding/json"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var eventSocket = clientFlags.String("event_socket", "", "Path of a Unix socket streaming newline delimited JSON events about "+
+	"tunnels being opened, closed or failing, for tooling to consume. Empty to disable.")
+
+// eventBacklog is the number of events buffered for a consumer before further ones are dropped.
+const eventBacklog = 256
+
+// event is a JSON event streamed on the -event_socket.
+type event struct {
+	Time     time.Time     `json:"time"`
+	Type     string        `json:"type"` // One of "open", "error" or "close".
+	Client   string        `json:"client"`
+	Server   string        `json:"server"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration_ns,omitempty"`
+}
+
+// eventTap fans events out to the consumers connected to the -event_socket. Consumers that don't keep
+// up have events dropped rather than slowing down tunnels. A nil *eventTap discards all events.
+type eventTap struct {
+	mu        sync.Mutex
+	consumers map[chan []byte]bool
+	dropped   uint64
+}
+
+// events is the tap of the -event_socket, nil if disabled.
+var events *eventTap
+
+func newEventTap(ln net.Listener) *eventTap {
+	t := &eventTap{consumers: make(map[chan []byte]bool)}
+	go t.serve(ln)
+	return t
+}
+
+func (t *eventTap) serve(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		go t.stream(conn)
+	}
+}
+
+func (t *eventTap) stream(conn net.Conn) {
+	defer conn.Close()
+
+	c := make(chan []byte, eventBacklog)
+	t.mu.Lock()
+	t.consumers[c] = true
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		delete(t.consumers, c)
+		t.mu.Unlock()
+	}()
+
+	for line := range c {
+		if _, err := conn.Write(line); err != nil {
+			return
+		}
+	}
+}
+
+func (t *eventTap) emit(e event) {
+	if t == nil {
+		return
+	}
+	e.Time = time.Now()
+	line, err := json.Marshal(e)
+	if err != nil {
+		logError("Failed encoding event", "error", err)
+		return
+	}
+	line = append(line, '\n')
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for c := range t.consumers {
+		select {
+		case c <- line:
+		default:
+			atomic.AddUint64(&t.dropped, 1)
+		}
+	}
+}
+
+// droppedEvents returns the number of events dropped because consumers didn't keep up.
+func (t *eventTap) droppedEvents() uint64 {
+	if t == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&t.dropped)
+}
@@ -0,0 +1,93 @@
+package wstunnel
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// consumeEvents starts a client with -event_socket tunneling to serverURL, or to a server of its own if empty,
+// and returns it along with the events it streams.
+func consumeEvents(t *testing.T, serverURL string) (*Client, <-chan event) {
+	path := filepath.Join(t.TempDir(), "events.sock")
+	func(socket string, tap *eventTap) { t.Cleanup(func() { *eventSocket, events = socket, tap }) }(*eventSocket, events)
+	*eventSocket = path
+	client := startTunnel(t, ClientConfig{ServerURL: serverURL})
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	// Events are only streamed to consumers once the tap got to them.
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		events.mu.Lock()
+		n := len(events.consumers)
+		events.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("The event socket didn't register the consumer")
+		}
+	}
+
+	c := make(chan event, eventBacklog)
+	go func() {
+		defer close(c)
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			var e event
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				t.Errorf("Invalid event %q: %v", scanner.Text(), err)
+				return
+			}
+			c <- e
+		}
+	}()
+	return client, c
+}
+
+// nextEvent returns the next event of c, failing if there's none within a second.
+func nextEvent(t *testing.T, c <-chan event) event {
+	select {
+	case e := <-c:
+		return e
+	case <-time.After(time.Second):
+		t.Fatal("No event within a second")
+		return event{}
+	}
+}
+
+func TestEventSocket(t *testing.T) {
+	client, c := consumeEvents(t, "")
+	local, answer, err := pingThrough(t, client, startTarget(t).Addr().String())
+	if err != nil || answer != "pong!" {
+		t.Fatalf("Ping = %q, %v, want pong!", answer, err)
+	}
+
+	open := nextEvent(t, c)
+	if open.Type != "open" || open.Client != local.String() || open.Server == "" || open.Time.IsZero() {
+		t.Errorf("First event = %+v, want an open event from %v", open, local)
+	}
+	closed := nextEvent(t, c)
+	if closed.Type != "close" || closed.Client != local.String() || closed.Server != open.Server || closed.Duration <= 0 {
+		t.Errorf("Second event = %+v, want a close event with the tunnel's duration", closed)
+	}
+}
+
+func TestEventSocketError(t *testing.T) {
+	client, c := consumeEvents(t, "ws://"+closedAddr(t)+"/")
+	if _, _, err := pingThrough(t, client, "faythe.com:443"); err == nil {
+		t.Fatal("Ping through a client of a closed server succeeded")
+	}
+
+	for _, want := range []string{"open", "error", "close"} {
+		if e := nextEvent(t, c); e.Type != want || (want == "error") != (e.Error != "") {
+			t.Errorf("Event %+v, want a %s event", e, want)
+		}
+	}
+}
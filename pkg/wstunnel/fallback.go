@@ -0,0 +1,133 @@
+package wstunnel
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	fallbacks     fallbackFlags
+	fallbackRetry = clientFlags.Duration("fallback_retry", 5*time.Minute, "Time tunnels keep going through the -fallback "+
+		"that worked before trying -target_host again")
+)
+
+func init() {
+	clientFlags.Var(&fallbacks, "fallback", "Server to fall back to when -target_host can't be reached, e.g. because a port "+
+		"or the proxy is blocked, as host:port or a ws:// or wss:// URL like -target_host. Can be repeated, the fallbacks being "+
+		"tried in order. Fallbacks always use websockets, so that -transport=webtransport can fall back to TCP.")
+}
+
+// fallbackFlags are the servers to fall back to, in order.
+type fallbackFlags []string
+
+func (f *fallbackFlags) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *fallbackFlags) Set(v string) error {
+	if _, _, err := targetURL(v); err != nil {
+		return err
+	}
+	*f = append(*f, v)
+	return nil
+}
+
+// fallbackChain is the ways a tunnel can reach its server: the server as configured, then its fallbacks in order.
+// New tunnels go the way that last worked, going back to the configured one every -fallback_retry.
+type fallbackChain struct {
+	paths []*websocketConfig
+
+	mu      sync.Mutex
+	current int       // The path that last worked.
+	since   time.Time // When current was last found to be the first that works.
+}
+
+// getFallbackChain returns the chain of wsConfig, the config of tunnel t, or nil if t has no fallbacks.
+func getFallbackChain(t tunnelConfig, wsConfig *websocketConfig) (*fallbackChain, error) {
+	if len(t.Fallbacks) == 0 {
+		return nil, nil
+	}
+	c := &fallbackChain{paths: []*websocketConfig{wsConfig}}
+	for _, spec := range t.Fallbacks {
+		f := t
+		f.Fallbacks, f.servers = nil, nil
+		var err error
+		if f.TargetHost, f.url, err = targetURL(spec); err != nil {
+			return nil, err
+		}
+		config, err := getWsConfig(f)
+		if err != nil {
+			return nil, fmt.Errorf("Fallback %s: %v", spec, err)
+		}
+		config.Transport = "websocket"
+		c.paths = append(c.paths, config)
+	}
+	return c, nil
+}
+
+// pathName describes the way config reaches the server, for logs.
+func pathName(config *websocketConfig) string {
+	name := fmt.Sprintf("%s://%s%s", config.Location.Scheme, config.Location.Host, config.Location.Path)
+	if config.Transport == "webtransport" {
+		// QUIC goes around proxies.
+		return name + " over webtransport"
+	}
+	return name + " via " + proxyPath(*config.Location)
+}
+
+// open opens a tunnel for wsConfig, a config of the chain's server possibly with headers of its own, on the first
+// path that works.
+func (c *fallbackChain) open(wsConfig *websocketConfig) (*tunnel, error) {
+	c.mu.Lock()
+	start := c.current
+	retrying := start != 0 && time.Since(c.since) >= *fallbackRetry
+	if retrying {
+		start = 0
+	}
+	c.mu.Unlock()
+
+	order := []int{start}
+	for i := range c.paths {
+		if i != start {
+			order = append(order, i)
+		}
+	}
+	var errs []string
+	for _, i := range order {
+		config := c.paths[i]
+		if i == 0 {
+			config = wsConfig
+		} else if wsConfig != c.paths[0] {
+			copied := *config
+			copied.Header = wsConfig.Header
+			config = &copied
+		}
+		t, err := openTunnelOn(config)
+		if err == nil {
+			c.use(i, retrying)
+			return t, nil
+		}
+		logWarn("Failed connecting to the server", "path", pathName(c.paths[i]), "error", err)
+		errs = append(errs, err.Error())
+	}
+	return nil, fmt.Errorf("No way to the server worked: %s", strings.Join(errs, "; "))
+}
+
+// use records that path i worked, after retrying the configured one if retried.
+func (c *fallbackChain) use(i int, retried bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if i == c.current && !retried {
+		return
+	}
+	if i != c.current {
+		if i == 0 {
+			logInfo("Reaching the server as configured again", "path", pathName(c.paths[i]))
+		} else {
+			logWarn("Falling back to another way to the server", "path", pathName(c.paths[i]), "fallback", i)
+		}
+	}
+	c.current, c.since = i, time.Now()
+}
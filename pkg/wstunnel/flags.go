@@ -0,0 +1,35 @@
+package wstunnel
+
+import (
+	"flag"
+	"fmt"
+)
+
+// The flags of the client and server commands, along with those both share, which are kept off flag.CommandLine
+// so as not to clash with the flags of programs embedding the package. See ParseClientFlags.
+var (
+	clientFlags = newFlagSet("client", "Listens for local connections and tunnels them to a server over websockets.")
+	serverFlags = newFlagSet("server", "Serves the tunnels of clients, connecting them to the targets they ask for.")
+	sharedFlags = flag.NewFlagSet("shared", flag.ExitOnError)
+)
+
+func newFlagSet(name, doc string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: wstunnel %s [flags]\n\n%s\n\nFlags:\n", name, doc)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// ParseClientFlags parses args as the flags of the client command, for NewFlagClient. Flags args doesn't set are
+// taken from their WSTUNNEL_ environment variables. It exits the process on invalid flags, as flag.Parse does,
+// and panics on invalid environment variables.
+func ParseClientFlags(args []string) {
+	parseFlags(clientFlags, args)
+}
+
+// ParseServerFlags parses args as the flags of the server command, for NewFlagServer, like ParseClientFlags.
+func ParseServerFlags(args []string) {
+	parseFlags(serverFlags, args)
+}
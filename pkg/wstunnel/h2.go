@@ -0,0 +1,1015 @@
+package wstunnel
+
+// Websockets over HTTP/2, as in RFC 8441: tunnels are streams of shared HTTP/2 connections, opened with an
+// extended CONNECT. The websocket package only speaks HTTP/1.1 handshakes, so both ends translate them on the
+// streams: the client turns the handshake request written on a stream into a CONNECT, and the response to it into
+// a 101, while the server turns CONNECTs into handshake requests for its http.Server, and its 101s into responses.
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http/httpguts"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+var (
+	http2Client = clientFlags.Bool("http2", false, "Carry the tunnels as streams of shared HTTP/2 connections to the server, with "+
+		"websockets over HTTP/2 (RFC 8441) as some ingresses prefer. Requires TLS, and a server supporting it, e.g. with -http2.")
+	http2Server = serverFlags.Bool("http2", false, "Accept websockets over HTTP/2 (RFC 8441) on -https_port, for clients carrying "+
+		"tunnels as streams of shared connections with -http2. Other requests are left to HTTP/1.1.")
+)
+
+const (
+	// settingEnableConnectProtocol is the SETTINGS_ENABLE_CONNECT_PROTOCOL of RFC 8441.
+	settingEnableConnectProtocol http2.SettingID = 0x8
+	// h2StreamWindow is the flow control window of every stream, which bounds the data buffered for it.
+	h2StreamWindow = 1 << 20
+	// h2ConnWindow is the flow control window of the connection. It's credited back as soon as data arrives,
+	// as the stream windows bound the data buffered already.
+	h2ConnWindow = 1 << 30
+	// h2SettingsTimeout bounds the time the server may take to send its settings.
+	h2SettingsTimeout = 10 * time.Second
+	// h2MaxHeaderList bounds the size of the header blocks received, CONTINUATION frames included, and of every
+	// field in them, so that peers can't have them buffered without end.
+	h2MaxHeaderList = 64 << 10
+	// h2MaxStreams is the most streams a client may have open on a connection to the server at once.
+	h2MaxStreams = 1000
+	// websocketGUID is what the key of a websocket handshake is hashed with for the accept header, as per RFC 6455.
+	websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+var errH2GoingAway = errors.New("HTTP/2 connection going away")
+
+// h2HandshakeHeaders are the headers of HTTP/1.1 websocket handshakes that have no place in HTTP/2.
+var h2HandshakeHeaders = []string{"Connection", "Upgrade", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding",
+	"Content-Length", "Host", "Sec-Websocket-Key", "Sec-Websocket-Accept"}
+
+// h2Conn is an HTTP/2 connection carrying websockets on its streams, from either end.
+type h2Conn struct {
+	conn     net.Conn
+	framer   *http2.Framer
+	isServer bool
+	// newStream is called with every stream the client opens, on the server.
+	newStream func(*h2Stream)
+	// onClose is called once the connection is closed.
+	onClose func()
+
+	wmu  sync.Mutex // Guards writing frames, and henc with hbuf. Taken before mu when both are.
+	henc *hpack.Encoder
+	hbuf bytes.Buffer
+
+	mu              sync.Mutex
+	cond            *sync.Cond // Broadcast when send windows grow, or streams or the connection close.
+	streams         map[uint32]*h2Stream
+	active          int    // Streams open, including those of the client not sent yet.
+	nextID          uint32 // The ID of the next stream the client opens.
+	lastID          uint32 // The ID of the latest stream the client opened, on the server.
+	sendWindow      int64
+	recvWindow      int64 // The data the peer may still send on the connection.
+	recvUnacked     int64
+	peerWindow      int64  // The peer's SETTINGS_INITIAL_WINDOW_SIZE.
+	peerFrame       uint32 // The peer's SETTINGS_MAX_FRAME_SIZE.
+	peerStreams     uint32 // The peer's SETTINGS_MAX_CONCURRENT_STREAMS.
+	extendedConnect bool
+	goingAway       bool
+	err             error // Set once the connection is closed.
+
+	settingsOnce sync.Once
+	settings     chan struct{} // Closed once the peer's settings arrived.
+}
+
+func newH2Conn(conn net.Conn, isServer bool) *h2Conn {
+	c := &h2Conn{
+		conn: conn, framer: http2.NewFramer(conn, conn), isServer: isServer, streams: make(map[uint32]*h2Stream), nextID: 1,
+		sendWindow: 65535, recvWindow: 65535, peerWindow: 65535, peerFrame: 16384, peerStreams: ^uint32(0),
+		settings: make(chan struct{}),
+	}
+	c.cond = sync.NewCond(&c.mu)
+	c.henc = hpack.NewEncoder(&c.hbuf)
+	// The framer puts header blocks together from their CONTINUATION frames, within h2MaxHeaderList.
+	c.framer.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	c.framer.MaxHeaderListSize = h2MaxHeaderList
+	return c
+}
+
+// start exchanges the connection preface and settings, and starts reading frames.
+func (c *h2Conn) start() error {
+	settings := []http2.Setting{
+		{ID: http2.SettingInitialWindowSize, Val: h2StreamWindow}, {ID: http2.SettingMaxHeaderListSize, Val: h2MaxHeaderList},
+	}
+	if c.isServer {
+		preface := make([]byte, len(http2.ClientPreface))
+		c.conn.SetReadDeadline(time.Now().Add(h2SettingsTimeout))
+		if _, err := io.ReadFull(c.conn, preface); err != nil || string(preface) != http2.ClientPreface {
+			return errors.New("Invalid HTTP/2 client preface")
+		}
+		c.conn.SetReadDeadline(time.Time{})
+		settings = append(settings, http2.Setting{ID: settingEnableConnectProtocol, Val: 1},
+			http2.Setting{ID: http2.SettingMaxConcurrentStreams, Val: h2MaxStreams})
+	} else {
+		if _, err := io.WriteString(c.conn, http2.ClientPreface); err != nil {
+			return err
+		}
+		settings = append(settings, http2.Setting{ID: http2.SettingEnablePush, Val: 0})
+	}
+
+	c.wmu.Lock()
+	err := c.framer.WriteSettings(settings...)
+	if err == nil {
+		err = c.framer.WriteWindowUpdate(0, h2ConnWindow-65535)
+	}
+	c.wmu.Unlock()
+	c.mu.Lock()
+	c.recvWindow = h2ConnWindow
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	go c.readLoop()
+	return nil
+}
+
+// close closes the connection and its streams with err, once.
+func (c *h2Conn) close(err error) {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return
+	}
+	c.err = err
+	streams := c.streams
+	c.streams = map[uint32]*h2Stream{}
+	c.cond.Broadcast()
+	c.mu.Unlock()
+
+	c.conn.Close()
+	for _, s := range streams {
+		s.reset(err)
+	}
+	c.settingsOnce.Do(func() { close(c.settings) })
+	if c.onClose != nil {
+		c.onClose()
+	}
+}
+
+// goAway has the peer open no more streams, and closes the connection once those open are done.
+func (c *h2Conn) goAway() {
+	c.wmu.Lock()
+	c.mu.Lock()
+	last := c.lastID
+	c.goingAway = true
+	idle := c.active == 0
+	c.mu.Unlock()
+	c.framer.WriteGoAway(last, http2.ErrCodeNo, nil)
+	c.wmu.Unlock()
+	if idle {
+		c.close(errH2GoingAway)
+	}
+}
+
+// writeHeaders writes a header block for stream id, continued in CONTINUATION frames if needed. c.wmu must be held.
+func (c *h2Conn) writeHeaders(id uint32, fields []hpack.HeaderField, endStream bool) error {
+	c.hbuf.Reset()
+	for _, f := range fields {
+		c.henc.WriteField(f)
+	}
+	block := c.hbuf.Bytes()
+	c.mu.Lock()
+	max := int(c.peerFrame)
+	c.mu.Unlock()
+
+	for first := true; first || len(block) > 0; first = false {
+		chunk := block
+		if len(chunk) > max {
+			chunk = chunk[:max]
+		}
+		block = block[len(chunk):]
+		var err error
+		if first {
+			err = c.framer.WriteHeaders(http2.HeadersFrameParam{StreamID: id, BlockFragment: chunk, EndStream: endStream, EndHeaders: len(block) == 0})
+		} else {
+			err = c.framer.WriteContinuation(id, len(block) == 0, chunk)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *h2Conn) readLoop() {
+	for {
+		f, err := c.framer.ReadFrame()
+		if se, ok := err.(http2.StreamError); ok {
+			c.wmu.Lock()
+			c.framer.WriteRSTStream(se.StreamID, se.Code)
+			c.wmu.Unlock()
+			if s := c.stream(se.StreamID); s != nil {
+				s.reset(se)
+			}
+			continue
+		}
+		if err != nil {
+			c.close(err)
+			return
+		}
+
+		switch f := f.(type) {
+		case *http2.SettingsFrame:
+			if !f.IsAck() {
+				c.applySettings(f)
+			}
+		case *http2.MetaHeadersFrame:
+			err = c.handleHeaders(f)
+		case *http2.DataFrame:
+			err = c.handleData(f)
+		case *http2.WindowUpdateFrame:
+			c.mu.Lock()
+			if f.StreamID == 0 {
+				c.sendWindow += int64(f.Increment)
+			} else if s := c.streams[f.StreamID]; s != nil {
+				s.sendWindow += int64(f.Increment)
+			}
+			c.cond.Broadcast()
+			c.mu.Unlock()
+		case *http2.RSTStreamFrame:
+			if s := c.stream(f.StreamID); s != nil {
+				s.reset(fmt.Errorf("HTTP/2 stream reset by the peer: %v", f.ErrCode))
+			}
+		case *http2.PingFrame:
+			if !f.IsAck() {
+				c.wmu.Lock()
+				err = c.framer.WritePing(true, f.Data)
+				c.wmu.Unlock()
+			}
+		case *http2.GoAwayFrame:
+			c.mu.Lock()
+			c.goingAway = true
+			var refused []*h2Stream
+			for id, s := range c.streams {
+				if id > f.LastStreamID {
+					refused = append(refused, s)
+				}
+			}
+			idle := c.active == 0
+			c.mu.Unlock()
+			for _, s := range refused {
+				s.reset(errH2GoingAway)
+			}
+			if idle {
+				c.close(errH2GoingAway)
+			}
+		}
+		if err != nil {
+			c.close(err)
+			return
+		}
+	}
+}
+
+func (c *h2Conn) stream(id uint32) *h2Stream {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.streams[id]
+}
+
+func (c *h2Conn) applySettings(f *http2.SettingsFrame) {
+	c.mu.Lock()
+	f.ForeachSetting(func(s http2.Setting) error {
+		switch s.ID {
+		case http2.SettingInitialWindowSize:
+			// The change applies to the windows of the streams open too.
+			for _, stream := range c.streams {
+				stream.sendWindow += int64(s.Val) - c.peerWindow
+			}
+			c.peerWindow = int64(s.Val)
+		case http2.SettingMaxFrameSize:
+			c.peerFrame = s.Val
+		case http2.SettingMaxConcurrentStreams:
+			c.peerStreams = s.Val
+		case settingEnableConnectProtocol:
+			c.extendedConnect = s.Val == 1
+		}
+		return nil
+	})
+	c.cond.Broadcast()
+	c.mu.Unlock()
+
+	c.wmu.Lock()
+	c.framer.WriteSettingsAck()
+	c.wmu.Unlock()
+	c.settingsOnce.Do(func() { close(c.settings) })
+}
+
+func (c *h2Conn) handleHeaders(f *http2.MetaHeadersFrame) error {
+	id, fields, endStream := f.StreamID, f.Fields, f.StreamEnded()
+	if f.Truncated {
+		// Past h2MaxHeaderList.
+		if s := c.stream(id); s != nil {
+			s.reset(errors.New("HTTP/2 header block too large"))
+		}
+		c.wmu.Lock()
+		defer c.wmu.Unlock()
+		return c.framer.WriteRSTStream(id, http2.ErrCodeRefusedStream)
+	}
+	if !c.isServer {
+		if s := c.stream(id); s != nil {
+			s.receiveResponse(fields, endStream)
+		}
+		return nil
+	}
+
+	c.mu.Lock()
+	if id <= c.lastID {
+		// Trailers, which tunnels have no use for.
+		c.mu.Unlock()
+		return nil
+	}
+	c.lastID = id
+	refused := c.goingAway || c.active >= h2MaxStreams
+	c.mu.Unlock()
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if refused {
+		return c.framer.WriteRSTStream(id, http2.ErrCodeRefusedStream)
+	}
+	req, err := h2Request(fields)
+	if err != nil || endStream {
+		// Clients retry other requests, e.g. for the debug handlers, over HTTP/1.1.
+		logDebug("Refusing HTTP/2 request", "remote", c.conn.RemoteAddr(), "error", err)
+		return c.framer.WriteRSTStream(id, http2.ErrCodeHTTP11Required)
+	}
+
+	s := newH2Stream(c)
+	s.id = id
+	s.rbuf.Write(req)
+	s.unflowed = len(req)
+	c.mu.Lock()
+	s.sendWindow = c.peerWindow
+	c.streams[id] = s
+	c.active++
+	c.mu.Unlock()
+	go c.newStream(s)
+	return nil
+}
+
+func (c *h2Conn) handleData(f *http2.DataFrame) error {
+	c.mu.Lock()
+	if int64(f.Length) > c.recvWindow {
+		c.mu.Unlock()
+		return http2.ConnectionError(http2.ErrCodeFlowControl)
+	}
+	c.recvWindow -= int64(f.Length)
+	c.recvUnacked += int64(f.Length)
+	var credit int64
+	if c.recvUnacked >= h2ConnWindow/2 {
+		credit, c.recvUnacked = c.recvUnacked, 0
+		c.recvWindow += credit
+	}
+	s := c.streams[f.StreamID]
+	c.mu.Unlock()
+
+	if s != nil && !s.receive(f.Data(), int(f.Length), f.StreamEnded()) {
+		// The peer sent more than the stream's window.
+		s.reset(errors.New("HTTP/2 stream flow control violated by the peer"))
+		c.wmu.Lock()
+		err := c.framer.WriteRSTStream(f.StreamID, http2.ErrCodeFlowControl)
+		c.wmu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	if credit > 0 {
+		c.wmu.Lock()
+		defer c.wmu.Unlock()
+		return c.framer.WriteWindowUpdate(0, uint32(credit))
+	}
+	return nil
+}
+
+// reserveStream returns a stream to open on the client, or nil if the connection has no room left for it.
+func (c *h2Conn) reserveStream() *h2Stream {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil || c.goingAway || uint32(c.active) >= c.peerStreams {
+		return nil
+	}
+	c.active++
+	return newH2Stream(c)
+}
+
+// h2Stream is a stream of an h2Conn carrying a websocket, as a net.Conn which its websocket handshake
+// is written to and read from in HTTP/1.1.
+type h2Stream struct {
+	c  *h2Conn
+	id uint32 // 0 until the client sent the CONNECT.
+
+	// Guarded by c.mu:
+	sendWindow    int64
+	sentEnd       bool
+	closed        bool
+	writeErr      error
+	writeDeadline time.Time
+	writeTimer    *time.Timer
+
+	rmu          sync.Mutex
+	rcond        *sync.Cond
+	rbuf         bytes.Buffer
+	unflowed     int   // Bytes at the start of rbuf not received in DATA frames, i.e. a translated handshake.
+	recvWindow   int64 // The data the peer may still send on the stream.
+	recvUnacked  int64 // Bytes read since the stream window was last credited.
+	recvEnd      bool
+	rerr         error // io.EOF once the peer ended the stream, or why it was reset.
+	readDeadline time.Time
+	readTimer    *time.Timer
+
+	hmu       sync.Mutex // Guards the translation of the handshake.
+	handshake bytes.Buffer
+	shaken    bool
+	key       string // The Sec-WebSocket-Key of the client's handshake request.
+	refused   bool   // The server refused the websocket, so that further writes of the response are dropped.
+}
+
+func newH2Stream(c *h2Conn) *h2Stream {
+	s := &h2Stream{c: c, recvWindow: h2StreamWindow}
+	s.rcond = sync.NewCond(&s.rmu)
+	return s
+}
+
+// receive buffers the data of a DATA frame of flowed bytes, padding included, for reading. It returns false
+// if the frame is over the stream's window.
+func (s *h2Stream) receive(data []byte, flowed int, end bool) bool {
+	s.rmu.Lock()
+	defer s.rmu.Unlock()
+	if int64(flowed) > s.recvWindow {
+		return false
+	}
+	s.recvWindow -= int64(flowed)
+	s.rbuf.Write(data)
+	// Padding is credited along with the data read.
+	s.recvUnacked += int64(flowed - len(data))
+	if end {
+		s.recvEnd = true
+		if s.rerr == nil {
+			s.rerr = io.EOF
+		}
+	}
+	s.rcond.Broadcast()
+	return true
+}
+
+// reset fails reads and writes on the stream with err, the peer having reset it or the connection being closed.
+func (s *h2Stream) reset(err error) {
+	s.rmu.Lock()
+	s.recvEnd = true
+	if s.rerr == nil || s.rerr == io.EOF && s.rbuf.Len() == 0 {
+		s.rerr = err
+	}
+	s.rcond.Broadcast()
+	s.rmu.Unlock()
+
+	s.c.mu.Lock()
+	if s.writeErr == nil {
+		s.writeErr = err
+	}
+	s.c.cond.Broadcast()
+	s.c.mu.Unlock()
+}
+
+func (s *h2Stream) Read(b []byte) (int, error) {
+	s.rmu.Lock()
+	for s.rbuf.Len() == 0 && s.rerr == nil {
+		if !s.readDeadline.IsZero() && !time.Now().Before(s.readDeadline) {
+			s.rmu.Unlock()
+			return 0, os.ErrDeadlineExceeded
+		}
+		s.rcond.Wait()
+	}
+	if s.rbuf.Len() == 0 {
+		err := s.rerr
+		s.rmu.Unlock()
+		return 0, err
+	}
+	n, _ := s.rbuf.Read(b)
+	flowed := n - s.unflowed
+	if s.unflowed -= n; s.unflowed < 0 {
+		s.unflowed = 0
+	}
+	if flowed > 0 {
+		s.recvUnacked += int64(flowed)
+	}
+	var credit int64
+	if s.recvUnacked >= h2StreamWindow/2 && !s.recvEnd {
+		credit, s.recvUnacked = s.recvUnacked, 0
+		s.recvWindow += credit
+	}
+	s.rmu.Unlock()
+
+	if credit > 0 {
+		s.c.wmu.Lock()
+		s.c.framer.WriteWindowUpdate(s.id, uint32(credit))
+		s.c.wmu.Unlock()
+	}
+	return n, nil
+}
+
+func (s *h2Stream) Write(b []byte) (int, error) {
+	s.hmu.Lock()
+	if !s.shaken {
+		defer s.hmu.Unlock()
+		if s.c.isServer {
+			return s.writeResponse(b)
+		}
+		return s.writeRequest(b)
+	}
+	s.hmu.Unlock()
+	return s.writeData(b)
+}
+
+func (s *h2Stream) writeData(b []byte) (int, error) {
+	n := 0
+	for len(b) > 0 {
+		size, err := s.reserveWindow(len(b))
+		if err != nil {
+			return n, err
+		}
+		s.c.wmu.Lock()
+		err = s.c.framer.WriteData(s.id, false, b[:size])
+		s.c.wmu.Unlock()
+		if err != nil {
+			s.c.close(err)
+			return n, err
+		}
+		n, b = n+size, b[size:]
+	}
+	return n, nil
+}
+
+// reserveWindow waits for the flow control windows to let up to want bytes be sent, and takes them from the windows.
+func (s *h2Stream) reserveWindow(want int) (int, error) {
+	c := s.c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		switch {
+		case s.writeErr != nil:
+			return 0, s.writeErr
+		case s.closed || s.sentEnd:
+			return 0, io.ErrClosedPipe
+		case !s.writeDeadline.IsZero() && !time.Now().Before(s.writeDeadline):
+			return 0, os.ErrDeadlineExceeded
+		}
+		n := int64(want)
+		for _, limit := range []int64{c.sendWindow, s.sendWindow, int64(c.peerFrame)} {
+			if limit < n {
+				n = limit
+			}
+		}
+		if n > 0 {
+			c.sendWindow -= n
+			s.sendWindow -= n
+			return int(n), nil
+		}
+		c.cond.Wait()
+	}
+}
+
+// writeRequest translates the websocket handshake request written on the client's stream into an extended CONNECT.
+func (s *h2Stream) writeRequest(b []byte) (int, error) {
+	s.handshake.Write(b)
+	if !bytes.Contains(s.handshake.Bytes(), []byte("\r\n\r\n")) {
+		return len(b), nil
+	}
+	req, err := http.ReadRequest(bufio.NewReader(&s.handshake))
+	if err != nil {
+		return 0, fmt.Errorf("Invalid websocket handshake request: %v", err)
+	}
+	s.key = req.Header.Get("Sec-Websocket-Key")
+	fields := []hpack.HeaderField{
+		{Name: ":method", Value: "CONNECT"}, {Name: ":protocol", Value: "websocket"}, {Name: ":scheme", Value: "https"},
+		{Name: ":authority", Value: req.Host}, {Name: ":path", Value: req.URL.RequestURI()},
+	}
+	fields = append(fields, h2Fields(req.Header)...)
+
+	c := s.c
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return 0, c.err
+	}
+	s.id = c.nextID
+	c.nextID += 2
+	s.sendWindow = c.peerWindow
+	c.streams[s.id] = s
+	c.mu.Unlock()
+	if err := c.writeHeaders(s.id, fields, false); err != nil {
+		go c.close(err)
+		return 0, err
+	}
+	s.shaken = true
+	return len(b), nil
+}
+
+// receiveResponse translates the response to the client's CONNECT into a websocket handshake response to read.
+func (s *h2Stream) receiveResponse(fields []hpack.HeaderField, endStream bool) {
+	status, header := h2Header(fields)
+	var b bytes.Buffer
+	if status == "200" {
+		sum := sha1.Sum([]byte(s.key + websocketGUID))
+		b.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+		header.Set("Sec-Websocket-Accept", base64.StdEncoding.EncodeToString(sum[:]))
+	} else {
+		code, _ := strconv.Atoi(status)
+		fmt.Fprintf(&b, "HTTP/1.1 %s %s\r\n", status, http.StatusText(code))
+		header.Set("Content-Length", "0")
+	}
+	header.Write(&b)
+	b.WriteString("\r\n")
+
+	s.rmu.Lock()
+	if s.rbuf.Len() == 0 {
+		s.rbuf.Write(b.Bytes())
+		s.unflowed = b.Len()
+	}
+	s.rmu.Unlock()
+	s.receive(nil, 0, endStream)
+}
+
+// writeResponse translates the websocket handshake response written on the server's stream into a response
+// to the CONNECT. A refusal ends the stream, the rest of it being dropped.
+func (s *h2Stream) writeResponse(b []byte) (int, error) {
+	if s.refused {
+		return len(b), nil
+	}
+	s.handshake.Write(b)
+	end := bytes.Index(s.handshake.Bytes(), []byte("\r\n\r\n"))
+	if end < 0 {
+		return len(b), nil
+	}
+	head := s.handshake.Next(end + 4)
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(head)), nil)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid websocket handshake response: %v", err)
+	}
+	status := strconv.Itoa(resp.StatusCode)
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		status = "200"
+	}
+	fields := append([]hpack.HeaderField{{Name: ":status", Value: status}}, h2Fields(resp.Header)...)
+
+	c := s.c
+	c.wmu.Lock()
+	err = c.writeHeaders(s.id, fields, status != "200")
+	c.wmu.Unlock()
+	if err != nil {
+		go c.close(err)
+		return 0, err
+	}
+	if status != "200" {
+		s.refused = true
+		c.mu.Lock()
+		s.sentEnd = true
+		c.mu.Unlock()
+		return len(b), nil
+	}
+	s.shaken = true
+	// Anything written past the response is websocket data already.
+	if rest := s.handshake.Bytes(); len(rest) > 0 {
+		if _, err := s.writeData(rest); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// CloseWrite ends the stream, telling the peer nothing more is coming.
+func (s *h2Stream) CloseWrite() error {
+	c := s.c
+	c.mu.Lock()
+	if s.closed || s.sentEnd || s.id == 0 {
+		c.mu.Unlock()
+		return nil
+	}
+	s.sentEnd = true
+	c.mu.Unlock()
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.framer.WriteData(s.id, true, nil)
+}
+
+func (s *h2Stream) Close() error {
+	c := s.c
+	c.mu.Lock()
+	if s.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	sentEnd := s.sentEnd
+	if c.streams[s.id] == s {
+		delete(c.streams, s.id)
+	}
+	c.active--
+	idle := c.goingAway && c.active == 0
+	c.cond.Broadcast()
+	c.mu.Unlock()
+
+	s.rmu.Lock()
+	recvEnd := s.recvEnd
+	if s.rerr == nil || s.rerr == io.EOF {
+		s.rerr = io.ErrClosedPipe
+	}
+	s.rcond.Broadcast()
+	s.rmu.Unlock()
+
+	if s.id != 0 {
+		c.wmu.Lock()
+		if !recvEnd {
+			// The peer is to stop sending.
+			c.framer.WriteRSTStream(s.id, http2.ErrCodeCancel)
+		} else if !sentEnd {
+			c.framer.WriteData(s.id, true, nil)
+		}
+		c.wmu.Unlock()
+	}
+	if idle {
+		c.close(errH2GoingAway)
+	}
+	return nil
+}
+
+func (s *h2Stream) LocalAddr() net.Addr  { return s.c.conn.LocalAddr() }
+func (s *h2Stream) RemoteAddr() net.Addr { return s.c.conn.RemoteAddr() }
+
+func (s *h2Stream) SetDeadline(t time.Time) error {
+	s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
+}
+
+func (s *h2Stream) SetReadDeadline(t time.Time) error {
+	s.rmu.Lock()
+	defer s.rmu.Unlock()
+	s.readDeadline = t
+	if s.readTimer != nil {
+		s.readTimer.Stop()
+	}
+	if !t.IsZero() {
+		s.readTimer = time.AfterFunc(time.Until(t), func() {
+			s.rmu.Lock()
+			s.rcond.Broadcast()
+			s.rmu.Unlock()
+		})
+	}
+	s.rcond.Broadcast()
+	return nil
+}
+
+func (s *h2Stream) SetWriteDeadline(t time.Time) error {
+	c := s.c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s.writeDeadline = t
+	if s.writeTimer != nil {
+		s.writeTimer.Stop()
+	}
+	if !t.IsZero() {
+		s.writeTimer = time.AfterFunc(time.Until(t), func() {
+			c.mu.Lock()
+			c.cond.Broadcast()
+			c.mu.Unlock()
+		})
+	}
+	c.cond.Broadcast()
+	return nil
+}
+
+// h2Fields returns the fields of the headers of an HTTP/1.1 websocket handshake that go in HTTP/2.
+func h2Fields(header http.Header) []hpack.HeaderField {
+	for _, name := range h2HandshakeHeaders {
+		header.Del(name)
+	}
+	var fields []hpack.HeaderField
+	for name, values := range header {
+		for _, v := range values {
+			fields = append(fields, hpack.HeaderField{Name: strings.ToLower(name), Value: v})
+		}
+	}
+	return fields
+}
+
+// h2Header returns the :status and the regular headers of fields.
+func h2Header(fields []hpack.HeaderField) (status string, header http.Header) {
+	header = http.Header{}
+	for _, f := range fields {
+		switch {
+		case f.Name == ":status":
+			status = f.Value
+		case strings.HasPrefix(f.Name, ":") || !httpguts.ValidHeaderFieldName(f.Name):
+		default:
+			header.Add(f.Name, f.Value)
+		}
+	}
+	for _, name := range h2HandshakeHeaders {
+		header.Del(name)
+	}
+	return status, header
+}
+
+// h2Request returns the websocket handshake request in HTTP/1.1 of the extended CONNECT with fields.
+func h2Request(fields []hpack.HeaderField) ([]byte, error) {
+	_, header := h2Header(fields)
+	pseudo := map[string]string{}
+	for _, f := range fields {
+		if strings.HasPrefix(f.Name, ":") {
+			pseudo[f.Name] = f.Value
+		}
+	}
+	if pseudo[":method"] != "CONNECT" || pseudo[":protocol"] != "websocket" {
+		return nil, fmt.Errorf("Not a websocket CONNECT: %s %s", pseudo[":method"], pseudo[":path"])
+	}
+	path := pseudo[":path"]
+	if !strings.HasPrefix(path, "/") || strings.ContainsAny(path, " \r\n") {
+		return nil, fmt.Errorf("Invalid path: %q", path)
+	}
+
+	key := make([]byte, 16)
+	rand.Read(key)
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "GET %s HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: %s\r\n",
+		path, strings.Map(func(r rune) rune {
+			if r == '\r' || r == '\n' {
+				return -1
+			}
+			return r
+		}, pseudo[":authority"]), base64.StdEncoding.EncodeToString(key))
+	header.Write(&b)
+	b.WriteString("\r\n")
+	return b.Bytes(), nil
+}
+
+var (
+	h2Mu    sync.Mutex
+	h2Conns = map[string][]*h2Conn{}
+)
+
+// openH2Stream returns a new stream to the server of wsConfig, on an HTTP/2 connection with room for it,
+// establishing one if needed.
+func openH2Stream(wsConfig *websocketConfig) (net.Conn, error) {
+	host := wsConfig.Location.Host
+	h2Mu.Lock()
+	for _, c := range h2Conns[host] {
+		if s := c.reserveStream(); s != nil {
+			h2Mu.Unlock()
+			return s, nil
+		}
+	}
+	h2Mu.Unlock()
+
+	// Connecting without h2Mu held, so that a slow server doesn't hold up the tunnels to others.
+	conn, err := getTLSConn(wsConfig)
+	if err != nil {
+		return nil, err
+	}
+	if proto := conn.(*tls.Conn).ConnectionState().NegotiatedProtocol; proto != "h2" {
+		conn.Close()
+		return nil, fmt.Errorf("Server doesn't support HTTP/2")
+	}
+	c := newH2Conn(conn, false)
+	c.onClose = func() {
+		h2Mu.Lock()
+		defer h2Mu.Unlock()
+		conns := h2Conns[host][:0]
+		for _, other := range h2Conns[host] {
+			if other != c {
+				conns = append(conns, other)
+			}
+		}
+		h2Conns[host] = conns
+	}
+	if err := c.start(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Failed starting HTTP/2 connection: %v", err)
+	}
+	select {
+	case <-c.settings:
+	case <-time.After(h2SettingsTimeout):
+	}
+	c.mu.Lock()
+	err, extendedConnect := c.err, c.extendedConnect
+	c.mu.Unlock()
+	if err != nil || !extendedConnect {
+		c.close(errH2GoingAway)
+		if err == nil {
+			err = errors.New("Server doesn't support websockets over HTTP/2 (RFC 8441)")
+		}
+		return nil, err
+	}
+	logDebug("Opened HTTP/2 connection to the server", "server", host)
+	h2Mu.Lock()
+	c.mu.Lock()
+	// Unless closed already, or its onClose removes it once it's done waiting for h2Mu.
+	if c.err == nil {
+		h2Conns[host] = append(h2Conns[host], c)
+	}
+	c.mu.Unlock()
+	h2Mu.Unlock()
+	if s := c.reserveStream(); s != nil {
+		return s, nil
+	}
+	return nil, errH2GoingAway
+}
+
+// streamListener hands the streams of HTTP/2 connections to an http.Server, as connections of their own.
+type streamListener struct {
+	conns chan net.Conn
+	once  sync.Once
+	done  chan struct{}
+}
+
+func (l *streamListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, errH2GoingAway
+	}
+}
+
+func (l *streamListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *streamListener) Addr() net.Addr {
+	return h2Addr{}
+}
+
+func (l *streamListener) deliver(s *h2Stream) {
+	select {
+	case l.conns <- s:
+	case <-l.done:
+		s.Close()
+	}
+}
+
+// h2Addr is the address of a streamListener, whose streams have the addresses of their connections.
+type h2Addr struct{}
+
+func (h2Addr) Network() string { return "h2" }
+func (h2Addr) String() string  { return "h2" }
+
+// serveHTTP2 has srv accept websockets over HTTP/2, serving the streams with its handler. At shutdown, the
+// connections are told to go away, and closed once done.
+func serveHTTP2(srv *http.Server) {
+	streams := &streamListener{conns: make(chan net.Conn), done: make(chan struct{})}
+	var mu sync.Mutex
+	conns := map[*h2Conn]bool{}
+	srv.TLSNextProto["h2"] = func(_ *http.Server, conn *tls.Conn, _ http.Handler) {
+		c := newH2Conn(conn, true)
+		c.newStream = streams.deliver
+		closed := make(chan struct{})
+		c.onClose = func() { close(closed) }
+		mu.Lock()
+		conns[c] = true
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			delete(conns, c)
+			mu.Unlock()
+		}()
+		if err := c.start(); err != nil {
+			logDebug("Failed starting HTTP/2 connection", "remote", conn.RemoteAddr(), "error", err)
+			return
+		}
+		// The connection is closed once this returns.
+		<-closed
+	}
+	srv.RegisterOnShutdown(func() {
+		streams.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for c := range conns {
+			go c.goAway()
+		}
+	})
+	go (&http.Server{Handler: srv.Handler}).Serve(streams)
+}
@@ -0,0 +1,232 @@
+package wstunnel
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	localHealthResponse = clientFlags.String("local_health_response", "OK\n", "What's written back to health probes, see -health_probe and -health_addr")
+	healthProbe         = clientFlags.String("health_probe", "", "If a connection to the listeners starts with these bytes, answer it with "+
+		"-local_health_response instead of tunneling it, so that probing doesn't depend on the server")
+	healthAddr = clientFlags.String("health_addr", "", "host:port of a separate listener answering every connection with -local_health_response")
+)
+
+// healthProbeTimeout bounds how long a connection may take to send enough bytes to tell whether it's a health probe.
+const healthProbeTimeout = time.Second
+
+// answerHealthProbe reads from conn as long as what it sent could be -health_probe, and answers it locally if it is.
+// Otherwise, it returns conn with the bytes read to tell still to be read from it.
+func answerHealthProbe(conn net.Conn) (net.Conn, bool) {
+	probe := []byte(*healthProbe)
+	buf := make([]byte, len(probe))
+	n := 0
+	conn.SetReadDeadline(time.Now().Add(healthProbeTimeout))
+	for n < len(buf) && bytes.HasPrefix(probe, buf[:n]) {
+		m, err := conn.Read(buf[n:])
+		n += m
+		if err != nil {
+			break
+		}
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	if n == len(probe) && bytes.Equal(buf, probe) {
+		answerHealth(conn)
+		return conn, true
+	}
+	return &peekedConn{Conn: conn, peeked: buf[:n]}, false
+}
+
+func answerHealth(conn net.Conn) {
+	if _, err := conn.Write([]byte(*localHealthResponse)); err != nil {
+		logWarn("Failed answering health probe", "remote", conn.RemoteAddr(), "error", err)
+	}
+}
+
+// serveHealth answers every connection on ln until it's closed.
+func serveHealth(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		go func() {
+			answerHealth(conn)
+			conn.Close()
+		}()
+	}
+}
+
+// peekedConn is a net.Conn whose reads start with what was already read from it.
+type peekedConn struct {
+	net.Conn
+	peeked []byte
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	if len(c.peeked) > 0 {
+		n := copy(b, c.peeked)
+		c.peeked = c.peeked[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *peekedConn) CloseWrite() error {
+	closeWrite(c.Conn)
+	return nil
+}
+
+// handshakeResult is the outcome of the latest websocket handshake with a server.
+type handshakeResult struct {
+	err error
+	at  time.Time
+}
+
+var (
+	handshakesMu sync.Mutex
+	// handshakes holds the latest handshake result by server host:port.
+	handshakes = map[string]handshakeResult{}
+	// readinessConfigs are the websocket configs of the tunnels /readyz reports on.
+	readinessConfigs []*websocketConfig
+)
+
+// recordHandshake records the outcome of a handshake with the server of wsConfig, for /readyz.
+func recordHandshake(wsConfig *websocketConfig, err error) {
+	handshakesMu.Lock()
+	defer handshakesMu.Unlock()
+	handshakes[wsConfig.Location.Host] = handshakeResult{err: err, at: time.Now()}
+}
+
+func latestHandshake(wsConfig *websocketConfig) (handshakeResult, bool) {
+	handshakesMu.Lock()
+	defer handshakesMu.Unlock()
+	r, ok := handshakes[wsConfig.Location.Host]
+	return r, ok
+}
+
+// serveHealthz reports that the process is alive.
+func serveHealthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// readinessRetry is how long /readyz keeps reporting a failed handshake before trying another one.
+const readinessRetry = 5 * time.Second
+
+// serverStatus is what's known of whether tunnels can reach a server, for /readyz.
+type serverStatus struct {
+	host      string
+	handshake handshakeResult // The latest handshake with the server, zero if it wasn't connected to yet.
+	pooled    int             // The websockets waiting in its pool.
+	unhealthy bool            // Whether it fails its health checks, see -health_check_interval.
+}
+
+func (s serverStatus) ok() bool {
+	return s.pooled > 0 || !s.unhealthy && !s.handshake.at.IsZero() && s.handshake.err == nil
+}
+
+// stale returns whether a handshake would tell more about the server than what's known.
+func (s serverStatus) stale() bool {
+	if s.pooled > 0 || s.unhealthy {
+		return false
+	}
+	return s.handshake.at.IsZero() || s.handshake.err != nil && time.Since(s.handshake.at) > readinessRetry
+}
+
+func (s serverStatus) String() string {
+	switch {
+	case s.pooled > 0:
+		return fmt.Sprintf("%s: ok (%d pooled)", s.host, s.pooled)
+	case s.unhealthy:
+		return fmt.Sprintf("%s: fails its health checks", s.host)
+	case s.handshake.at.IsZero():
+		return fmt.Sprintf("%s: not connected to yet", s.host)
+	case s.handshake.err != nil:
+		return fmt.Sprintf("%s: %v (%v ago)", s.host, s.handshake.err, time.Since(s.handshake.at).Round(time.Second))
+	}
+	return fmt.Sprintf("%s: ok (%v ago)", s.host, time.Since(s.handshake.at).Round(time.Second))
+}
+
+// tunnelStatus returns what's known of the servers the tunnels of wsConfig may reach, from their pools, their
+// health checks and their latest handshakes.
+func tunnelStatus(wsConfig *websocketConfig) []serverStatus {
+	paths := []*websocketConfig{wsConfig}
+	if wsConfig.Fallbacks != nil {
+		paths = wsConfig.Fallbacks.paths
+	}
+	var statuses []serverStatus
+	for _, path := range paths {
+		servers, healthy := []*websocketConfig{path}, []bool{true}
+		if b := path.Balancer; b != nil {
+			b.mu.Lock()
+			servers, healthy = b.servers, append([]bool{}, b.healthy...)
+			b.mu.Unlock()
+		}
+		for i, config := range servers {
+			s := serverStatus{host: config.Location.Host, unhealthy: *healthCheckInterval > 0 && !healthy[i]}
+			s.handshake, _ = latestHandshake(config)
+			if config.Pool != nil {
+				s.pooled, _ = config.Pool.stats()
+			}
+			statuses = append(statuses, s)
+		}
+	}
+	return statuses
+}
+
+// readiness returns whether tunnels of wsConfig can reach any of their servers, and whether a handshake would
+// tell more about it.
+func readiness(statuses []serverStatus) (ready, stale bool) {
+	for _, s := range statuses {
+		ready = ready || s.ok()
+		stale = stale || s.stale()
+	}
+	return ready, stale
+}
+
+// serveReadyz reports whether the tunnels can reach a server: their own, one balanced with it or a fallback. It takes
+// that from the pools, health checks and latest handshakes, and only opens a tunnel, the way connections do, when
+// that isn't enough to tell: before the first connection, and then every readinessRetry while every server failed.
+func serveReadyz(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&notReady) != 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "shutting down")
+		return
+	}
+	status, report := http.StatusOK, ""
+	for _, wsConfig := range readinessConfigs {
+		statuses := tunnelStatus(wsConfig)
+		ready, stale := readiness(statuses)
+		if !ready && stale {
+			if t, err := openTunnel(wsConfig); err == nil {
+				t.data().Close()
+			}
+			statuses = tunnelStatus(wsConfig)
+			ready, _ = readiness(statuses)
+		}
+		name := wsConfig.Location.Host
+		if m := wsConfig.metrics; m != nil {
+			name = m.name
+		}
+		if ready {
+			report += name + ": ok\n"
+		} else {
+			status = http.StatusServiceUnavailable
+			report += name + ": no server can be reached\n"
+		}
+		for _, s := range statuses {
+			report += "  " + s.String() + "\n"
+		}
+	}
+	w.WriteHeader(status)
+	fmt.Fprint(w, report)
+}
@@ -0,0 +1,137 @@
+package wstunnel
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// closedAddr returns a host:port nothing listens on.
+func closedAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+	return ln.Addr().String()
+}
+
+// readyzReport returns the status and report of /readyz for the tunnels of configs.
+func readyzReport(configs ...*websocketConfig) (int, string) {
+	defer func(c []*websocketConfig) { readinessConfigs = c }(readinessConfigs)
+	readinessConfigs = configs
+	w := httptest.NewRecorder()
+	serveReadyz(w, httptest.NewRequest("GET", "/readyz", nil))
+	return w.Code, w.Body.String()
+}
+
+func TestReadyzFallsBack(t *testing.T) {
+	var handshakes int64
+	server := httptest.NewServer(websocketHandler(func(conn *wsConn) {
+		atomic.AddInt64(&handshakes, 1)
+		io.Copy(io.Discard, conn)
+	}))
+	defer server.Close()
+	config, err := getWsConfig(tunnelConfig{Name: "faythe", TargetHost: closedAddr(t), Fallbacks: []string{server.Listener.Addr().String()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, report := readyzReport(config)
+	if code != http.StatusOK {
+		t.Fatalf("/readyz returned %d with a fallback reachable, want 200:\n%s", code, report)
+	}
+	if n := atomic.LoadInt64(&handshakes); n != 1 {
+		t.Errorf("/readyz performed %d handshakes with the fallback, want 1", n)
+	}
+	code, report = readyzReport(config)
+	if n := atomic.LoadInt64(&handshakes); code != http.StatusOK || n != 1 {
+		t.Errorf("/readyz returned %d after %d handshakes, want 200 from the latest one:\n%s", code, n, report)
+	}
+}
+
+func TestReadyzPool(t *testing.T) {
+	p, dialed := fakePool(t, 1)
+	p.start()
+	waitPoolSize(t, p, 1)
+	p.config.Pool = p
+	p.config.Location.Host = closedAddr(t)
+	if code, report := readyzReport(p.config); code != http.StatusOK || !strings.Contains(report, "1 pooled") {
+		t.Errorf("/readyz returned %d with a websocket pooled, want 200:\n%s", code, report)
+	}
+	if size, _ := p.stats(); size != 1 || atomic.LoadInt64(dialed) != 1 {
+		t.Errorf("/readyz took from the pool, or dialed")
+	}
+}
+
+func TestReadyzHealthChecks(t *testing.T) {
+	defer func(d time.Duration) { *healthCheckInterval = d }(*healthCheckInterval)
+	*healthCheckInterval = time.Minute
+	config := &websocketConfig{Location: &url.URL{Scheme: "ws", Host: closedAddr(t)}}
+	b := &balancer{servers: []*websocketConfig{config, {Location: &url.URL{Scheme: "ws", Host: closedAddr(t)}}},
+		active: make([]int, 2), healthy: []bool{false, false}, failed: make([]time.Time, 2)}
+	config.Balancer = b
+	code, report := readyzReport(config)
+	if code != http.StatusServiceUnavailable || strings.Count(report, "fails its health checks") != 2 {
+		t.Errorf("/readyz returned %d with every server failing its health checks, want 503:\n%s", code, report)
+	}
+	if b.active[0] != 0 || b.failed[0] != (time.Time{}) || b.failed[1] != (time.Time{}) {
+		t.Error("/readyz tried servers failing their health checks")
+	}
+}
+
+func TestHealthProbe(t *testing.T) {
+	func(probe, response string) {
+		t.Cleanup(func() { *healthProbe, *localHealthResponse = probe, response })
+	}(*healthProbe, *localHealthResponse)
+	*healthProbe, *localHealthResponse = "PING\r\n", "HEALTHY\n"
+	var handshakes int64
+	server := httptest.NewServer(websocketHandler(func(conn *wsConn) { atomic.AddInt64(&handshakes, 1) }))
+	t.Cleanup(server.Close)
+	client := startTunnel(t, ClientConfig{ServerURL: "ws://" + server.Listener.Addr().String() + "/"})
+
+	conn, err := net.Dial("tcp", client.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte(*healthProbe))
+	if b, err := io.ReadAll(conn); string(b) != *localHealthResponse {
+		t.Errorf("Health probe answered %q, %v, want -local_health_response", b, err)
+	}
+	if n := atomic.LoadInt64(&handshakes); n != 0 {
+		t.Errorf("Health probe caused %d handshakes with the server, want none", n)
+	}
+
+	// Anything else is tunneled, including the bytes read to tell.
+	tunneled := startTunnel(t, ClientConfig{})
+	if _, answer, err := pingThrough(t, tunneled, startTarget(t).Addr().String()); err != nil || answer != "pong!" {
+		t.Errorf("Ping with -health_probe set = %q, %v, want it tunneled", answer, err)
+	}
+}
+
+func TestHealthAddr(t *testing.T) {
+	defer func(response string) { *localHealthResponse = response }(*localHealthResponse)
+	*localHealthResponse = "HEALTHY\n"
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go serveHealth(ln)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if b, err := io.ReadAll(conn); string(b) != "HEALTHY\n" {
+		t.Errorf("-health_addr answered %q, %v, want -local_health_response", b, err)
+	}
+}
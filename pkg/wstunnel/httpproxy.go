@@ -0,0 +1,84 @@
+package wstunnel
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	httpProxyMode = clientFlags.Bool("http_proxy_mode", false, "Serve HTTP on the listeners and forward each request through the tunnel, "+
+		"instead of tunneling raw connections")
+	httpBackend = clientFlags.String("http_backend", "", "host:port of the backend for -http_proxy_mode, or empty to use each request's Host")
+)
+
+const httpIdleTimeout = 90 * time.Second
+
+var errBreakerOpen = errors.New("circuit breaker is open")
+
+// newHTTPProxy returns a reverse proxy for -http_proxy_mode. Each tunnel carries a single HTTP/1.1
+// connection to the backend, established with a SOCKS5 CONNECT as for raw tunnels, and requests and
+// responses are written to it as is. Tunnels are kept open between requests and reused for later ones.
+func newHTTPProxy(wsConfig *websocketConfig) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			r.URL.Scheme = "http"
+			r.URL.Host = r.Host
+			if *httpBackend != "" {
+				r.URL.Host = *httpBackend
+			}
+		},
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dialThroughTunnel(wsConfig, addr)
+			},
+			MaxIdleConnsPerHost: 16,
+			IdleConnTimeout:     httpIdleTimeout,
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			logError("Failed forwarding request", "remote", r.RemoteAddr, "method", r.Method, "url", r.URL, "error", err)
+			if errors.Is(err, errBreakerOpen) {
+				http.Error(w, *breakerBanner, http.StatusServiceUnavailable)
+				return
+			}
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+}
+
+// limitHTTP rejects requests while -max_goroutines are running, as serve does with connections.
+func limitHTTP(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if *maxGoroutines > 0 && runtime.NumGoroutine() >= *maxGoroutines {
+			logWarn("Rejecting request: too many goroutines running", "remote", r.RemoteAddr, "goroutines", runtime.NumGoroutine(), "limit", *maxGoroutines)
+			atomic.AddInt64(&goroutineRejections, 1)
+			http.Error(w, *capacityBanner, http.StatusServiceUnavailable)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// dialThroughTunnel establishes a tunnel and connects through it to addr.
+func dialThroughTunnel(wsConfig *websocketConfig, addr string) (net.Conn, error) {
+	if !breaker.allow() {
+		return nil, errBreakerOpen
+	}
+	t, err := openTunnel(wsConfig)
+	if err != nil {
+		breaker.failure()
+		return nil, err
+	}
+	breaker.success()
+
+	if err := t.connect(wsConfig, addr); err != nil {
+		t.data().Close()
+		return nil, err
+	}
+	return t.data(), nil
+}
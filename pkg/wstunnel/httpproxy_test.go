@@ -0,0 +1,95 @@
+package wstunnel
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// httpProxyClient starts a client with -http_proxy_mode forwarding to -http_backend backend.
+func httpProxyClient(t *testing.T, backend string) *Client {
+	func(mode bool, backend string) {
+		t.Cleanup(func() { *httpProxyMode, *httpBackend = mode, backend })
+	}(*httpProxyMode, *httpBackend)
+	*httpProxyMode, *httpBackend = true, backend
+	return startTunnel(t, ClientConfig{})
+}
+
+func TestHTTPProxyMode(t *testing.T) {
+	var mu sync.Mutex
+	conns := map[string]bool{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		conns[r.RemoteAddr] = true
+		mu.Unlock()
+		io.WriteString(w, r.Method+" "+r.URL.Path)
+	}))
+	defer backend.Close()
+	client := httpProxyClient(t, backend.Listener.Addr().String())
+
+	for _, path := range []string{"/first", "/second"} {
+		resp, err := http.Get("http://" + client.Addr().String() + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != "GET "+path {
+			t.Errorf("GET %s = %s %q, want the backend's answer", path, resp.Status, body)
+		}
+	}
+	// Each tunnel carries a connection to the backend, kept open for later requests.
+	mu.Lock()
+	defer mu.Unlock()
+	if len(conns) != 1 {
+		t.Errorf("The backend got %d connections for sequential requests, want the tunnel reused", len(conns))
+	}
+}
+
+func TestHTTPProxyModeBackendDown(t *testing.T) {
+	client := httpProxyClient(t, closedAddr(t))
+
+	resp, err := http.Get("http://" + client.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("GET with the backend down = %s, want 502 Bad Gateway", resp.Status)
+	}
+}
+
+func TestHTTPProxyModeRejections(t *testing.T) {
+	func(capacity, open string, b *circuitBreaker, goroutines int) {
+		t.Cleanup(func() { *capacityBanner, *breakerBanner, breaker, *maxGoroutines = capacity, open, b, goroutines })
+	}(*capacityBanner, *breakerBanner, breaker, *maxGoroutines)
+	*capacityBanner, *breakerBanner = "busy, try later", "server unavailable"
+	breaker = &circuitBreaker{threshold: 1, cooldown: time.Minute}
+	client := httpProxyClient(t, closedAddr(t))
+
+	// http.Error ends the body with a newline.
+	breaker.failure()
+	if code, body := get(t, client); code != http.StatusServiceUnavailable || body != *breakerBanner+"\n" {
+		t.Errorf("Request with the circuit breaker open = %d %q, want 503 with -breaker_banner", code, body)
+	}
+	breaker.success()
+
+	*maxGoroutines = 1
+	if code, body := get(t, client); code != http.StatusServiceUnavailable || body != *capacityBanner+"\n" {
+		t.Errorf("Request over -max_goroutines = %d %q, want 503 with -capacity_banner", code, body)
+	}
+}
+
+// get returns the status and body of a request to client.
+func get(t *testing.T, client *Client) (int, string) {
+	resp, err := http.Get("http://" + client.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
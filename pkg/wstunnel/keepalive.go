@@ -0,0 +1,40 @@
+package wstunnel
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	pingInterval = clientFlags.Duration("ping_interval", 0, "Time the server may stay silent on a websocket before it's pinged, "+
+		"to keep NATs and load balancers from dropping idle tunnels and to detect dead ones, or 0 to disable")
+	pongTimeout = clientFlags.Duration("pong_timeout", 10*time.Second, "Time the server may take to answer a ping before the "+
+		"websocket is considered dead and closed, see -ping_interval")
+)
+
+// keepAlive pings server over ws whenever it was silent for interval, -ping_interval, until ws is closed. If the
+// server then stays silent for timeout, -pong_timeout, the connection is closed, which ends the tunnel or has it
+// reconnect. Pongs are consumed by whoever reads from ws, v only notices that something arrived.
+func keepAlive(ws *wsConn, v *frameValidator, server string, interval, timeout time.Duration) {
+	for {
+		idle := time.Since(time.Unix(0, atomic.LoadInt64(&v.lastRead)))
+		if idle < interval {
+			time.Sleep(interval - idle)
+			continue
+		}
+
+		sent := time.Now()
+		if err := ws.WriteControl(websocket.PingMessage, nil, sent.Add(timeout)); err != nil {
+			return
+		}
+		time.Sleep(timeout)
+		if atomic.LoadInt64(&v.lastRead) < sent.UnixNano() {
+			logWarn("Server didn't answer ping, closing connection", "server", server, "timeout", timeout)
+			// Closing ws would try to send the server a close frame, which may hang on a dead connection.
+			v.Conn.Close()
+			return
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package wstunnel
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strings"
+)
+
+const (
+	// unixPrefix marks the addresses that are Unix socket paths rather than host:port.
+	unixPrefix = "unix:"
+	// pipePrefix starts the paths of Windows named pipes, which are used as addresses as they are.
+	pipePrefix = `\\.\pipe\`
+)
+
+// splitNetwork returns the network and address of addr, a host:port, unix:/path or \\.\pipe\name.
+func splitNetwork(addr string) (network, address string) {
+	if strings.HasPrefix(addr, unixPrefix) {
+		return "unix", addr[len(unixPrefix):]
+	}
+	if strings.HasPrefix(strings.ToLower(addr), pipePrefix) {
+		return "pipe", addr
+	}
+	return "tcp", addr
+}
+
+// listenEndpoint is an address something is configured to listen on, named after its flag.
+type listenEndpoint struct {
+	name    string
+	network string // "tcp", "udp", "unix" or "pipe".
+	addr    string // Empty if the endpoint is disabled.
+}
+
+// checkListenAddrs returns an error naming the first two endpoints configured to listen on the same
+// address, so that this is caught up front rather than as a bind error halfway through startup.
+func checkListenAddrs(endpoints ...listenEndpoint) error {
+	for i, a := range endpoints {
+		for _, b := range endpoints[:i] {
+			if a.addr != "" && b.addr != "" && sameListenAddr(a, b) {
+				return fmt.Errorf("%s and %s are both configured to listen on %s", b.name, a.name, a.addr)
+			}
+		}
+	}
+	return nil
+}
+
+func sameListenAddr(a, b listenEndpoint) bool {
+	if a.network != b.network {
+		return false
+	}
+	if a.network == "unix" {
+		return path.Clean(a.addr) == path.Clean(b.addr)
+	}
+	if a.network == "pipe" {
+		// Pipe names are case-insensitive.
+		return strings.EqualFold(a.addr, b.addr)
+	}
+
+	ahost, aport, aerr := net.SplitHostPort(a.addr)
+	bhost, bport, berr := net.SplitHostPort(b.addr)
+	if aerr != nil || berr != nil {
+		return a.addr == b.addr
+	}
+	if aport != bport || aport == "0" {
+		return false
+	}
+	// Listening on the unspecified address takes the port on all addresses.
+	return ahost == bhost || isUnspecified(ahost) || isUnspecified(bhost)
+}
+
+func isUnspecified(host string) bool {
+	if host == "" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsUnspecified()
+}
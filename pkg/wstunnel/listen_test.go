@@ -0,0 +1,39 @@
+package wstunnel
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckListenAddrs(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		endpoints []listenEndpoint
+		conflict  string // What the error names, empty for none.
+	}{
+		{"distinct ports", []listenEndpoint{{"-listen", "tcp", "127.0.0.1:8080"}, {"-metrics_addr", "tcp", "127.0.0.1:9090"}}, ""},
+		{"same address", []listenEndpoint{{"-listen", "tcp", "127.0.0.1:8080"}, {"-metrics_addr", "tcp", "127.0.0.1:8080"}},
+			"-listen and -metrics_addr are both configured to listen on 127.0.0.1:8080"},
+		{"unspecified host", []listenEndpoint{{"-listen", "tcp", ":8080"}, {"-health_addr", "tcp", "127.0.0.1:8080"}},
+			"-listen and -health_addr"},
+		{"unspecified IP", []listenEndpoint{{"-listen", "tcp", "127.0.0.1:8080"}, {"-health_addr", "tcp", "[::]:8080"}},
+			"-listen and -health_addr"},
+		{"different hosts", []listenEndpoint{{"-listen", "tcp", "127.0.0.1:8080"}, {"-health_addr", "tcp", "127.0.0.2:8080"}}, ""},
+		{"ephemeral ports", []listenEndpoint{{"-listen", "tcp", "127.0.0.1:0"}, {"-metrics_addr", "tcp", "127.0.0.1:0"}}, ""},
+		{"disabled", []listenEndpoint{{"-listen", "tcp", ""}, {"-metrics_addr", "tcp", ""}}, ""},
+		{"tcp and udp", []listenEndpoint{{`Tunnel "dns"`, "udp", "127.0.0.1:53"}, {`Tunnel "web"`, "tcp", "127.0.0.1:53"}}, ""},
+		{"unix paths", []listenEndpoint{{"-listen_unix", "unix", "/run/wstunnel.sock"}, {"-event_socket", "unix", "/run/../run/wstunnel.sock"}},
+			"-listen_unix and -event_socket"},
+		{"pipe names", []listenEndpoint{{"-listen", "pipe", `\\.\pipe\wstunnel`}, {`Tunnel "b"`, "pipe", `\\.\PIPE\WSTunnel`}},
+			`-listen and Tunnel "b"`},
+		{"first conflict", []listenEndpoint{{"a", "tcp", ":1"}, {"b", "tcp", ":2"}, {"c", "tcp", ":2"}, {"d", "tcp", ":1"}}, "b and c"},
+	} {
+		err := checkListenAddrs(tt.endpoints...)
+		switch {
+		case tt.conflict == "" && err != nil:
+			t.Errorf("%s: checkListenAddrs() = %v, want no conflict", tt.name, err)
+		case tt.conflict != "" && (err == nil || !strings.Contains(err.Error(), tt.conflict)):
+			t.Errorf("%s: checkListenAddrs() = %v, want an error naming %s", tt.name, err, tt.conflict)
+		}
+	}
+}
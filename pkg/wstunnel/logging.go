@@ -0,0 +1,136 @@
+package wstunnel
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+var (
+	logLevel  = sharedFlags.String("log_level", "info", "Minimum level of messages to log: debug, info, warn or error")
+	logFormat = sharedFlags.String("log_format", "text", "Format of log lines: text, "+
+		"logfmt for key=value pairs only, or json for one object per line, e.g. for Loki or ELK")
+)
+
+// logLevels are the levels of -log_level.
+var logLevels = map[string]slog.Level{"debug": slog.LevelDebug, "info": slog.LevelInfo, "warn": slog.LevelWarn, "error": slog.LevelError}
+
+// minLevel is the level of -log_level, lowered to debug by -debug_conns.
+var minLevel = new(slog.LevelVar)
+
+// logger logs in -log_format, through the log package so that its output applies.
+var logger = slog.New(newTextHandler())
+
+// setupLogging applies -log_level and -log_format.
+func setupLogging() error {
+	level, ok := logLevels[strings.ToLower(*logLevel)]
+	if !ok {
+		return fmt.Errorf("Unknown -log_level: %s", *logLevel)
+	}
+	minLevel.Set(level)
+
+	switch *logFormat {
+	case "text":
+		logger = slog.New(newTextHandler())
+	case "json":
+		// Lines carry their own timestamp.
+		logger = slog.New(slog.NewJSONHandler(logOutput{}, logOptions()))
+	case "logfmt":
+		logger = slog.New(slog.NewTextHandler(logOutput{}, logOptions()))
+	default:
+		return fmt.Errorf("Unknown -log_format: %s", *logFormat)
+	}
+	return nil
+}
+
+// logDebug, logInfo, logWarn and logError log msg with fields given as alternating keys and values, like
+// logInfo("Tunnel closed", "remote", addr, "bytes", n).
+func logDebug(msg string, kv ...interface{}) { logger.Debug(msg, kv...) }
+func logInfo(msg string, kv ...interface{})  { logger.Info(msg, kv...) }
+func logWarn(msg string, kv ...interface{})  { logger.Warn(msg, kv...) }
+func logError(msg string, kv ...interface{}) { logger.Error(msg, kv...) }
+
+// debugEnabled returns whether debug messages are logged, for those costly to put together.
+func debugEnabled() bool {
+	return minLevel.Level() <= slog.LevelDebug
+}
+
+func logOptions() *slog.HandlerOptions {
+	return &slog.HandlerOptions{Level: minLevel, ReplaceAttr: replaceLogAttr}
+}
+
+// replaceLogAttr logs levels in lower case, and values describing themselves, like addresses and durations,
+// as their text rather than their fields or nanoseconds.
+func replaceLogAttr(groups []string, a slog.Attr) slog.Attr {
+	switch v := a.Value; {
+	case len(groups) == 0 && a.Key == slog.LevelKey:
+		a.Value = slog.StringValue(strings.ToLower(v.String()))
+	case v.Kind() == slog.KindDuration:
+		a.Value = slog.StringValue(v.Duration().String())
+	case v.Kind() == slog.KindAny:
+		if _, isErr := v.Any().(error); !isErr {
+			if s, ok := v.Any().(fmt.Stringer); ok {
+				a.Value = slog.StringValue(s.String())
+			}
+		}
+	}
+	return a
+}
+
+// logOutput writes to the output of the log package, whatever it's set to at the time.
+type logOutput struct{}
+
+func (logOutput) Write(b []byte) (int, error) {
+	return log.Writer().Write(b)
+}
+
+// textHandler logs records as "LEVEL msg key=value ..." through the log package, which prefixes them with the
+// time, with the fields formatted as slog.TextHandler does.
+type textHandler struct {
+	fields slog.Handler // Formats the fields of records into buf.
+	mu     *sync.Mutex
+	buf    *bytes.Buffer
+}
+
+func newTextHandler() *textHandler {
+	h := &textHandler{mu: new(sync.Mutex), buf: new(bytes.Buffer)}
+	h.fields = slog.NewTextHandler(h.buf, &slog.HandlerOptions{Level: minLevel, ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+		if len(groups) == 0 && (a.Key == slog.TimeKey || a.Key == slog.LevelKey || a.Key == slog.MessageKey) {
+			return slog.Attr{}
+		}
+		return replaceLogAttr(groups, a)
+	}})
+	return h
+}
+
+func (h *textHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.fields.Enabled(ctx, level)
+}
+
+func (h *textHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.mu.Lock()
+	h.buf.Reset()
+	err := h.fields.Handle(ctx, r)
+	line := r.Level.String() + " " + r.Message
+	if fields := strings.TrimSuffix(h.buf.String(), "\n"); fields != "" {
+		line += " " + fields
+	}
+	h.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	log.Print(line)
+	return nil
+}
+
+func (h *textHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &textHandler{fields: h.fields.WithAttrs(attrs), mu: h.mu, buf: h.buf}
+}
+
+func (h *textHandler) WithGroup(name string) slog.Handler {
+	return &textHandler{fields: h.fields.WithGroup(name), mu: h.mu, buf: h.buf}
+}
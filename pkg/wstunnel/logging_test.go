@@ -0,0 +1,164 @@
+package wstunnel
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// parseLogfmt returns the keys and values of a logfmt line, in order.
+func parseLogfmt(line string) (keys, values []string, err error) {
+	for line != "" {
+		eq := strings.IndexByte(line, '=')
+		if eq <= 0 || strings.ContainsAny(line[:eq], ` "`) {
+			return nil, nil, fmt.Errorf("no key at %q", line)
+		}
+		keys = append(keys, line[:eq])
+		line = line[eq+1:]
+		var v string
+		if strings.HasPrefix(line, `"`) {
+			q, err := strconv.QuotedPrefix(line)
+			if err != nil {
+				return nil, nil, fmt.Errorf("bad quoted value at %q", line)
+			}
+			v, _ = strconv.Unquote(q)
+			line = line[len(q):]
+		} else {
+			end := strings.IndexByte(line, ' ')
+			if end < 0 {
+				end = len(line)
+			}
+			v, line = line[:end], line[end:]
+			if strings.ContainsAny(v, `"=`) {
+				return nil, nil, fmt.Errorf("unquoted value %q", v)
+			}
+		}
+		values = append(values, v)
+		if line != "" {
+			if line[0] != ' ' {
+				return nil, nil, fmt.Errorf("no space before %q", line)
+			}
+			line = line[1:]
+		}
+	}
+	return keys, values, nil
+}
+
+// captureLog returns what f logs with -log_format set to format.
+func captureLog(format string, f func()) string {
+	defer func(f string) {
+		*logFormat = f
+		setupLogging()
+	}(*logFormat)
+	*logFormat = format
+	if err := setupLogging(); err != nil {
+		panic(err)
+	}
+	var b bytes.Buffer
+	defer func(w io.Writer, flags int) {
+		log.SetOutput(w)
+		log.SetFlags(flags)
+	}(log.Writer(), log.Flags())
+	log.SetOutput(&b)
+	log.SetFlags(0)
+	f()
+	return b.String()
+}
+
+func TestLogfmt(t *testing.T) {
+	line := captureLog("logfmt", func() {
+		logWarn("Tunnel closed", "id", 7, "remote", "127.0.0.1:1234", "target", "faythe.com:443", "bytes_to_server", int64(1024),
+			"error", errors.New(`read tcp: "connection" reset`), "note", "", "ratio", "a=b", "lines", "one\ntwo")
+	})
+	line = strings.TrimSuffix(line, "\n")
+	if strings.Contains(line, "\n") {
+		t.Fatalf("Logged more than one line: %q", line)
+	}
+	keys, values, err := parseLogfmt(line)
+	if err != nil {
+		t.Fatalf("%q isn't logfmt: %v", line, err)
+	}
+
+	wantKeys := []string{"time", "level", "msg", "id", "remote", "target", "bytes_to_server", "error", "note", "ratio", "lines"}
+	if strings.Join(keys, " ") != strings.Join(wantKeys, " ") {
+		t.Errorf("Keys are %v, want %v", keys, wantKeys)
+	}
+	if _, err := time.Parse(time.RFC3339Nano, values[0]); err != nil {
+		t.Errorf("time=%q: %v", values[0], err)
+	}
+	wantValues := []string{"warn", "Tunnel closed", "7", "127.0.0.1:1234", "faythe.com:443", "1024",
+		`read tcp: "connection" reset`, "", "a=b", "one\ntwo"}
+	for i, want := range wantValues {
+		if i+1 < len(values) && values[i+1] != want {
+			t.Errorf("%s=%q, want %q", keys[i+1], values[i+1], want)
+		}
+	}
+}
+
+func TestLogfmtValue(t *testing.T) {
+	for _, tt := range []struct {
+		v    interface{}
+		want string
+	}{
+		{"plain", "plain"},
+		{"", `""`},
+		{"with space", `"with space"`},
+		{`say "hi"`, `"say \"hi\""`},
+		{"k=v", `"k=v"`},
+		{"tab\there", `"tab\there"`},
+		{42, "42"},
+		{time.Second, "1s"},
+		{errors.New("failed"), "failed"},
+		{&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}, "127.0.0.1:1234"},
+	} {
+		line := strings.TrimSuffix(captureLog("logfmt", func() { logInfo("Value", "v", tt.v) }), "\n")
+		if got := line[strings.LastIndex(line, " v=")+len(" v="):]; got != tt.want {
+			t.Errorf("%#v logged as v=%s, want v=%s", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestLogJSON(t *testing.T) {
+	line := captureLog("json", func() {
+		logError("Tunnel closed", "id", 7, "remote", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}, "duration", time.Second,
+			"error", errors.New("failed"), "ok", false)
+	})
+	var got map[string]interface{}
+	if err := json.Unmarshal([]byte(line), &got); err != nil {
+		t.Fatalf("%q isn't JSON: %v", line, err)
+	}
+	if _, err := time.Parse(time.RFC3339Nano, fmt.Sprint(got["time"])); err != nil {
+		t.Errorf("time=%v: %v", got["time"], err)
+	}
+	delete(got, "time")
+	want := map[string]interface{}{"level": "error", "msg": "Tunnel closed", "id": 7.0, "remote": "127.0.0.1:1234",
+		"duration": "1s", "error": "failed", "ok": false}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Logged %v, want %v", got, want)
+	}
+}
+
+func TestLogText(t *testing.T) {
+	defer func(l string) {
+		*logLevel = l
+		setupLogging()
+	}(*logLevel)
+	*logLevel = "warn"
+	line := captureLog("text", func() {
+		logInfo("Not logged below -log_level")
+		logWarn("Tunnel closed", "remote", "127.0.0.1:1234", "error", errors.New("connection reset"))
+		logWarn("No fields")
+	})
+	if want := "WARN Tunnel closed remote=127.0.0.1:1234 error=\"connection reset\"\nWARN No fields\n"; line != want {
+		t.Errorf("Logged %q, want %q", line, want)
+	}
+}
@@ -0,0 +1,152 @@
+package wstunnel
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync/atomic"
+)
+
+var metricsAddr = clientFlags.String("metrics_addr", "", "host:port of an HTTP listener serving Prometheus metrics at /metrics, "+
+	"and liveness and readiness at /healthz and /readyz, or empty to disable")
+
+// tunnelMetrics are the counters of a tunnel.
+type tunnelMetrics struct {
+	name                         string
+	active, connections          int64
+	handshakeFailures            int64
+	protocolViolations           int64
+	lostBytes                    int64
+	bytesToServer, bytesToClient int64
+	coalesce                     coalesceStats
+	balancer                     *balancer // The balancer of the tunnel's servers, nil with a single server.
+}
+
+var (
+	// allTunnelMetrics holds the metrics of every tunnel of the client command, in the order the tunnels
+	// were defined. It's only written before any tunnel is served.
+	allTunnelMetrics []*tunnelMetrics
+	// reconnectAttempts is the number of attempts to reestablish a lost persistent connection to the server.
+	reconnectAttempts int64
+	// goroutineRejections is the number of connections and requests rejected because of -max_goroutines.
+	goroutineRejections int64
+)
+
+// registerTunnelMetrics sets up the metrics of the tunnel of wsConfig, exported by -metrics_addr.
+func registerTunnelMetrics(name string, wsConfig *websocketConfig) {
+	wsConfig.metrics = &tunnelMetrics{name: name, balancer: wsConfig.Balancer}
+	allTunnelMetrics = append(allTunnelMetrics, wsConfig.metrics)
+	namePools(name, wsConfig)
+}
+
+// totalBytes returns the data tunneled in each direction, across tunnels.
+func totalBytes() (toServer, toClient int64) {
+	for _, m := range allTunnelMetrics {
+		toServer += atomic.LoadInt64(&m.bytesToServer)
+		toClient += atomic.LoadInt64(&m.bytesToClient)
+	}
+	return toServer, toClient
+}
+
+// labelEscaper escapes label values as the Prometheus text format wants, which differs from Go's quoting.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelValue returns s quoted as a label value.
+func labelValue(s string) string {
+	return `"` + labelEscaper.Replace(s) + `"`
+}
+
+// serveMetrics writes the metrics in the Prometheus text format.
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	perTunnel := func(name, typ, help string, value func(m *tunnelMetrics) *int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+		for _, m := range allTunnelMetrics {
+			fmt.Fprintf(w, "%s{tunnel=%s} %d\n", name, labelValue(m.name), atomic.LoadInt64(value(m)))
+		}
+	}
+	perTunnel("wstunnel_active_connections", "gauge", "Connections currently tunneled.",
+		func(m *tunnelMetrics) *int64 { return &m.active })
+	perTunnel("wstunnel_connections_total", "counter", "Connections accepted.",
+		func(m *tunnelMetrics) *int64 { return &m.connections })
+	perTunnel("wstunnel_handshake_failures_total", "counter", "Connections that failed to reach the server.",
+		func(m *tunnelMetrics) *int64 { return &m.handshakeFailures })
+	perTunnel("wstunnel_protocol_violations_total", "counter", "Connections closed because the server violated the websocket protocol.",
+		func(m *tunnelMetrics) *int64 { return &m.protocolViolations })
+	perTunnel("wstunnel_lost_bytes_total", "counter", "Data read from clients that couldn't be delivered to the server before it closed.",
+		func(m *tunnelMetrics) *int64 { return &m.lostBytes })
+
+	io.WriteString(w, "# HELP wstunnel_bytes_total Data tunneled, by direction.\n# TYPE wstunnel_bytes_total counter\n")
+	for _, m := range allTunnelMetrics {
+		fmt.Fprintf(w, "wstunnel_bytes_total{tunnel=%s,direction=\"to_server\"} %d\n", labelValue(m.name), atomic.LoadInt64(&m.bytesToServer))
+		fmt.Fprintf(w, "wstunnel_bytes_total{tunnel=%s,direction=\"to_client\"} %d\n", labelValue(m.name), atomic.LoadInt64(&m.bytesToClient))
+	}
+
+	if *coalesceWindow > 0 {
+		writeCoalesceMetrics(w)
+	}
+
+	if breaker != nil {
+		io.WriteString(w, "# HELP wstunnel_circuit_breaker_state Whether the circuit breaker is in each state, see -breaker_failures.\n"+
+			"# TYPE wstunnel_circuit_breaker_state gauge\n")
+		current := breaker.current()
+		for _, s := range []breakerState{breakerClosed, breakerOpen, breakerHalfOpen} {
+			in := 0
+			if s == current {
+				in = 1
+			}
+			fmt.Fprintf(w, "wstunnel_circuit_breaker_state{state=\"%s\"} %d\n", s, in)
+		}
+	}
+
+	if *healthCheckInterval > 0 {
+		io.WriteString(w, "# HELP wstunnel_all_servers_unhealthy Whether every server of a tunnel fails its health checks, see -all_unhealthy.\n"+
+			"# TYPE wstunnel_all_servers_unhealthy gauge\n")
+		for _, m := range allTunnelMetrics {
+			if m.balancer != nil {
+				degraded := 0
+				if m.balancer.isDegraded() {
+					degraded = 1
+				}
+				fmt.Fprintf(w, "wstunnel_all_servers_unhealthy{tunnel=%s} %d\n", labelValue(m.name), degraded)
+			}
+		}
+	}
+
+	if *poolSize > 0 {
+		// Only the pools of tunnels, those of reverse forwards going unused.
+		poolsMu.Lock()
+		var named []*tunnelPool
+		for _, p := range pools {
+			if p.tunnel != "" {
+				named = append(named, p)
+			}
+		}
+		poolsMu.Unlock()
+		perPool := func(name, help string, value func(size, highWater int) int) {
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+			for _, p := range named {
+				fmt.Fprintf(w, "%s{tunnel=%s,server=%s} %d\n", name, labelValue(p.tunnel), labelValue(p.config.Location.Host), value(p.stats()))
+			}
+		}
+		perPool("wstunnel_pool_size", "Websockets waiting in the pool of a server.",
+			func(size, highWater int) int { return size })
+		perPool("wstunnel_pool_size_high_water", "The most websockets the pool of a server held at once.",
+			func(size, highWater int) int { return highWater })
+	}
+
+	fmt.Fprintf(w, "# HELP wstunnel_reconnect_attempts_total Attempts to reestablish a lost persistent connection to the server.\n"+
+		"# TYPE wstunnel_reconnect_attempts_total counter\nwstunnel_reconnect_attempts_total %d\n", atomic.LoadInt64(&reconnectAttempts))
+	fmt.Fprintf(w, "# HELP wstunnel_goroutines Goroutines running, see -max_goroutines.\n"+
+		"# TYPE wstunnel_goroutines gauge\nwstunnel_goroutines %d\n", runtime.NumGoroutine())
+	fmt.Fprintf(w, "# HELP wstunnel_active_tunnels Connections currently handled, across tunnels and reverse forwards.\n"+
+		"# TYPE wstunnel_active_tunnels gauge\nwstunnel_active_tunnels %d\n", atomic.LoadInt64(&activeTunnels))
+	fmt.Fprintf(w, "# HELP wstunnel_pending_tunnels Connections accepted but still connecting to the server, see -max_pending.\n"+
+		"# TYPE wstunnel_pending_tunnels gauge\nwstunnel_pending_tunnels %d\n", atomic.LoadInt64(&pendingTunnels))
+	fmt.Fprintf(w, "# HELP wstunnel_pending_limit_reached_total Times accepting connections stopped because of -max_pending.\n"+
+		"# TYPE wstunnel_pending_limit_reached_total counter\nwstunnel_pending_limit_reached_total %d\n", atomic.LoadInt64(&pendingLimitReached))
+	fmt.Fprintf(w, "# HELP wstunnel_goroutine_rejections_total Connections and requests rejected because of -max_goroutines.\n"+
+		"# TYPE wstunnel_goroutine_rejections_total counter\nwstunnel_goroutine_rejections_total %d\n", atomic.LoadInt64(&goroutineRejections))
+}
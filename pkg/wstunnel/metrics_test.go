@@ -0,0 +1,110 @@
+package wstunnel
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// scrape returns the samples served by serveMetrics, by metric name and labels.
+func scrape(t *testing.T) map[string]float64 {
+	w := httptest.NewRecorder()
+	serveMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	samples := map[string]float64{}
+	s := bufio.NewScanner(w.Body)
+	for s.Scan() {
+		line := s.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("Bad sample %q: %v", line, err)
+		}
+		samples[line[:i]] = v
+	}
+	return samples
+}
+
+func TestGoroutineMetrics(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	before := scrape(t)["wstunnel_goroutines"]
+	for i := 0; i < 100; i++ {
+		go func() { <-block }()
+	}
+	samples := scrape(t)
+	if got := samples["wstunnel_goroutines"]; got < before+100 {
+		t.Errorf("wstunnel_goroutines = %v after starting 100 goroutines, up from %v", got, before)
+	}
+
+	defer func(n int) { *maxGoroutines = n }(*maxGoroutines)
+	*maxGoroutines = runtime.NumGoroutine()
+	w := httptest.NewRecorder()
+	limitHTTP(http.NotFoundHandler()).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("A request over -max_goroutines got %d, want 503", w.Code)
+	}
+	if got := scrape(t)["wstunnel_goroutine_rejections_total"]; got != samples["wstunnel_goroutine_rejections_total"]+1 {
+		t.Errorf("wstunnel_goroutine_rejections_total = %v after a rejection, up from %v", got, samples["wstunnel_goroutine_rejections_total"])
+	}
+}
+
+func TestLabelValue(t *testing.T) {
+	for s, want := range map[string]string{
+		"faythe":               `"faythe"`,
+		`C:\tunnels\"faythe"`:  `"C:\\tunnels\\\"faythe\""`,
+		"two\nlines":           `"two\nlines"`,
+		"tab\tand ünïcödé\x01": "\"tab\tand ünïcödé\x01\"",
+	} {
+		if got := labelValue(s); got != want {
+			t.Errorf("labelValue(%q) = %s, want %s", s, got, want)
+		}
+	}
+}
+
+func TestMetricsLabelEscaping(t *testing.T) {
+	defer func(m []*tunnelMetrics) { allTunnelMetrics = m }(allTunnelMetrics)
+	allTunnelMetrics = []*tunnelMetrics{{name: "-L 8080:bob.com:22 \"ünïcödé\"", connections: 3}}
+	samples := scrape(t)
+	if got, ok := samples[`wstunnel_connections_total{tunnel="-L 8080:bob.com:22 \"ünïcödé\""}`]; !ok || got != 3 {
+		t.Errorf("The connections of the tunnel aren't reported with its name escaped: %v", samples)
+	}
+}
+
+func TestLostBytes(t *testing.T) {
+	defer func(policy string) { *onUpstreamClose = policy }(*onUpstreamClose)
+	*onUpstreamClose = "fail"
+	release := make(chan struct{})
+	server := httptest.NewServer(websocketHandler(func(conn *wsConn) {
+		// Finishes sending without reading from the tunnel, once the client's writes back up.
+		time.Sleep(200 * time.Millisecond)
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(closeTimeout))
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+	config, err := getWsConfig(tunnelConfig{TargetHost: server.Listener.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(m []*tunnelMetrics) { allTunnelMetrics = m }(allTunnelMetrics)
+	registerTunnelMetrics("lossy", config)
+
+	client, conn := net.Pipe()
+	defer client.Close()
+	go client.Write(make([]byte, 64<<20))
+	handleConnection(config, "", conn)
+	if got := scrape(t)[`wstunnel_lost_bytes_total{tunnel="lossy"}`]; got == 0 {
+		t.Error("wstunnel_lost_bytes_total is 0 after the server closed without reading, want the data lost")
+	}
+}
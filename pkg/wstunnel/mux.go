@@ -0,0 +1,5 @@
+package wstunnel
+
+// muxHeader in the handshake request has the server accept streams multiplexed with yamux on the tunnel,
+// each of them serving as a tunnel of its own.
+const muxHeader = "X-Tunnel-Mux"
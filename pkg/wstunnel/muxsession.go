@@ -0,0 +1,121 @@
+package wstunnel
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+var mux = clientFlags.Bool("mux", false, "Multiplex the connections of each tunnel as streams over a single websocket, "+
+	"instead of a websocket for each of them. The server must support it.")
+
+// muxSession is a websocket connection to the server carrying multiplexed streams.
+type muxSession struct {
+	session *yamux.Session
+	header  http.Header // The header of the server's handshake response.
+}
+
+var (
+	muxMu       sync.Mutex
+	muxSessions = map[*websocketConfig]*muxSession{}
+)
+
+// muxStream is a multiplexed stream, whose Close only closes the write side until the server closed its own.
+type muxStream struct {
+	*yamux.Stream
+}
+
+func (s muxStream) CloseWrite() error {
+	return s.Stream.Close()
+}
+
+// openTunnel returns a new tunnel to the server of wsConfig, through the first of its fallbacks that works if it has any.
+func openTunnel(wsConfig *websocketConfig) (*tunnel, error) {
+	if wsConfig.Fallbacks != nil {
+		return wsConfig.Fallbacks.open(wsConfig)
+	}
+	return openTunnelOn(wsConfig)
+}
+
+// openTunnelOn returns a new tunnel to the server of wsConfig, or to whichever of the servers balanced with it is in turn.
+func openTunnelOn(wsConfig *websocketConfig) (*tunnel, error) {
+	if wsConfig.Balancer != nil {
+		return wsConfig.Balancer.open(wsConfig)
+	}
+	return openTunnelTo(wsConfig)
+}
+
+// openTunnelTo returns a new stream on the session to the server of wsConfig with -mux or -transport=webtransport,
+// establishing the session if needed, or a tunnel of its own otherwise.
+func openTunnelTo(wsConfig *websocketConfig) (*tunnel, error) {
+	if wsConfig.Transport == "webtransport" {
+		return openWTStream(wsConfig)
+	}
+	if !*mux {
+		if wsConfig.Pool != nil {
+			if t := wsConfig.Pool.take(); t != nil {
+				return t, nil
+			}
+		}
+		return dialTunnel(wsConfig)
+	}
+
+	s, err := getMuxSession(wsConfig)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := s.session.OpenStream()
+	if err != nil {
+		s.session.Close()
+		return nil, err
+	}
+	return &tunnel{conn: muxStream{stream}, header: s.header}, nil
+}
+
+// getMuxSession returns the session to the server of wsConfig, establishing it if needed.
+func getMuxSession(wsConfig *websocketConfig) (*muxSession, error) {
+	muxMu.Lock()
+	defer muxMu.Unlock()
+	if s := muxSessions[wsConfig]; s != nil && !s.session.IsClosed() {
+		return s, nil
+	}
+
+	t, err := dialTunnel(withHeader(wsConfig, muxHeader, "yamux"))
+	if err != nil {
+		return nil, err
+	}
+	session, err := yamux.Client(t.ws, nil)
+	if err != nil {
+		t.ws.Close()
+		return nil, err
+	}
+	logInfo("Connected to the server", "server", wsConfig.Location.Host)
+	s := &muxSession{session: session, header: t.header}
+	muxSessions[wsConfig] = s
+	return s, nil
+}
+
+// keepMuxSession keeps the session to the server of wsConfig established, reconnecting whenever it's lost
+// rather than waiting for the next connection to need it.
+func keepMuxSession(wsConfig *websocketConfig) {
+	var b backoff
+	for {
+		s, err := getMuxSession(wsConfig)
+		if err != nil {
+			d, ok := b.next()
+			if !ok {
+				logError("Giving up connecting to the server until a connection needs it", "server", wsConfig.Location.Host,
+					"attempts", *reconnectMaxRetries, "error", err)
+				return
+			}
+			logWarn("Failed connecting to the server, retrying", "server", wsConfig.Location.Host, "delay", d, "attempt", b.attempts, "error", err)
+			time.Sleep(d)
+			continue
+		}
+		b.reset()
+		<-s.session.CloseChan()
+		logWarn("Lost connection to the server, reconnecting", "server", wsConfig.Location.Host)
+	}
+}
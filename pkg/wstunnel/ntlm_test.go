@@ -0,0 +1,127 @@
+package wstunnel
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// The user, and the values derived from their password, of the examples of [MS-NLMP] 4.2.4.
+const (
+	ntlmTestUser     = "User"
+	ntlmTestDomain   = "Domain"
+	ntlmTestPassword = "Password"
+	ntlmTestNTOWFv2  = "0c868a403bfd7a93a3001ef22ef02e3f"
+)
+
+var ntlmTestServerChallenge = []byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}
+
+// ntlmChallenge returns a CHALLENGE_MESSAGE with flags, and targetInfo unless it's nil.
+func ntlmChallenge(flags uint32, targetInfo []byte) []byte {
+	msg := make([]byte, 48)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 2)
+	binary.LittleEndian.PutUint32(msg[20:], flags)
+	copy(msg[24:], ntlmTestServerChallenge)
+	if targetInfo == nil {
+		return msg[:32]
+	}
+	binary.LittleEndian.PutUint16(msg[40:], uint16(len(targetInfo)))
+	binary.LittleEndian.PutUint16(msg[42:], uint16(len(targetInfo)))
+	binary.LittleEndian.PutUint32(msg[44:], uint32(len(msg)))
+	return append(msg, targetInfo...)
+}
+
+// authenticateField returns the field of an AUTHENTICATE_MESSAGE at offset off, failing t if it's out of bounds.
+func authenticateField(t *testing.T, msg []byte, off int) []byte {
+	f, ok := ntlmField(msg, off)
+	if !ok {
+		t.Fatalf("The field at %d of the authenticate message is out of bounds", off)
+	}
+	return f
+}
+
+func TestNTLMAuthenticate(t *testing.T) {
+	timestamp := []byte{0, 0, 0, 0, 0, 0, 0, 0}
+	targetInfo := append(append([]byte{ntlmAvTimestamp, 0, 8, 0}, timestamp...), 0, 0, 0, 0)
+	msg, err := ntlmAuthenticate(ntlmChallenge(ntlmNegotiateUnicode|ntlmNegotiateNTLM, targetInfo),
+		ntlmTestDomain, ntlmTestUser, ntlmTestPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msg[:8], ntlmSignature) || binary.LittleEndian.Uint32(msg[8:]) != 3 {
+		t.Fatalf("Not an AUTHENTICATE_MESSAGE: %x", msg)
+	}
+	if got := authenticateField(t, msg, 28); !bytes.Equal(got, utf16le(ntlmTestDomain)) {
+		t.Errorf("The domain is %x, want %q in UTF-16", got, ntlmTestDomain)
+	}
+	if got := authenticateField(t, msg, 36); !bytes.Equal(got, utf16le(ntlmTestUser)) {
+		t.Errorf("The user is %x, want %q in UTF-16", got, ntlmTestUser)
+	}
+	if flags := binary.LittleEndian.Uint32(msg[60:]); flags != ntlmNegotiateUnicode|ntlmNegotiateNTLM {
+		t.Errorf("The flags are %#x, want those of the challenge", flags)
+	}
+	if lm := authenticateField(t, msg, 12); !bytes.Equal(lm, make([]byte, 24)) {
+		t.Errorf("The LMv2 response is %x, want zeroes with a server timestamp", lm)
+	}
+
+	nt := authenticateField(t, msg, 20)
+	blob := nt[16:]
+	if !bytes.Equal(blob[8:16], timestamp) {
+		t.Errorf("The response has timestamp %x, want the server's %x", blob[8:16], timestamp)
+	}
+	if !bytes.Contains(blob, targetInfo) {
+		t.Errorf("The response %x doesn't hold the target info %x", blob, targetInfo)
+	}
+	key, _ := hex.DecodeString(ntlmTestNTOWFv2)
+	if proof := hmacMD5(key, ntlmTestServerChallenge, blob); !bytes.Equal(nt[:16], proof) {
+		t.Errorf("The NTProofStr is %x, want %x", nt[:16], proof)
+	}
+}
+
+func TestNTLMAuthenticateWithoutTimestamp(t *testing.T) {
+	msg, err := ntlmAuthenticate(ntlmChallenge(ntlmNegotiateNTLM, nil), ntlmTestDomain, ntlmTestUser, ntlmTestPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := authenticateField(t, msg, 36); string(got) != ntlmTestUser {
+		t.Errorf("The user is %q, want %q in the OEM encoding the challenge asked for", got, ntlmTestUser)
+	}
+	key, _ := hex.DecodeString(ntlmTestNTOWFv2)
+	lm := authenticateField(t, msg, 12)
+	if proof := hmacMD5(key, ntlmTestServerChallenge, lm[16:]); !bytes.Equal(lm[:16], proof) {
+		t.Errorf("The LMv2 response is %x, want %x followed by its client challenge", lm, proof)
+	}
+	nt := authenticateField(t, msg, 20)
+	if !bytes.Equal(nt[16+16:16+24], lm[16:]) {
+		t.Errorf("The responses have different client challenges: %x and %x", nt[32:40], lm[16:])
+	}
+}
+
+func TestNTLMAuthenticateMalformed(t *testing.T) {
+	bad := ntlmChallenge(0, []byte{0, 0, 0, 0})
+	binary.LittleEndian.PutUint32(bad[44:], 1000)
+	for _, challenge := range [][]byte{nil, []byte("NTLMSSP\x00"), ntlmNegotiate(), bad} {
+		if _, err := ntlmAuthenticate(challenge, ntlmTestDomain, ntlmTestUser, ntlmTestPassword); err == nil {
+			t.Errorf("ntlmAuthenticate(%x) accepted a malformed challenge", challenge)
+		}
+	}
+}
+
+func TestNTLMAuthenticator(t *testing.T) {
+	a := &ntlmAuthenticator{authScheme: "Negotiate", domain: ntlmTestDomain, user: ntlmTestUser, password: ntlmTestPassword}
+	negotiate, err := a.authorize(nil)
+	if err != nil || negotiate != "Negotiate "+base64.StdEncoding.EncodeToString(ntlmNegotiate()) {
+		t.Fatalf("The first token is %q, %v, want a negotiate message", negotiate, err)
+	}
+	authenticate, err := a.authorize(ntlmChallenge(ntlmNegotiateUnicode, nil))
+	if err != nil || !strings.HasPrefix(authenticate, "Negotiate TlRMTVNTUAADAAAA") {
+		t.Fatalf("The second token is %q, %v, want an authenticate message", authenticate, err)
+	}
+	if again, err := a.authorize(ntlmChallenge(ntlmNegotiateUnicode, nil)); again != "" || err != nil {
+		t.Errorf("The authenticator answered a second challenge with %q, %v", again, err)
+	}
+}
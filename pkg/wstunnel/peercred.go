@@ -0,0 +1,63 @@
+package wstunnel
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// idFlags are the user or group IDs that may connect to the Unix sockets listened on.
+type idFlags []uint32
+
+func (f *idFlags) String() string {
+	var s []string
+	for _, id := range *f {
+		s = append(s, strconv.FormatUint(uint64(id), 10))
+	}
+	return strings.Join(s, ",")
+}
+
+func (f *idFlags) Set(v string) error {
+	id, err := strconv.ParseUint(v, 10, 32)
+	if err != nil {
+		return fmt.Errorf("%q isn't a numeric ID", v)
+	}
+	*f = append(*f, uint32(id))
+	return nil
+}
+
+var allowUIDs, allowGIDs idFlags
+
+func init() {
+	clientFlags.Var(&allowUIDs, "allow_uid", "User ID of the processes that may connect to the Unix sockets listened on, "+
+		"as told by the socket's peer credentials. Can be repeated, along with -allow_gid. Without either, any process "+
+		"the socket's permissions let in may connect. Linux only.")
+	clientFlags.Var(&allowGIDs, "allow_gid", "Group ID of the processes that may connect to the Unix sockets listened on, "+
+		"like -allow_uid")
+}
+
+// allowedPeer returns whether -allow_uid and -allow_gid let the process at the other end of conn connect,
+// and the uid and gid it runs as. Connections other than over Unix sockets are always allowed.
+func allowedPeer(conn net.Conn) (ok bool, uid, gid uint32) {
+	uc, isUnix := conn.(*net.UnixConn)
+	if !isUnix || len(allowUIDs) == 0 && len(allowGIDs) == 0 {
+		return true, 0, 0
+	}
+	uid, gid, err := peerCred(uc)
+	if err != nil {
+		logError("Failed reading the peer credentials of a Unix socket connection", "error", err)
+		return false, 0, 0
+	}
+	for _, id := range allowUIDs {
+		if id == uid {
+			return true, uid, gid
+		}
+	}
+	for _, id := range allowGIDs {
+		if id == gid {
+			return true, uid, gid
+		}
+	}
+	return false, uid, gid
+}
@@ -0,0 +1,27 @@
+package wstunnel
+
+import (
+	"net"
+	"syscall"
+)
+
+const peerCredSupported = true
+
+// peerCred returns the user and group IDs of the process at the other end of conn, as of when it connected.
+func peerCred(conn *net.UnixConn) (uid, gid uint32, err error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return 0, 0, err
+	}
+	var cred *syscall.Ucred
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		cred, serr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return 0, 0, err
+	}
+	if serr != nil {
+		return 0, 0, serr
+	}
+	return cred.Uid, cred.Gid, nil
+}
@@ -0,0 +1,78 @@
+package wstunnel
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// unixPair returns the accepted end of a connection over a Unix socket made by this process.
+func unixPair(t *testing.T) net.Conn {
+	ln, err := net.Listen("unix", filepath.Join(t.TempDir(), "sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("unix", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestAllowedPeer(t *testing.T) {
+	uid, gid := uint32(os.Getuid()), uint32(os.Getgid())
+	for _, tt := range []struct {
+		name       string
+		uids, gids idFlags
+		want       bool
+	}{
+		{"no flags", nil, nil, true},
+		{"allowed uid", idFlags{uid + 1, uid}, nil, true},
+		{"denied uid", idFlags{uid + 1}, nil, false},
+		{"allowed gid", idFlags{uid + 1}, idFlags{gid}, true},
+		{"denied gid", nil, idFlags{gid + 1}, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(uids, gids idFlags) { allowUIDs, allowGIDs = uids, gids }(allowUIDs, allowGIDs)
+			allowUIDs, allowGIDs = tt.uids, tt.gids
+			ok, gotUID, gotGID := allowedPeer(unixPair(t))
+			if ok != tt.want {
+				t.Errorf("allowedPeer() = %v, want %v", ok, tt.want)
+			}
+			if (tt.uids != nil || tt.gids != nil) && (gotUID != uid || gotGID != gid) {
+				t.Errorf("allowedPeer() read uid %d gid %d, want %d and %d", gotUID, gotGID, uid, gid)
+			}
+		})
+	}
+}
+
+func TestAllowedPeerIgnoresTCP(t *testing.T) {
+	defer func(uids idFlags) { allowUIDs = uids }(allowUIDs)
+	allowUIDs = idFlags{uint32(os.Getuid()) + 1}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if ok, _, _ := allowedPeer(conn); !ok {
+		t.Error("allowedPeer() rejected a TCP connection")
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package wstunnel
+
+import (
+	"errors"
+	"net"
+)
+
+const peerCredSupported = false
+
+func peerCred(conn *net.UnixConn) (uid, gid uint32, err error) {
+	return 0, 0, errors.New("Peer credentials are not supported on this platform")
+}
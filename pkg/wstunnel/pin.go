@@ -0,0 +1,90 @@
+package wstunnel
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// pinFlags are the base64 SHA-256 hashes of the public keys (SPKI) the server's certificate chain may hold.
+type pinFlags []string
+
+func (p *pinFlags) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *pinFlags) Set(v string) error {
+	if sum, err := base64.StdEncoding.DecodeString(v); err != nil || len(sum) != sha256.Size {
+		return fmt.Errorf("%q isn't a base64 SHA-256 hash", v)
+	}
+	*p = append(*p, v)
+	return nil
+}
+
+var pinnedKeys pinFlags
+
+func init() {
+	clientFlags.Var(&pinnedKeys, "pin_sha256", "Base64 SHA-256 hash of a public key (SPKI) the server's certificate, or one of its CAs, "+
+		"must have, as in HPKP. "+
+		"Can be repeated to pin a backup key. Enables TLS even without -certs_dir, then pinning the server's certificate only.")
+}
+
+func spkiHash(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func (p pinFlags) pinned(cert *x509.Certificate) bool {
+	hash := spkiHash(cert)
+	for _, pin := range p {
+		if pin == hash {
+			return true
+		}
+	}
+	return false
+}
+
+// verifier returns a tls.Config.VerifyPeerCertificate function requiring a pinned key in a verified chain,
+// or in the leaf certificate if chains aren't verified.
+func (p pinFlags) verifier() func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if len(verifiedChains) == 0 {
+			if len(rawCerts) == 0 {
+				return errors.New("Server presented no certificate")
+			}
+			leaf, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return fmt.Errorf("Invalid server certificate: %v", err)
+			}
+			verifiedChains = [][]*x509.Certificate{{leaf}}
+		}
+		for _, chain := range verifiedChains {
+			for _, cert := range chain {
+				if p.pinned(cert) {
+					return nil
+				}
+			}
+		}
+		leaf := verifiedChains[0][0]
+		return fmt.Errorf("No key of the server certificate chain matches -pin_sha256, the server's is %s", spkiHash(leaf))
+	}
+}
+
+// chainVerifiers returns a tls.Config.VerifyPeerCertificate function calling first then second, either of which may be nil.
+func chainVerifiers(first, second func([][]byte, [][]*x509.Certificate) error) func([][]byte, [][]*x509.Certificate) error {
+	if first == nil {
+		return second
+	}
+	if second == nil {
+		return first
+	}
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if err := first(rawCerts, verifiedChains); err != nil {
+			return err
+		}
+		return second(rawCerts, verifiedChains)
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package wstunnel
+
+import (
+	"fmt"
+	"net"
+)
+
+func listenPipe(path string) (net.Listener, error) {
+	return nil, fmt.Errorf("Can't listen on %s, named pipes are only supported on Windows", path)
+}
+
+func dialPipe(path string) (net.Conn, error) {
+	return nil, fmt.Errorf("Can't connect to %s, named pipes are only supported on Windows", path)
+}
@@ -0,0 +1,17 @@
+package wstunnel
+
+import (
+	"net"
+
+	winio "github.com/Microsoft/go-winio"
+)
+
+// listenPipe listens on the Windows named pipe at path.
+func listenPipe(path string) (net.Listener, error) {
+	return winio.ListenPipe(path, nil)
+}
+
+// dialPipe connects to the Windows named pipe at path.
+func dialPipe(path string) (net.Conn, error) {
+	return winio.DialPipe(path, nil)
+}
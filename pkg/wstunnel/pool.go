@@ -0,0 +1,266 @@
+package wstunnel
+
+import (
+	"runtime/debug"
+	"runtime/metrics"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	poolSize = clientFlags.Int("pool_size", 0, "Websockets to keep handshaked with the server ahead of the connections needing them, "+
+		"which then skip the handshake, or 0 for none. Pooled websockets don't carry the client's address for -backend_proxy_protocol.")
+	poolMaxIdle = clientFlags.Duration("pool_max_idle", time.Minute, "Time a pooled websocket may wait for a connection "+
+		"before it's replaced, so that connections don't get one the server or a middlebox dropped meanwhile")
+	poolMaxMemory = clientFlags.Int64("pool_max_memory", 0, "Memory in bytes held by the process above which the pools "+
+		"close their websockets and stop refilling until it's back under, or 0 for the Go memory limit (GOMEMLIMIT) if set")
+)
+
+// poolMemoryInterval is the interval memory in use is checked at against -pool_max_memory.
+const poolMemoryInterval = 5 * time.Second
+
+// pooledTunnel is a tunnel established ahead of the connection needing it. It's only kept alive with
+// -ping_interval once taken, -pool_max_idle replacing it before NATs and load balancers would drop it.
+type pooledTunnel struct {
+	t  *tunnel
+	at time.Time
+}
+
+// tunnelPool keeps -pool_size tunnels to a server established, refilling as they're taken.
+type tunnelPool struct {
+	config  *websocketConfig
+	tunnel  string // The name of the tunnel the pool is for, set under poolsMu.
+	dial    func(*websocketConfig) (*tunnel, error)
+	tunnels chan pooledTunnel
+	free    chan struct{} // A token per tunnel missing from the pool.
+
+	mu        sync.Mutex
+	filling   bool
+	held      int // Tokens kept from free while under memory pressure.
+	highWater int // The most tunnels the pool held at once.
+}
+
+var (
+	// pools are the pools of every server, for the metrics and memory pressure.
+	pools   []*tunnelPool
+	poolsMu sync.Mutex
+	// memoryPressure is 1 while the process holds more memory than -pool_max_memory. Accessed atomically.
+	memoryPressure int32
+)
+
+// newTunnelPool returns a pool of tunnels to the server of config, or nil without -pool_size.
+func newTunnelPool(config *websocketConfig) *tunnelPool {
+	if *poolSize == 0 {
+		return nil
+	}
+	p := &tunnelPool{config: config, dial: dialIdleTunnel, tunnels: make(chan pooledTunnel, *poolSize), free: make(chan struct{}, *poolSize)}
+	for i := 0; i < *poolSize; i++ {
+		p.free <- struct{}{}
+	}
+	poolsMu.Lock()
+	pools = append(pools, p)
+	poolsMu.Unlock()
+	return p
+}
+
+// start has the pool filled in the background, unless it's being filled already.
+func (p *tunnelPool) start() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.filling {
+		p.filling = true
+		go p.fill()
+	}
+}
+
+// fill establishes a tunnel for every free slot of the pool, backing off while the server can't be reached,
+// and giving up after -reconnect_max_retries until a connection finds the pool empty. Slots freed under
+// memory pressure are held until it's over.
+func (p *tunnelPool) fill() {
+	var b backoff
+	for range p.free {
+		if p.holdUnderPressure() {
+			continue
+		}
+		for {
+			t, err := p.dial(p.config)
+			if err == nil {
+				b.reset()
+				if p.holdUnderPressure() {
+					t.data().Close()
+					break
+				}
+				p.tunnels <- pooledTunnel{t, time.Now()}
+				p.mu.Lock()
+				p.highWater = max(p.highWater, len(p.tunnels))
+				p.mu.Unlock()
+				break
+			}
+			d, ok := b.next()
+			if !ok {
+				logError("Giving up filling the pool until a connection finds it empty", "server", p.config.Location.Host,
+					"attempts", *reconnectMaxRetries, "error", err)
+				p.free <- struct{}{}
+				p.mu.Lock()
+				p.filling = false
+				p.mu.Unlock()
+				return
+			}
+			logWarn("Failed filling the pool, retrying", "server", p.config.Location.Host, "delay", d, "attempt", b.attempts, "error", err)
+			time.Sleep(d)
+		}
+	}
+}
+
+// holdUnderPressure holds a slot of the pool rather than filling it, if under memory pressure.
+func (p *tunnelPool) holdUnderPressure() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if atomic.LoadInt32(&memoryPressure) == 0 {
+		return false
+	}
+	p.held++
+	return true
+}
+
+// take returns a tunnel from the pool, or nil if it has none fresh enough and still open.
+func (p *tunnelPool) take() *tunnel {
+	for {
+		select {
+		case pt := <-p.tunnels:
+			p.free <- struct{}{}
+			if time.Since(pt.at) < *poolMaxIdle && (pt.t.validator == nil || pt.t.validator.alive()) {
+				pt.t.keepAlive(p.config.Location.Host)
+				return pt.t
+			}
+			pt.t.data().Close()
+		default:
+			p.start()
+			return nil
+		}
+	}
+}
+
+// shrink closes the tunnels of the pool, holding their slots until release.
+func (p *tunnelPool) shrink() {
+	for {
+		select {
+		case pt := <-p.tunnels:
+			pt.t.data().Close()
+			p.mu.Lock()
+			p.held++
+			p.mu.Unlock()
+		default:
+			return
+		}
+	}
+}
+
+// release frees the slots held under memory pressure, and has the pool refilled if it held any.
+func (p *tunnelPool) release() {
+	p.mu.Lock()
+	held := p.held
+	for ; p.held > 0; p.held-- {
+		p.free <- struct{}{}
+	}
+	p.mu.Unlock()
+	if held > 0 {
+		p.start()
+	}
+}
+
+// stats returns the tunnels in the pool, and the most it held at once.
+func (p *tunnelPool) stats() (size, highWater int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.tunnels), p.highWater
+}
+
+// startPools starts filling the pools of wsConfig and of the servers balanced with it. The pools of fallbacks
+// only start filling once a connection falls back to them.
+func startPools(wsConfig *websocketConfig) {
+	servers := []*websocketConfig{wsConfig}
+	if wsConfig.Balancer != nil {
+		servers = wsConfig.Balancer.servers
+	}
+	for _, s := range servers {
+		if s.Pool != nil {
+			s.Pool.start()
+		}
+	}
+}
+
+// namePools names the pools of wsConfig, the config of tunnel name, and of the servers it falls back to or
+// balances with after it.
+func namePools(name string, wsConfig *websocketConfig) {
+	configs := []*websocketConfig{wsConfig}
+	if wsConfig.Fallbacks != nil {
+		configs = append(configs, wsConfig.Fallbacks.paths...)
+	}
+	poolsMu.Lock()
+	defer poolsMu.Unlock()
+	for _, c := range configs {
+		servers := []*websocketConfig{c}
+		if c.Balancer != nil {
+			servers = append(servers, c.Balancer.servers...)
+		}
+		for _, s := range servers {
+			if s.Pool != nil {
+				s.Pool.tunnel = name
+			}
+		}
+	}
+}
+
+// poolMemoryLimit returns the memory in bytes above which the pools shrink, or 0 for no limit.
+func poolMemoryLimit() uint64 {
+	if *poolMaxMemory > 0 {
+		return uint64(*poolMaxMemory)
+	}
+	// Reads the limit without changing it.
+	if limit := debug.SetMemoryLimit(-1); limit < 1<<63-1 {
+		return uint64(limit)
+	}
+	return 0
+}
+
+// memoryInUse returns the memory the process holds from the system, as the Go memory limit counts it.
+func memoryInUse() uint64 {
+	s := []metrics.Sample{{Name: "/memory/classes/total:bytes"}, {Name: "/memory/classes/heap/released:bytes"}}
+	metrics.Read(s)
+	return s[0].Value.Uint64() - s[1].Value.Uint64()
+}
+
+// watchPoolMemory empties the pools whenever the process holds more than limit bytes of memory,
+// and has them refilled once it's back under.
+func watchPoolMemory(limit uint64) {
+	for range time.Tick(poolMemoryInterval) {
+		setMemoryPressure(memoryInUse() > limit, limit)
+	}
+}
+
+// setMemoryPressure empties the pools and keeps them empty from the time over is true, until it's false.
+func setMemoryPressure(over bool, limit uint64) {
+	var v int32
+	if over {
+		v = 1
+	}
+	if atomic.SwapInt32(&memoryPressure, v) == v {
+		return
+	}
+	if over {
+		logWarn("Emptying the pools while memory in use is over the limit", "limit", limit)
+	} else {
+		logInfo("Refilling the pools, memory in use is back under the limit", "limit", limit)
+	}
+	poolsMu.Lock()
+	defer poolsMu.Unlock()
+	for _, p := range pools {
+		if over {
+			p.shrink()
+		} else {
+			p.release()
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package wstunnel
+
+import (
+	"io"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakePool returns a pool of size tunnels over in-memory pipes, and the count of tunnels it dialed.
+func fakePool(t *testing.T, size int) (*tunnelPool, *int64) {
+	defer func(n int) { *poolSize = n }(*poolSize)
+	*poolSize = size
+	p := newTunnelPool(&websocketConfig{Location: &url.URL{Scheme: "ws", Host: "faythe.com"}})
+	t.Cleanup(func() {
+		poolsMu.Lock()
+		pools = pools[:len(pools)-1]
+		poolsMu.Unlock()
+	})
+	var dialed int64
+	p.dial = func(*websocketConfig) (*tunnel, error) {
+		a, b := net.Pipe()
+		t.Cleanup(func() { b.Close() })
+		atomic.AddInt64(&dialed, 1)
+		return &tunnel{conn: a}, nil
+	}
+	return p, &dialed
+}
+
+// waitPoolSize waits for p to hold want tunnels.
+func waitPoolSize(t *testing.T, p *tunnelPool, want int) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if size, _ := p.stats(); size == want {
+			return
+		}
+	}
+	size, _ := p.stats()
+	t.Fatalf("The pool holds %d tunnels, want %d", size, want)
+}
+
+func TestPoolShrinksUnderMemoryPressure(t *testing.T) {
+	defer atomic.StoreInt32(&memoryPressure, 0)
+	p, dialed := fakePool(t, 3)
+	p.start()
+	waitPoolSize(t, p, 3)
+	pooled := make([]pooledTunnel, 0, 3)
+	for len(pooled) < 3 {
+		pt := <-p.tunnels
+		pooled = append(pooled, pt)
+		p.tunnels <- pt
+	}
+
+	setMemoryPressure(true, 1)
+	if size, highWater := p.stats(); size != 0 || highWater != 3 {
+		t.Fatalf("After shrinking, the pool holds %d tunnels with a high-water mark of %d, want 0 and 3", size, highWater)
+	}
+	for _, pt := range pooled {
+		if _, err := pt.t.conn.Write([]byte{0}); err != io.ErrClosedPipe {
+			t.Errorf("Writing to a tunnel of the emptied pool returned %v, want it closed", err)
+		}
+	}
+	// Tunnels taken meanwhile aren't replaced.
+	if p.take() != nil {
+		t.Error("take() returned a tunnel from the emptied pool")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if size, _ := p.stats(); size != 0 || atomic.LoadInt64(dialed) != 3 {
+		t.Fatalf("Under memory pressure, the pool refilled to %d tunnels after %d dials, want 0 after 3", size, atomic.LoadInt64(dialed))
+	}
+
+	setMemoryPressure(false, 1)
+	waitPoolSize(t, p, 3)
+	if _, highWater := p.stats(); highWater != 3 {
+		t.Errorf("The high-water mark is %d, want 3", highWater)
+	}
+}
+
+// serverPool returns a pool of size tunnels to a server handling them with handle.
+func serverPool(t *testing.T, size int, handle func(conn *wsConn)) *tunnelPool {
+	server := httptest.NewServer(websocketHandler(handle))
+	t.Cleanup(server.Close)
+	defer func(n int) { *poolSize = n }(*poolSize)
+	*poolSize = size
+	config, err := getWsConfig(tunnelConfig{TargetHost: server.Listener.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		config.Pool.shrink()
+		poolsMu.Lock()
+		pools = pools[:len(pools)-1]
+		poolsMu.Unlock()
+	})
+	return config.Pool
+}
+
+func TestPoolKeepAlive(t *testing.T) {
+	defer func(ping, pong time.Duration) { *pingInterval, *pongTimeout = ping, pong }(*pingInterval, *pongTimeout)
+	*pingInterval, *pongTimeout = 20*time.Millisecond, 20*time.Millisecond
+	p := serverPool(t, 1, func(conn *wsConn) { io.Copy(conn, conn) })
+	p.start()
+	waitPoolSize(t, p, 1)
+
+	// Long enough for pings to go unanswered, if pooled tunnels were pinged.
+	time.Sleep(10 * (*pingInterval + *pongTimeout))
+	tunnel := p.take()
+	if tunnel == nil {
+		t.Fatal("take() returned no tunnel")
+	}
+	defer tunnel.data().Close()
+	b := make([]byte, 4)
+	read := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(tunnel.data(), b)
+		read <- err
+	}()
+	// Long enough for the tunnel to be pinged, now that it's read from.
+	time.Sleep(10 * (*pingInterval + *pongTimeout))
+	tunnel.data().Write([]byte("ping"))
+	if err := <-read; err != nil || string(b) != "ping" {
+		t.Errorf("Read %q, %v from the pooled tunnel, want it echoing", b, err)
+	}
+}
+
+func TestPoolSkipsClosedTunnels(t *testing.T) {
+	var handled int64
+	p := serverPool(t, 1, func(conn *wsConn) {
+		// The first tunnel is closed by the server while pooled.
+		if atomic.AddInt64(&handled, 1) > 1 {
+			io.Copy(conn, conn)
+		}
+	})
+	p.start()
+	waitPoolSize(t, p, 1)
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt64(&handled) == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("The server didn't handle the pooled tunnel")
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	if tunnel := p.take(); tunnel != nil {
+		tunnel.data().Close()
+		t.Fatal("take() returned a tunnel the server closed")
+	}
+	waitPoolSize(t, p, 1)
+	tunnel := p.take()
+	if tunnel == nil {
+		t.Fatal("take() returned no tunnel after the pool refilled")
+	}
+	defer tunnel.data().Close()
+	go tunnel.data().Write([]byte("ping"))
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(tunnel.data(), b); err != nil || string(b) != "ping" {
+		t.Errorf("Read %q, %v from the refilled tunnel, want it echoing", b, err)
+	}
+}
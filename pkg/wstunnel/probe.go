@@ -0,0 +1,68 @@
+package wstunnel
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"time"
+)
+
+var (
+	probeAddr  = clientFlags.String("probe_addr", "", "Instead of listening, measure round trips through the tunnel to the echo service at this host:port, and exit")
+	probeSize  = clientFlags.Int("probe_size", 1024, "Payload size of each probe round trip")
+	probeCount = clientFlags.Int("probe_count", 10, "Number of probe round trips")
+)
+
+// probe establishes a tunnel the same way handleConnection does, connects through it to the echo
+// service at addr, and prints round trip and throughput statistics of count payloads of size bytes.
+func probe(wsConfig *websocketConfig, addr string, size, count int) error {
+	if size <= 0 || count <= 0 {
+		return fmt.Errorf("Probe size and count must be positive, got %d and %d", size, count)
+	}
+
+	start := time.Now()
+	t, err := openTunnel(wsConfig)
+	if err != nil {
+		return err
+	}
+	defer t.data().Close()
+
+	if err := t.connect(wsConfig, addr); err != nil {
+		return err
+	}
+	conn := t.data()
+	setup := time.Since(start)
+
+	payload := make([]byte, size)
+	rand.Read(payload)
+	reply := make([]byte, size)
+
+	var total, min, max time.Duration
+	for i := 0; i < count; i++ {
+		t := time.Now()
+		if _, err := conn.Write(payload); err != nil {
+			return fmt.Errorf("Failed sending probe %d: %v", i, err)
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return fmt.Errorf("Failed reading probe %d: %v", i, err)
+		}
+		rtt := time.Since(t)
+		if !bytes.Equal(payload, reply) {
+			return fmt.Errorf("Echo of probe %d doesn't match what was sent", i)
+		}
+
+		total += rtt
+		if i == 0 || rtt < min {
+			min = rtt
+		}
+		if rtt > max {
+			max = rtt
+		}
+	}
+
+	throughput := float64(2*size*count) / total.Seconds() / 1024
+	fmt.Printf("setup=%v rtt_min=%v rtt_avg=%v rtt_max=%v throughput=%.1fKiB/s\n",
+		setup, min, total/time.Duration(count), max, throughput)
+	return nil
+}
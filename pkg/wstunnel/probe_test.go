@@ -0,0 +1,93 @@
+package wstunnel
+
+import (
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tcpEcho starts a server echoing what each connection sends.
+func tcpEcho(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// captureStdout returns what f prints to stdout.
+func captureStdout(t *testing.T, f func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	out := make(chan []byte)
+	go func() {
+		b, _ := io.ReadAll(r)
+		out <- b
+	}()
+	f()
+	w.Close()
+	return string(<-out)
+}
+
+func TestProbe(t *testing.T) {
+	client := startTunnel(t, ClientConfig{})
+	echo := tcpEcho(t)
+	var err error
+	line := captureStdout(t, func() { err = probe(client.wsConfigs[0], echo, 512, 5) })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats := map[string]string{}
+	for _, field := range strings.Fields(line) {
+		name, value, _ := strings.Cut(field, "=")
+		stats[name] = value
+	}
+	durations := map[string]time.Duration{}
+	for _, name := range []string{"setup", "rtt_min", "rtt_avg", "rtt_max"} {
+		d, err := time.ParseDuration(stats[name])
+		if err != nil || d <= 0 {
+			t.Fatalf("Probe printed %s=%q in %q, want a positive duration", name, stats[name], line)
+		}
+		durations[name] = d
+	}
+	if durations["rtt_min"] > durations["rtt_avg"] || durations["rtt_avg"] > durations["rtt_max"] {
+		t.Errorf("Probe printed %q, want rtt_min <= rtt_avg <= rtt_max", line)
+	}
+	if kib, err := strconv.ParseFloat(strings.TrimSuffix(stats["throughput"], "KiB/s"), 64); err != nil || kib <= 0 {
+		t.Errorf("Probe printed throughput=%q, want a positive rate", stats["throughput"])
+	}
+}
+
+func TestProbeErrors(t *testing.T) {
+	client := startTunnel(t, ClientConfig{})
+	if err := probe(client.wsConfigs[0], tcpEcho(t), 0, 5); err == nil {
+		t.Error("probe() accepted a size of 0")
+	}
+	// The target answers "pong!" rather than echoing.
+	if err := probe(client.wsConfigs[0], startTarget(t).Addr().String(), len("ping"), 1); err == nil {
+		t.Error("probe() succeeded against a target that doesn't echo")
+	}
+}
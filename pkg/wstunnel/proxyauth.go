@@ -0,0 +1,102 @@
+package wstunnel
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+var proxyAuth = clientFlags.String("proxy_auth", "basic", "How to authenticate to HTTP proxies: basic, ntlm or negotiate. "+
+	"With -proxy_user, ntlm and negotiate both authenticate with NTLMv2. Without, on Windows, they use the logged-on "+
+	"user's credentials, and negotiate Kerberos where possible.")
+
+// proxyAuthenticator produces the Proxy-Authorization headers of a CONNECT handshake,
+// which may take more than one round trip on the same connection.
+type proxyAuthenticator interface {
+	// scheme is the scheme of the Proxy-Authenticate challenges meant for the authenticator.
+	scheme() string
+	// authorize returns the Proxy-Authorization value to send next, given the token of the proxy's
+	// latest challenge, which is empty for the first request. An empty value means it has nothing more to try.
+	authorize(token []byte) (string, error)
+}
+
+// newProxyAuthenticator returns the authenticator for the proxy at proxyURL according to -proxy_auth,
+// or nil when there are no credentials to authenticate with.
+func newProxyAuthenticator(proxyURL *url.URL) (proxyAuthenticator, error) {
+	user, password, err := proxyCredentials(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	switch *proxyAuth {
+	case "basic":
+		if user == "" {
+			return nil, nil
+		}
+		return &basicAuthenticator{user: user, password: password}, nil
+	case "ntlm", "negotiate":
+		if user == "" {
+			return newSSPIAuthenticator(*proxyAuth, proxyURL.Hostname())
+		}
+		domain := ""
+		if i := strings.IndexByte(user, '\\'); i >= 0 {
+			domain, user = user[:i], user[i+1:]
+		}
+		scheme := "NTLM"
+		if *proxyAuth == "negotiate" {
+			scheme = "Negotiate"
+		}
+		return &ntlmAuthenticator{authScheme: scheme, domain: domain, user: user, password: password}, nil
+	}
+	return nil, fmt.Errorf("Unknown -proxy_auth %q, expected basic, ntlm or negotiate", *proxyAuth)
+}
+
+// proxyCredentials returns the user and password to authenticate to the proxy at proxyURL with, from its
+// userinfo or else from -proxy_user and -proxy_password, or an empty user for none.
+func proxyCredentials(proxyURL *url.URL) (user, password string, err error) {
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		return proxyURL.User.Username(), password, nil
+	}
+	if *proxyUser == "" {
+		return "", "", nil
+	}
+	password, err = proxyPassword.Get()
+	return *proxyUser, password, err
+}
+
+// challengeToken returns the token of the challenge for scheme among the Proxy-Authenticate values, and whether there was one.
+func challengeToken(challenges []string, scheme string) ([]byte, bool) {
+	for _, c := range challenges {
+		fields := strings.Fields(c)
+		if len(fields) == 0 || !strings.EqualFold(fields[0], scheme) {
+			continue
+		}
+		if len(fields) == 1 {
+			return nil, true
+		}
+		token, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			// Not a token, like the realm of a Basic challenge.
+			return nil, true
+		}
+		return token, true
+	}
+	return nil, false
+}
+
+// basicAuthenticator sends the credentials upfront, with nothing more to try if the proxy rejects them.
+type basicAuthenticator struct {
+	user, password string
+	sent           bool
+}
+
+func (a *basicAuthenticator) scheme() string { return "Basic" }
+
+func (a *basicAuthenticator) authorize(token []byte) (string, error) {
+	if a.sent {
+		return "", nil
+	}
+	a.sent = true
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(a.user+":"+a.password)), nil
+}
@@ -0,0 +1,241 @@
+package wstunnel
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	acceptProxyProtocol = clientFlags.Bool("accept_proxy_protocol", false, "Expect a PROXY protocol v1 or v2 header, as haproxy or "+
+		"a load balancer sends, on every connection to the listeners, and take the client address from it. -allow_cidr then "+
+		"applies to the proxies sending the headers.")
+	backendProxyProtocol = serverFlags.String("backend_proxy_protocol", "", "PROXY protocol version, v1 or v2, of a header to "+
+		"send on every connection to -backend with the address of the client the tunnel is for, e.g. for haproxy or nginx. "+
+		"Empty to send none.")
+	trustClientAddr = serverFlags.Bool("trust_client_addr", false, "Take the client address for -backend_proxy_protocol from "+
+		"every client, rather than only from those authenticated with a certificate, e.g. behind an ingress that authenticates them")
+)
+
+// clientAddrHeader carries the address of the connection a tunnel is for, as the client got it, in the handshake
+// request. Streams multiplexed on a tunnel don't have a handshake of their own, and so don't carry it.
+const clientAddrHeader = "X-Tunnel-Client-Addr"
+
+// proxyHeaderTimeout bounds the time a client may take to send its PROXY protocol header.
+const proxyHeaderTimeout = 5 * time.Second
+
+// proxyV2Signature starts PROXY protocol v2 headers.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtocolListener is a listener whose connections start with a PROXY protocol header.
+type proxyProtocolListener struct {
+	net.Listener
+}
+
+func (l proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtocolConn{Conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// proxyProtocolConn is a connection starting with a PROXY protocol header, read on first use,
+// whose remote address is the one in the header.
+type proxyProtocolConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	once   sync.Once
+	remote net.Addr // Nil if the header has no address, e.g. for health checks.
+	err    error
+}
+
+func (c *proxyProtocolConn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+		if c.remote, c.err = readProxyHeader(c.r); c.err != nil {
+			logWarn("Invalid PROXY protocol header", "remote", c.Conn.RemoteAddr(), "error", c.err)
+		}
+	})
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtocolConn) CloseWrite() error {
+	if hc, ok := c.Conn.(halfCloser); ok {
+		return hc.CloseWrite()
+	}
+	return nil
+}
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header from r, returning the source address in it.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	if sig, err := r.Peek(len(proxyV2Signature)); err == nil && bytes.Equal(sig, proxyV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+
+	// v1 headers are a line of at most 107 bytes.
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	fields := strings.Fields(strings.TrimSuffix(string(line), "\r\n"))
+	if !bytes.HasSuffix(line, []byte("\r\n")) || len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, errors.New("Not a PROXY protocol header")
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("Malformed PROXY protocol header: %q", line)
+		}
+		ip := net.ParseIP(fields[2])
+		port, err := strconv.ParseUint(fields[4], 10, 16)
+		if ip == nil || err != nil {
+			return nil, fmt.Errorf("Malformed PROXY protocol header: %q", line)
+		}
+		return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+	}
+	return nil, fmt.Errorf("Unknown PROXY protocol family: %s", fields[1])
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	h := make([]byte, 16)
+	if _, err := io.ReadFull(r, h); err != nil {
+		return nil, err
+	}
+	if h[12]>>4 != 2 {
+		return nil, fmt.Errorf("Unknown PROXY protocol version: %d", h[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(h[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	if h[12]&0xf == 0 {
+		// A LOCAL connection from the proxy itself, e.g. a health check.
+		return nil, nil
+	}
+
+	switch h[13] >> 4 {
+	case 1:
+		if len(body) < 12 {
+			return nil, errors.New("Truncated PROXY protocol header")
+		}
+		return &net.TCPAddr{IP: net.IP(body[:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+	case 2:
+		if len(body) < 36 {
+			return nil, errors.New("Truncated PROXY protocol header")
+		}
+		return &net.TCPAddr{IP: net.IP(body[:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+	}
+	// Unix sockets and unspecified families have no address worth taking.
+	return nil, nil
+}
+
+// writeProxyHeader writes a PROXY protocol header of -backend_proxy_protocol's version for a connection
+// from src to dst to w. Addresses that aren't TCP ones of the same family are sent as unknown.
+func writeProxyHeader(w io.Writer, src, dst net.Addr) error {
+	s, sok := src.(*net.TCPAddr)
+	d, dok := dst.(*net.TCPAddr)
+	ipv4 := sok && dok && s.IP.To4() != nil && d.IP.To4() != nil
+	known := ipv4 || sok && dok && s.IP.To4() == nil && d.IP.To4() == nil
+
+	if *backendProxyProtocol == "v1" {
+		var err error
+		switch {
+		case ipv4:
+			_, err = fmt.Fprintf(w, "PROXY TCP4 %s %s %d %d\r\n", s.IP.To4(), d.IP.To4(), s.Port, d.Port)
+		case known:
+			_, err = fmt.Fprintf(w, "PROXY TCP6 %s %s %d %d\r\n", s.IP, d.IP, s.Port, d.Port)
+		default:
+			_, err = io.WriteString(w, "PROXY UNKNOWN\r\n")
+		}
+		return err
+	}
+
+	var h bytes.Buffer
+	h.Write(proxyV2Signature)
+	var body []byte
+	switch {
+	case ipv4:
+		h.Write([]byte{0x21, 0x11})
+		body = append(append(body, s.IP.To4()...), d.IP.To4()...)
+	case known:
+		h.Write([]byte{0x21, 0x21})
+		body = append(append(body, s.IP.To16()...), d.IP.To16()...)
+	default:
+		h.Write([]byte{0x21, 0x00})
+	}
+	if known {
+		body = append(body, byte(s.Port>>8), byte(s.Port), byte(d.Port>>8), byte(d.Port))
+	}
+	binary.Write(&h, binary.BigEndian, uint16(len(body)))
+	h.Write(body)
+	_, err := w.Write(h.Bytes())
+	return err
+}
+
+// tunnelAddrs returns the addresses of the connection the tunnel of handshake request r is for: that of the
+// client's connection if a trusted client sent it, or else that of the tunnel, and the server's end of the tunnel.
+func tunnelAddrs(r *http.Request) (src, dst net.Addr) {
+	src = parseTCPAddr(r.RemoteAddr)
+	if addr := parseTCPAddr(r.Header.Get(clientAddrHeader)); addr != nil && trustedClient(r) {
+		src = addr
+	}
+	dst, _ = r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return src, dst
+}
+
+// trustedClient reports whether the client of handshake request r may tell the address of the connection its tunnel
+// is for: with -trust_client_addr, or if it presented a certificate the server verified. Anyone could claim any
+// address otherwise.
+func trustedClient(r *http.Request) bool {
+	return *trustClientAddr || r.TLS != nil && len(r.TLS.VerifiedChains) > 0
+}
+
+// parseTCPAddr returns the address of ip:port, or nil if it isn't one.
+func parseTCPAddr(hostport string) net.Addr {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	p, err := strconv.ParseUint(port, 10, 16)
+	if ip == nil || err != nil {
+		return nil
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}
+}
@@ -0,0 +1,142 @@
+package wstunnel
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteProxyHeaderV1(t *testing.T) {
+	defer func(v string) { *backendProxyProtocol = v }(*backendProxyProtocol)
+	*backendProxyProtocol = "v1"
+	for _, tc := range []struct {
+		src, dst net.Addr
+		want     string
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 51234}, &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 443},
+			"PROXY TCP4 192.0.2.1 192.0.2.2 51234 443\r\n"},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 51234}, &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443},
+			"PROXY TCP6 2001:db8::1 2001:db8::2 51234 443\r\n"},
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 51234}, &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443},
+			"PROXY UNKNOWN\r\n"},
+		{&net.UnixAddr{Name: "/run/wstunnel.sock", Net: "unix"}, nil, "PROXY UNKNOWN\r\n"},
+	} {
+		var b bytes.Buffer
+		if err := writeProxyHeader(&b, tc.src, tc.dst); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != tc.want {
+			t.Errorf("writeProxyHeader(%v, %v) = %q, want %q", tc.src, tc.dst, b.String(), tc.want)
+		}
+	}
+}
+
+func TestWriteProxyHeaderV2(t *testing.T) {
+	defer func(v string) { *backendProxyProtocol = v }(*backendProxyProtocol)
+	*backendProxyProtocol = "v2"
+	var b bytes.Buffer
+	src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 0x1234}
+	dst := &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 443}
+	if err := writeProxyHeader(&b, src, dst); err != nil {
+		t.Fatal(err)
+	}
+	want := append(append([]byte{}, proxyV2Signature...),
+		0x21, 0x11, 0, 12, 192, 0, 2, 1, 192, 0, 2, 2, 0x12, 0x34, 0x01, 0xbb)
+	if !bytes.Equal(b.Bytes(), want) {
+		t.Errorf("writeProxyHeader(%v, %v) = %x, want %x", src, dst, b.Bytes(), want)
+	}
+
+	b.Reset()
+	if err := writeProxyHeader(&b, &net.UnixAddr{Name: "/run/wstunnel.sock", Net: "unix"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	want = append(append([]byte{}, proxyV2Signature...), 0x21, 0x00, 0, 0)
+	if !bytes.Equal(b.Bytes(), want) {
+		t.Errorf("writeProxyHeader() of a Unix address = %x, want %x", b.Bytes(), want)
+	}
+}
+
+// TestProxyHeaderRoundTrip reads back the headers written, with the data following them.
+func TestProxyHeaderRoundTrip(t *testing.T) {
+	defer func(v string) { *backendProxyProtocol = v }(*backendProxyProtocol)
+	for _, version := range []string{"v1", "v2"} {
+		*backendProxyProtocol = version
+		for _, src := range []string{"192.0.2.1:51234", "[2001:db8::1]:51234"} {
+			srcAddr := parseTCPAddr(src)
+			dst := parseTCPAddr("192.0.2.2:443")
+			if strings.Contains(src, "[") {
+				dst = parseTCPAddr("[2001:db8::2]:443")
+			}
+			var b bytes.Buffer
+			if err := writeProxyHeader(&b, srcAddr, dst); err != nil {
+				t.Fatal(err)
+			}
+			b.WriteString("SSH-2.0-OpenSSH\r\n")
+
+			a, c := net.Pipe()
+			go func() {
+				a.Write(b.Bytes())
+				a.Close()
+			}()
+			conn := &proxyProtocolConn{Conn: c, r: bufio.NewReader(c)}
+			if got := conn.RemoteAddr().String(); got != src {
+				t.Errorf("%s: the address read back is %s, want %s", version, got, src)
+			}
+			rest, err := io.ReadAll(conn)
+			if err != nil || string(rest) != "SSH-2.0-OpenSSH\r\n" {
+				t.Errorf("%s: read %q, %v after the header", version, rest, err)
+			}
+		}
+	}
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	for _, header := range []string{"PROXY UNKNOWN\r\n", string(proxyV2Signature) + "\x20\x00\x00\x00"} {
+		if addr, err := readProxyHeader(bufio.NewReader(strings.NewReader(header))); addr != nil || err != nil {
+			t.Errorf("readProxyHeader(%q) = %v, %v, want no address", header, addr, err)
+		}
+	}
+	for _, header := range []string{
+		"GET / HTTP/1.1\r\n",
+		"PROXY TCP4 192.0.2.1 192.0.2.2 51234\r\n",
+		"PROXY TCP4 192.0.2.1 192.0.2.2 51234 443\n",
+		"PROXY TCP4 alice 192.0.2.2 51234 443\r\n",
+		"PROXY TCP4 192.0.2.1 192.0.2.2 70000 443\r\n",
+		"PROXY UDP4 192.0.2.1 192.0.2.2 51234 443\r\n",
+		"PROXY TCP4 " + strings.Repeat("1", 100) + "\r\n",
+		string(proxyV2Signature) + "\x11\x11\x00\x00",
+		string(proxyV2Signature) + "\x21\x11\x00\x04\xc0\x00\x02\x01",
+		string(proxyV2Signature) + "\x21\x11\x00\x0c\xc0\x00",
+	} {
+		if addr, err := readProxyHeader(bufio.NewReader(strings.NewReader(header))); err == nil {
+			t.Errorf("readProxyHeader(%q) = %v, want an error", header, addr)
+		}
+	}
+}
+
+func TestTunnelAddrs(t *testing.T) {
+	defer func(trust bool) { *trustClientAddr = trust }(*trustClientAddr)
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "198.51.100.1:40000"
+	r.Header.Set(clientAddrHeader, "192.0.2.1:51234")
+
+	*trustClientAddr = false
+	if src, _ := tunnelAddrs(r); src.String() != "198.51.100.1:40000" {
+		t.Errorf("The source address is %s from an unauthenticated client, want that of the tunnel", src)
+	}
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{}}}}
+	if src, _ := tunnelAddrs(r); src.String() != "192.0.2.1:51234" {
+		t.Errorf("The source address is %s from a client with a certificate, want the one it sent", src)
+	}
+	r.TLS = nil
+	*trustClientAddr = true
+	if src, _ := tunnelAddrs(r); src.String() != "192.0.2.1:51234" {
+		t.Errorf("The source address is %s with -trust_client_addr, want the one the client sent", src)
+	}
+}
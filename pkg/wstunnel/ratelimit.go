@@ -0,0 +1,144 @@
+package wstunnel
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	rateLimit = clientFlags.Int("rate_limit", 0, "Maximum throughput of each tunneled connection in bytes per second, "+
+		"in each direction, or 0 for no limit. A -config file setting rate_limit overrides it, see README.md.")
+	rateLimitTotal = clientFlags.Int("rate_limit_total", 0, "Maximum throughput of all tunneled connections together in bytes "+
+		"per second, in each direction, or 0 for no limit. A -config file setting rate_limit_total overrides it.")
+)
+
+var (
+	// connRateLimit and totalRateLimit are the limits in force, in bytes per second or 0 for none. Accessed atomically.
+	connRateLimit, totalRateLimit int64
+	// totalToServer and totalToClient enforce totalRateLimit.
+	totalToServer, totalToClient = newTokenBucket(&totalRateLimit), newTokenBucket(&totalRateLimit)
+)
+
+// rateLimits are the rate limits a -config file may set, nil for those left to the flags.
+type rateLimits struct {
+	RateLimit      *int `yaml:"rate_limit"`
+	RateLimitTotal *int `yaml:"rate_limit_total"`
+}
+
+// loadRateLimits returns the rate limits of -config file, or the flags' for those it doesn't set.
+func loadRateLimits(file string) (conn, total int, err error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return 0, 0, err
+	}
+	var config struct {
+		Tunnels    []tunnelConfig `yaml:"tunnels"`
+		rateLimits `yaml:",inline"`
+	}
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return 0, 0, fmt.Errorf("Failed parsing %s: %v", file, err)
+	}
+	limits := config.rateLimits
+	conn, total = *rateLimit, *rateLimitTotal
+	if limits.RateLimit != nil {
+		conn = *limits.RateLimit
+	}
+	if limits.RateLimitTotal != nil {
+		total = *limits.RateLimitTotal
+	}
+	if conn < 0 || total < 0 {
+		return 0, 0, fmt.Errorf("Invalid rate limit in %s: rate_limit=%d rate_limit_total=%d", file, conn, total)
+	}
+	return conn, total, nil
+}
+
+// setRateLimits has the rate limits apply to new and open connections alike.
+func setRateLimits(conn, total int) {
+	oldConn := atomic.SwapInt64(&connRateLimit, int64(conn))
+	oldTotal := atomic.SwapInt64(&totalRateLimit, int64(total))
+	if oldConn != int64(conn) || oldTotal != int64(total) {
+		logInfo("Rate limits set", "rate_limit", conn, "rate_limit_total", total)
+	}
+}
+
+// watchRateLimits reloads the rate limits of the -config file on SIGHUP, leaving the tunnels it defines as they are.
+func watchRateLimits() {
+	if *configFile == "" {
+		return
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			conn, total, err := loadRateLimits(*configFile)
+			if err != nil {
+				logError("Failed reloading rate limits, keeping the previous ones", "file", *configFile, "error", err)
+				continue
+			}
+			setRateLimits(conn, total)
+		}
+	}()
+}
+
+// tokenBucket limits throughput to the rate limit holds in bytes per second, allowing bursts of up to a second's
+// worth. Writes larger than what's available go into debt, which later ones wait out. The rate is read on every
+// write, so that changing it applies to the writes in progress, and none are limited while it's 0.
+type tokenBucket struct {
+	limit *int64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a tokenBucket for the rate limit holds.
+func newTokenBucket(limit *int64) *tokenBucket {
+	return &tokenBucket{limit: limit}
+}
+
+// wait takes n bytes' worth of tokens, waiting for the bucket to be out of debt.
+func (b *tokenBucket) wait(n int) {
+	rate := float64(atomic.LoadInt64(b.limit))
+	if rate <= 0 {
+		return
+	}
+	b.mu.Lock()
+	now := time.Now()
+	if b.last.IsZero() {
+		b.tokens = rate
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+	}
+	if b.tokens > rate {
+		b.tokens = rate
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	d := time.Duration(-b.tokens / rate * float64(time.Second))
+	b.mu.Unlock()
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// limitedWriter paces the writes to Writer by buckets.
+type limitedWriter struct {
+	io.Writer
+	buckets []*tokenBucket
+}
+
+func (w limitedWriter) Write(p []byte) (int, error) {
+	for _, b := range w.buckets {
+		b.wait(len(p))
+	}
+	return w.Writer.Write(p)
+}
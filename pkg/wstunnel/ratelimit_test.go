@@ -0,0 +1,78 @@
+package wstunnel
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLoadRateLimits(t *testing.T) {
+	defer func(n int) { *rateLimitTotal = n }(*rateLimitTotal)
+	*rateLimitTotal = 5000
+	file := writeFile(t, "tunnels.yaml", "rate_limit: 1000\ntunnels:\n  - name: faythe\n    listen: 127.0.0.1:8081\n    target_host: faythe.com:443\n")
+	if _, err := loadTunnels(file); err != nil {
+		t.Fatalf("loadTunnels() = %v with rate limits set", err)
+	}
+	conn, total, err := loadRateLimits(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn != 1000 || total != 5000 {
+		t.Errorf("loadRateLimits() = %d, %d, want 1000 from the file and 5000 from the flag", conn, total)
+	}
+
+	for _, config := range []string{"rate_limit: -1\n", "rate_limt: 1000\n"} {
+		if _, _, err := loadRateLimits(writeFile(t, "tunnels.yaml", config)); err == nil {
+			t.Errorf("loadRateLimits() accepted %q", config)
+		}
+	}
+}
+
+// countingSink counts the bytes written to it.
+type countingSink struct{ n *int64 }
+
+func (s countingSink) Write(p []byte) (int, error) {
+	atomic.AddInt64(s.n, int64(len(p)))
+	return len(p), nil
+}
+
+func TestRateLimitLoweredMidTransfer(t *testing.T) {
+	defer setRateLimits(0, 0)
+	setRateLimits(1<<20, 0)
+	var received, sent int64
+	w := limitedWriter{countingSink{&received}, []*tokenBucket{newTokenBucket(&connRateLimit), totalToServer}}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		chunk := make([]byte, 1000)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			n, _ := w.Write(chunk)
+			atomic.AddInt64(&sent, int64(n))
+		}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	setRateLimits(10000, 0)
+	before := atomic.LoadInt64(&received)
+	time.Sleep(time.Second)
+	during := atomic.LoadInt64(&received) - before
+	close(stop)
+	<-done
+
+	// A second's worth at the new rate, plus the burst the bucket allows and the write in progress.
+	if during > 10000+10000+1000 {
+		t.Errorf("%d bytes went through in the second after lowering the rate limit to 10000 bytes/s", during)
+	}
+	if during < 5000 {
+		t.Errorf("Only %d bytes went through in the second after lowering the rate limit to 10000 bytes/s", during)
+	}
+	if received != sent {
+		t.Errorf("%d bytes were received of the %d sent", received, sent)
+	}
+}
@@ -0,0 +1,124 @@
+package wstunnel
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var resolverURL = sharedFlags.String("resolver", "", "Nameserver to resolve host names with, as udp://host:port, tcp://host:port "+
+	"or https://host/dns-query for DNS over HTTPS, or empty for the system resolver. The client resolves the server "+
+	"(and proxy) with it, the server the targets clients ask for by name.")
+
+// getResolver returns the resolver configured with -resolver, or nil for the system resolver.
+func getResolver() (*net.Resolver, error) {
+	if *resolverURL == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(*resolverURL)
+	if err != nil {
+		return nil, fmt.Errorf("Failed parsing -resolver: %v", err)
+	}
+
+	var dial func(ctx context.Context, network, address string) (net.Conn, error)
+	switch u.Scheme {
+	case "udp", "tcp":
+		if _, _, err := net.SplitHostPort(u.Host); err != nil {
+			return nil, fmt.Errorf("Failed parsing -resolver: %v", err)
+		}
+		var d net.Dialer
+		dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+			return d.DialContext(ctx, u.Scheme, u.Host)
+		}
+	case "https":
+		dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+			return &dohConn{ctx: ctx, url: u.String()}, nil
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported -resolver scheme: %s", u.Scheme)
+	}
+
+	// PreferGo is required for Dial to be used.
+	return &net.Resolver{PreferGo: true, Dial: dial}, nil
+}
+
+// dohConn carries DNS queries of the Go resolver over HTTPS (RFC 8484). Not being a net.PacketConn,
+// the resolver uses it as a stream: messages are prefixed with their 2 byte length, like over TCP.
+type dohConn struct {
+	ctx      context.Context
+	url      string
+	deadline time.Time
+
+	query bytes.Buffer
+	reply bytes.Buffer
+}
+
+func (c *dohConn) Write(b []byte) (int, error) {
+	c.query.Write(b)
+	for c.query.Len() >= 2 {
+		n := int(binary.BigEndian.Uint16(c.query.Bytes()))
+		if c.query.Len() < 2+n {
+			break
+		}
+		c.query.Next(2)
+		if err := c.roundTrip(c.query.Next(n)); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+func (c *dohConn) roundTrip(msg []byte) error {
+	ctx := c.ctx
+	if !c.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, c.deadline)
+		defer cancel()
+	}
+
+	req, err := http.NewRequest("POST", c.url, bytes.NewReader(msg))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("DNS over HTTPS query failed: %s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 65535))
+	if err != nil {
+		return err
+	}
+
+	binary.Write(&c.reply, binary.BigEndian, uint16(len(body)))
+	c.reply.Write(body)
+	return nil
+}
+
+func (c *dohConn) Read(b []byte) (int, error) {
+	if c.reply.Len() == 0 {
+		return 0, io.EOF
+	}
+	return c.reply.Read(b)
+}
+
+func (c *dohConn) Close() error                       { return nil }
+func (c *dohConn) LocalAddr() net.Addr                { return nil }
+func (c *dohConn) RemoteAddr() net.Addr               { return nil }
+func (c *dohConn) SetDeadline(t time.Time) error      { c.deadline = t; return nil }
+func (c *dohConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *dohConn) SetWriteDeadline(t time.Time) error { c.deadline = t; return nil }
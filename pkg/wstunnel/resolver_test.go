@@ -0,0 +1,129 @@
+package wstunnel
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// stubAnswer answers a DNS query with 127.0.0.1 for the A records of names under .test, and nothing else.
+func stubAnswer(query []byte) []byte {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		return nil
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: h.ID, Response: true, Authoritative: true})
+	b.StartQuestions()
+	b.Question(q)
+	b.StartAnswers()
+	if q.Type == dnsmessage.TypeA && strings.HasSuffix(q.Name.String(), ".test.") {
+		b.AResource(dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60},
+			dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}})
+	}
+	msg, _ := b.Finish()
+	return msg
+}
+
+// stubDNS starts a nameserver answering with stubAnswer over UDP, and returns its -resolver URL.
+func stubDNS(t *testing.T) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(stubAnswer(buf[:n]), addr)
+		}
+	}()
+	return "udp://" + pc.LocalAddr().String()
+}
+
+// stubDoH starts a DNS over HTTPS server answering with stubAnswer, and returns its -resolver URL.
+// http.DefaultClient, which queries it, trusts it until the test ends.
+func stubDoH(t *testing.T) string {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(stubAnswer(query))
+	}))
+	t.Cleanup(server.Close)
+	client := http.DefaultClient
+	t.Cleanup(func() { http.DefaultClient = client })
+	http.DefaultClient = server.Client()
+	return server.URL + "/dns-query"
+}
+
+// useResolver sets -resolver to url, and the resolver of the client and server to it, until the test ends.
+func useResolver(t *testing.T, url string) {
+	func(u string, r *net.Resolver) { t.Cleanup(func() { *resolverURL, resolver = u, r }) }(*resolverURL, resolver)
+	*resolverURL = url
+	var err error
+	if resolver, err = getResolver(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResolver(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		url  func(t *testing.T) string
+	}{
+		{"udp", stubDNS},
+		{"https", stubDoH},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			useResolver(t, tt.url(t))
+			addrs, err := resolver.LookupHost(t.Context(), "faythe.test")
+			if err != nil || len(addrs) != 1 || addrs[0] != "127.0.0.1" {
+				t.Errorf("LookupHost(faythe.test) = %v, %v, want the stub's 127.0.0.1", addrs, err)
+			}
+		})
+	}
+}
+
+func TestResolverTunnel(t *testing.T) {
+	useResolver(t, stubDNS(t))
+	target := startTarget(t)
+	_, port, _ := net.SplitHostPort(target.Addr().String())
+
+	// The client resolves the server's name, and the server the target's, with the stub.
+	server, err := NewServer(ServerConfig{ListenAddr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Start(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	_, serverPort, _ := net.SplitHostPort(server.Addr().String())
+	client := startTunnel(t, ClientConfig{ServerURL: "ws://server.test:" + serverPort + "/"})
+	if _, answer, err := pingThrough(t, client, "target.test:"+port); err != nil || answer != "pong!" {
+		t.Errorf("Ping through server.test to target.test = %q, %v, want pong!", answer, err)
+	}
+}
+
+func TestResolverInvalid(t *testing.T) {
+	defer func(u string) { *resolverURL = u }(*resolverURL)
+	for _, u := range []string{"dns://127.0.0.1:53", "udp://127.0.0.1", "udp://%zz"} {
+		*resolverURL = u
+		if _, err := getResolver(); err == nil {
+			t.Errorf("getResolver() accepted -resolver=%s", u)
+		}
+	}
+}
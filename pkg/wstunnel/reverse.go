@@ -0,0 +1,9 @@
+package wstunnel
+
+const (
+	// reverseListenHeader carries the address the server is to listen on for a reverse forward in the handshake
+	// request of its control tunnel. The server sends an ID on it for every connection it accepts there.
+	reverseListenHeader = "X-Tunnel-Reverse-Listen"
+	// reverseAcceptHeader carries such an ID in the handshake request of the tunnel the connection is to go through.
+	reverseAcceptHeader = "X-Tunnel-Reverse-Accept"
+)
@@ -0,0 +1,67 @@
+package wstunnel
+
+import (
+	"net"
+	"time"
+)
+
+var reverseForwards = forwardsFlag("R", false, "Reverse port forward as [bind_address:]port:host:hostport, like SSH's, "+
+	"where the server listens on bind_address, 127.0.0.1 by default, and connections to it are forwarded to host:hostport "+
+	"from here. The server must allow this with -allow_reverse. Can be repeated, and -L's notes apply.")
+
+// serveReverse has the server listen on remote, and forwards the connections accepted there to target,
+// reestablishing the control tunnel whenever it's lost.
+func serveReverse(wsConfig *websocketConfig, remote, target string) {
+	var b backoff
+	for {
+		err := runReverse(wsConfig, remote, target, &b)
+		d, ok := b.next()
+		if !ok {
+			logError("Giving up on reverse forward", "remote", remote, "target", target, "attempts", *reconnectMaxRetries, "error", err)
+			return
+		}
+		logWarn("Lost reverse forward, retrying", "remote", remote, "target", target, "delay", d, "attempt", b.attempts, "error", err)
+		time.Sleep(d)
+	}
+}
+
+// runReverse runs the control tunnel of a reverse forward until it's lost, resetting b once it's established.
+func runReverse(wsConfig *websocketConfig, remote, target string, b *backoff) error {
+	t, err := dialTunnel(withHeader(wsConfig, reverseListenHeader, remote))
+	if err != nil {
+		return err
+	}
+	defer t.ws.Close()
+	b.reset()
+	logInfo("Forwarding connections on the server to the target", "remote", remote, "target", target)
+
+	for {
+		id, err := t.ws.readMessage()
+		if err != nil {
+			return err
+		}
+		go acceptReverse(wsConfig, string(id), target)
+	}
+}
+
+// acceptReverse connects the connection the server accepted with id to target.
+func acceptReverse(wsConfig *websocketConfig, id, target string) {
+	t, err := dialTunnel(withHeader(wsConfig, reverseAcceptHeader, id))
+	if err != nil {
+		logError("Failed connecting to the server for a reverse forward", "target", target, "error", err)
+		return
+	}
+	defer t.ws.Close()
+
+	conn, err := net.Dial("tcp", target)
+	if err != nil {
+		logError("Failed connecting to the reverse forward target", "target", target, "error", err)
+		return
+	}
+	defer conn.Close()
+
+	c := make(chan error, 2)
+	go iocopy(conn, t.ws, c)
+	go iocopy(t.ws, conn, c)
+	<-c
+}
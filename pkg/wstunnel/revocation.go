@@ -0,0 +1,131 @@
+package wstunnel
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+var revocationCheck = clientFlags.String("revocation_check", "off", "Check the server's certificate for revocation, with the "+
+	"OCSP response the server staples or else the certificate's CRLs: off, soft to only reject certificates known to be "+
+	"revoked, or hard to also reject those whose status can't be established. Applies to certificates verified against a CA.")
+
+var revocationModes = map[string]bool{"off": true, "soft": true, "hard": true}
+
+// crlTimeout bounds the time fetching a CRL may take.
+const crlTimeout = 10 * time.Second
+
+// maxCRLSize bounds the size of the CRLs fetched.
+const maxCRLSize = 16 << 20
+
+var errRevoked = errors.New("certificate revoked")
+
+// checkRevocation returns an error if the server's certificate of a completed handshake was revoked, or with
+// -revocation_check=hard, if that can't be established.
+func checkRevocation(state tls.ConnectionState) error {
+	if *revocationCheck == "off" || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) < 2 {
+		return nil
+	}
+	leaf, issuer := state.VerifiedChains[0][0], state.VerifiedChains[0][1]
+	err := revocationStatus(leaf, issuer, state.OCSPResponse)
+	switch {
+	case err == errRevoked:
+		return fmt.Errorf("Server certificate %s was revoked", leaf.SerialNumber)
+	case err != nil && *revocationCheck == "hard":
+		return fmt.Errorf("Failed checking the server certificate for revocation: %v", err)
+	case err != nil:
+		logWarn("Failed checking the server certificate for revocation, accepting it", "subject", leaf.Subject, "error", err)
+	}
+	return nil
+}
+
+// revocationStatus returns errRevoked if leaf was revoked according to staple, its stapled OCSP response,
+// or without one its CRLs, nil if it wasn't, or another error if that can't be established.
+func revocationStatus(leaf, issuer *x509.Certificate, staple []byte) error {
+	if len(staple) > 0 {
+		resp, err := ocsp.ParseResponseForCert(staple, leaf, issuer)
+		if err != nil {
+			return fmt.Errorf("Invalid OCSP staple: %v", err)
+		}
+		if !resp.NextUpdate.IsZero() && time.Now().After(resp.NextUpdate) {
+			return fmt.Errorf("OCSP staple expired at %v", resp.NextUpdate)
+		}
+		switch resp.Status {
+		case ocsp.Good:
+			return nil
+		case ocsp.Revoked:
+			return errRevoked
+		}
+		return errors.New("OCSP staple has an unknown status")
+	}
+
+	if len(leaf.CRLDistributionPoints) == 0 {
+		return errors.New("No OCSP staple, and the certificate has no CRL distribution point")
+	}
+	var err error
+	for _, url := range leaf.CRLDistributionPoints {
+		var crl *pkix.CertificateList
+		if crl, err = fetchCRL(url, issuer); err != nil {
+			continue
+		}
+		for _, revoked := range crl.TBSCertList.RevokedCertificates {
+			if revoked.SerialNumber.Cmp(leaf.SerialNumber) == 0 {
+				return errRevoked
+			}
+		}
+		return nil
+	}
+	return err
+}
+
+var (
+	crlMu    sync.Mutex
+	crlCache = map[string]*pkix.CertificateList{}
+)
+
+// fetchCRL returns the CRL issuer publishes at url, from the cache until it's due to be updated.
+func fetchCRL(url string, issuer *x509.Certificate) (*pkix.CertificateList, error) {
+	crlMu.Lock()
+	crl, ok := crlCache[url]
+	crlMu.Unlock()
+	if ok && !crl.HasExpired(time.Now()) && issuer.CheckCRLSignature(crl) == nil {
+		return crl, nil
+	}
+
+	client := http.Client{Timeout: crlTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("Failed fetching CRL: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed fetching CRL from %s: %s", url, resp.Status)
+	}
+	der, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxCRLSize))
+	if err != nil {
+		return nil, fmt.Errorf("Failed fetching CRL from %s: %v", url, err)
+	}
+	if crl, err = x509.ParseCRL(der); err != nil {
+		return nil, fmt.Errorf("Invalid CRL from %s: %v", url, err)
+	}
+	if err := issuer.CheckCRLSignature(crl); err != nil {
+		return nil, fmt.Errorf("CRL from %s isn't signed by the issuer: %v", url, err)
+	}
+	if crl.HasExpired(time.Now()) {
+		return nil, fmt.Errorf("CRL from %s expired at %v", url, crl.TBSCertList.NextUpdate)
+	}
+
+	crlMu.Lock()
+	crlCache[url] = crl
+	crlMu.Unlock()
+	return crl, nil
+}
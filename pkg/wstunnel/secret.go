@@ -0,0 +1,41 @@
+package wstunnel
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// secret is a flag value that can be given inline with -name, or be kept out of the process list by
+// reading it from a file with -name_file or, like any flag, from the WSTUNNEL_NAME environment variable.
+// The file takes precedence over the inline value.
+type secret struct {
+	name  string
+	value *string
+	file  *string
+}
+
+// env returns the name of the environment variable of the secret.
+func (s *secret) env() string {
+	return envPrefix + strings.ToUpper(s.name)
+}
+
+// secretFlag defines the -name and -name_file flags of a secret.
+func secretFlag(name, usage string) *secret {
+	s := &secret{name: name, value: clientFlags.String(name, "", usage)}
+	s.file = clientFlags.String(name+"_file", "", fmt.Sprintf("File to read -%s from, taking precedence over it. "+
+		"Without either, it's read from $%s.", name, s.env()))
+	return s
+}
+
+// Get returns the value of the secret. Its file is read on every call, so that it can be rotated.
+func (s *secret) Get() (string, error) {
+	if *s.file == "" {
+		return *s.value, nil
+	}
+	b, err := ioutil.ReadFile(*s.file)
+	if err != nil {
+		return "", fmt.Errorf("Failed reading -%s_file: %v", s.name, err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
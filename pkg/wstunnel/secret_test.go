@@ -0,0 +1,34 @@
+package wstunnel
+
+import (
+	"os"
+	"testing"
+)
+
+func TestSecretFile(t *testing.T) {
+	defer func(value, file string) { *authToken.value, *authToken.file = value, file }(*authToken.value, *authToken.file)
+	*authToken.value, *authToken.file = "inline", ""
+	if got, err := authorization(); got != "Bearer inline" || err != nil {
+		t.Errorf("authorization() = %q, %v with -auth_token, want Bearer inline", got, err)
+	}
+
+	*authToken.file = writeFile(t, "token", "s3cret\n")
+	if got, err := authorization(); got != "Bearer s3cret" || err != nil {
+		t.Errorf("authorization() = %q, %v with -auth_token_file too, want the file's token", got, err)
+	}
+
+	// The file is read again for every handshake, so that the token can be rotated.
+	if err := os.WriteFile(*authToken.file, []byte("rotated"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := authorization(); got != "Bearer rotated" || err != nil {
+		t.Errorf("authorization() = %q, %v after rotating -auth_token_file, want the new token", got, err)
+	}
+
+	if err := os.Remove(*authToken.file); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := authorization(); err == nil {
+		t.Errorf("authorization() = %q with -auth_token_file missing, want an error rather than -auth_token", got)
+	}
+}
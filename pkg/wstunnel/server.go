@@ -0,0 +1,663 @@
+package wstunnel
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	socks5 "github.com/armon/go-socks5"
+	"github.com/hashicorp/yamux"
+)
+
+var (
+	serverCertsDir = serverFlags.String("certs_dir", "", "Directory of certs for starting a wss:// server, or empty for ws:// server. "+
+		"Expected files are: cacert.pem, cert.pem and key.pem, or ca.crt, tls.crt and tls.key, optionally with the key in the cert file.")
+	httpPort        = serverFlags.Int("http_port", 80, "The port to listen to for http responses")
+	httpsPort       = serverFlags.Int("https_port", 443, "The port to listen to for https responses")
+	blockedNetmasks = serverFlags.String("blocked_netmasks", "", "List (comma separated) of netmasks that would not be served")
+
+	targetAllowlist = serverFlags.String("target_allowlist", "", "List (comma separated) of targets that may be served, or empty to "+
+		"serve any target that isn't blocked. Entries are IPs, netmasks, host names, or domain suffixes such as .example.com")
+
+	serverUDPIdleTimeout = serverFlags.Duration("udp_idle_timeout", time.Minute, "Time after which a UDP tunnel is closed when no datagrams went either way, "+
+		"or 0 to keep tunnels open")
+
+	allowReverse = serverFlags.Bool("allow_reverse", false, "Let clients have the server listen on the addresses they ask for, and "+
+		"forward the connections accepted there back to them, see the client's -R")
+
+	backend = serverFlags.String("backend", "", `host:port, unix:/path for a Unix socket, or \\.\pipe\name for a Windows named pipe, `+
+		"to forward every tunnel to as is, instead of serving the SOCKS5 requests sent through it. "+
+		"-blocked_netmasks and -target_allowlist apply to it as to SOCKS5 targets, unless it's a Unix socket or named pipe.")
+)
+
+var (
+	// serverActiveTunnels is the number of tunnels currently carrying a connection.
+	serverActiveTunnels int64
+	// shuttingDown is set once the server stops taking new connections.
+	shuttingDown int32
+)
+
+// track counts a tunnel as active until the returned func is called.
+func track() func() {
+	atomic.AddInt64(&serverActiveTunnels, 1)
+	return func() { atomic.AddInt64(&serverActiveTunnels, -1) }
+}
+
+// targetResolver resolves the targets clients ask for by name with -resolver.
+type targetResolver struct {
+	*net.Resolver
+}
+
+func (r targetResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	ips, err := r.LookupIP(ctx, "ip", name)
+	if err != nil {
+		return ctx, nil, err
+	}
+	return ctx, ips[0], nil
+}
+
+type RuleSet struct {
+	blocked []*net.IPNet
+	allowed []targetPattern
+}
+
+// targetPattern matches a target by its IP or by the host name the client asked for.
+type targetPattern struct {
+	ipnet  *net.IPNet
+	host   string
+	suffix string
+}
+
+func parseTargetPattern(p string) (targetPattern, error) {
+	switch {
+	case strings.Contains(p, "/"):
+		_, ipnet, err := net.ParseCIDR(p)
+		if err != nil {
+			return targetPattern{}, err
+		}
+		return targetPattern{ipnet: ipnet}, nil
+	case net.ParseIP(p) != nil:
+		ip := net.ParseIP(p)
+		bits := 8 * len(ip)
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		return targetPattern{ipnet: &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}}, nil
+	case strings.HasPrefix(p, "*."):
+		return targetPattern{suffix: strings.ToLower(p[1:])}, nil
+	case strings.HasPrefix(p, "."):
+		return targetPattern{suffix: strings.ToLower(p)}, nil
+	case p != "":
+		return targetPattern{host: strings.ToLower(p)}, nil
+	}
+	return targetPattern{}, fmt.Errorf("empty pattern")
+}
+
+func (p targetPattern) match(addr *socks5.AddrSpec) bool {
+	fqdn := strings.ToLower(strings.TrimSuffix(addr.FQDN, "."))
+	switch {
+	case p.ipnet != nil:
+		return addr.IP != nil && p.ipnet.Contains(addr.IP)
+	case p.suffix != "":
+		return strings.HasSuffix(fqdn, p.suffix)
+	}
+	return fqdn != "" && fqdn == p.host
+}
+
+func newRuleSet() *RuleSet {
+	rs := &RuleSet{}
+	if *blockedNetmasks != "" {
+		for _, nm := range strings.Split(*blockedNetmasks, ",") {
+			_, ipnet, err := net.ParseCIDR(nm)
+			if err != nil || ipnet == nil {
+				panic(fmt.Sprintf("Couldn't parse netmask: %v: %s", err, nm))
+			}
+			rs.blocked = append(rs.blocked, ipnet)
+		}
+	}
+
+	if *targetAllowlist != "" {
+		for _, p := range strings.Split(*targetAllowlist, ",") {
+			pattern, err := parseTargetPattern(strings.TrimSpace(p))
+			if err != nil {
+				panic(fmt.Sprintf("Couldn't parse target pattern: %v: %s", err, p))
+			}
+			rs.allowed = append(rs.allowed, pattern)
+		}
+	}
+
+	return rs
+}
+
+func (rs *RuleSet) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	for _, ipnet := range rs.blocked {
+		if ipnet.Contains(req.DestAddr.IP) {
+			return ctx, false
+		}
+	}
+
+	if len(rs.allowed) == 0 {
+		return ctx, true
+	}
+	for _, pattern := range rs.allowed {
+		if pattern.match(req.DestAddr) {
+			return ctx, true
+		}
+	}
+	logWarn("Rejecting target not in -target_allowlist", "target", req.DestAddr)
+	return ctx, false
+}
+
+// allowTarget returns an error unless rules allow the tunnels to connect to target, a host:port on network
+// "tcp" or "udp", as they do the targets of SOCKS5 requests.
+func allowTarget(rules socks5.RuleSet, network, target string) error {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return err
+	}
+	ip, err := net.ResolveIPAddr("ip", host)
+	if err != nil {
+		return fmt.Errorf("Failed resolving %s: %v", host, err)
+	}
+	dest := &socks5.AddrSpec{IP: ip.IP}
+	if dest.Port, err = net.LookupPort(network, port); err != nil {
+		return err
+	}
+	if net.ParseIP(host) == nil {
+		dest.FQDN = host
+	}
+	if _, ok := rules.Allow(context.Background(), &socks5.Request{DestAddr: dest}); !ok {
+		return fmt.Errorf("%s isn't allowed by -blocked_netmasks and -target_allowlist", target)
+	}
+	return nil
+}
+
+func getServerTlsConfig() (*tls.Config, error) {
+	tlscfg := &tls.Config{
+		ClientAuth:               tls.RequireAndVerifyClientCert,
+		CurvePreferences:         []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.CurveP256},
+		MinVersion:               tls.VersionTLS12,
+		PreferServerCipherSuites: true,
+		CipherSuites: []uint16{
+			tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+		},
+	}
+	if *http2Server {
+		tlscfg.NextProtos = []string{"h2", "http/1.1"}
+	}
+	store, err := newCertStore(*serverCertsDir, false)
+	if err != nil {
+		return nil, err
+	}
+	return store.serverConfig(tlscfg), nil
+}
+
+// forward pipes conn to a new connection to -backend, until either side is done.
+func (s *Server) forward(conn *wsConn) {
+	b, err := dialBackend(conn.Request(), s.rules)
+	if err != nil {
+		logError("Failed connecting to -backend", "remote", conn.Request().RemoteAddr, "error", err)
+		return
+	}
+	defer b.Close()
+	if err := splice(conn, b); err != nil {
+		logError("Failed tunneling data", "remote", conn.Request().RemoteAddr, "error", err)
+	}
+}
+
+// serveStream serves a stream multiplexed on a tunnel, as if it was a tunnel of its own.
+func (s *Server) serveStream(stream net.Conn, r *http.Request) {
+	defer track()()
+	defer stream.Close()
+	if *backend == "" {
+		s.socks.ServeConn(stream)
+		return
+	}
+	b, err := dialBackend(r, s.rules)
+	if err != nil {
+		logError("Failed connecting to -backend", "error", err)
+		return
+	}
+	defer b.Close()
+	splice(stream, b)
+}
+
+// dialBackend connects to -backend for the tunnel of handshake request r, if rules allow it as a target,
+// sending a PROXY protocol header with -backend_proxy_protocol.
+func dialBackend(r *http.Request, rules socks5.RuleSet) (net.Conn, error) {
+	network, addr := splitNetwork(*backend)
+	if network == "tcp" {
+		if err := allowTarget(rules, network, addr); err != nil {
+			return nil, err
+		}
+	}
+	var conn net.Conn
+	var err error
+	if network == "pipe" {
+		conn, err = dialPipe(addr)
+	} else {
+		conn, err = net.Dial(network, addr)
+	}
+	if err != nil || *backendProxyProtocol == "" {
+		return conn, err
+	}
+	src, dst := tunnelAddrs(r)
+	if err := writeProxyHeader(conn, src, dst); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Failed sending PROXY protocol header: %v", err)
+	}
+	return conn, nil
+}
+
+type halfCloser interface {
+	CloseWrite() error
+}
+
+var errHalfClosed = errors.New("half-closed")
+
+// splice pipes a and b to each other, until either side is done. A side done sending is only half-closed,
+// with the other one still piped until it's done too, if the connection it's sent to supports it, as TCP
+// and Unix connections do.
+func splice(a, b io.ReadWriter) error {
+	c := make(chan error, 2)
+	pipe := func(dst, src io.ReadWriter) {
+		_, err := copyData(dst, src)
+		if hc, ok := dst.(halfCloser); ok && err == nil && hc.CloseWrite() == nil {
+			err = errHalfClosed
+		}
+		c <- err
+	}
+	go pipe(b, a)
+	go pipe(a, b)
+	err := <-c
+	if err == errHalfClosed {
+		if err = <-c; err == errHalfClosed {
+			err = nil
+		}
+	}
+	return err
+}
+
+// reverseAcceptTimeout bounds the time a connection accepted for a reverse forward waits for the client's tunnel.
+const reverseAcceptTimeout = 30 * time.Second
+
+// reverseConn is a connection accepted for a reverse forward, waiting for the client's tunnel.
+type reverseConn struct {
+	tunnel chan *wsConn
+	done   chan struct{} // Closed once the tunnel is no longer used.
+}
+
+var (
+	reverseMu    sync.Mutex
+	reverseConns = map[string]*reverseConn{}
+)
+
+// listenReverse listens on addr for the client of the control tunnel, until it's closed.
+func listenReverse(control *wsConn, addr string) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		logError("Failed listening for reverse forward", "remote", control.Request().RemoteAddr, "listen", addr, "error", err)
+		return
+	}
+	defer ln.Close()
+	logInfo("Forwarding connections back to the client", "listen", ln.Addr(), "remote", control.Request().RemoteAddr)
+
+	go func() {
+		// The client doesn't send anything on the control tunnel, receiving only notices it's closed.
+		for {
+			if _, err := control.readMessage(); err != nil {
+				break
+			}
+		}
+		ln.Close()
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		if atomic.LoadInt32(&shuttingDown) != 0 {
+			conn.Close()
+			continue
+		}
+		go forwardReverse(control, conn)
+	}
+}
+
+// forwardReverse has the client of the control tunnel open a tunnel for conn, and pipes conn through it.
+func forwardReverse(control *wsConn, conn net.Conn) {
+	defer conn.Close()
+
+	b := make([]byte, 16)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+	rc := &reverseConn{tunnel: make(chan *wsConn, 1), done: make(chan struct{})}
+	defer close(rc.done)
+	reverseMu.Lock()
+	reverseConns[id] = rc
+	reverseMu.Unlock()
+	defer func() {
+		reverseMu.Lock()
+		delete(reverseConns, id)
+		reverseMu.Unlock()
+	}()
+
+	if err := control.writeMessage([]byte(id)); err != nil {
+		return
+	}
+	select {
+	case ws := <-rc.tunnel:
+		splice(ws, conn)
+	case <-time.After(reverseAcceptTimeout):
+		logWarn("Closing connection: the client didn't open a tunnel for it", "remote", conn.RemoteAddr())
+	}
+}
+
+// acceptReverseTunnel hands the tunnel ws over to the connection waiting for it with id.
+func acceptReverseTunnel(ws *wsConn, id string) {
+	reverseMu.Lock()
+	rc := reverseConns[id]
+	delete(reverseConns, id)
+	reverseMu.Unlock()
+	if rc == nil {
+		logWarn("Rejecting tunnel for unknown reverse connection", "id", id)
+		return
+	}
+	defer track()()
+	rc.tunnel <- ws
+	<-rc.done
+}
+
+// relayUDP relays datagrams between conn, one per message, and target, until conn is closed or no datagrams
+// went either way for -udp_idle_timeout.
+func relayUDP(conn *wsConn, target string, rules socks5.RuleSet) {
+	if err := allowTarget(rules, "udp", target); err != nil {
+		logWarn("Rejecting UDP target", "target", target, "error", err)
+		return
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", target)
+	if err != nil {
+		logError("Failed resolving UDP target", "target", target, "error", err)
+		return
+	}
+	u, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		logError("Failed connecting to UDP target", "target", target, "error", err)
+		return
+	}
+	defer u.Close()
+
+	idle := *serverUDPIdleTimeout
+	var lastActive int64
+	touch := func() { atomic.StoreInt64(&lastActive, time.Now().UnixNano()) }
+	touch()
+	go func() {
+		defer conn.Close()
+		buf := make([]byte, maxDatagram)
+		for {
+			if idle > 0 {
+				u.SetReadDeadline(time.Now().Add(idle))
+			}
+			n, err := u.Read(buf)
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				if time.Since(time.Unix(0, atomic.LoadInt64(&lastActive))) < idle {
+					continue
+				}
+				return
+			}
+			if err != nil {
+				return
+			}
+			touch()
+			if err := conn.writeMessage(buf[:n]); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		datagram, err := conn.readMessage()
+		if err != nil {
+			return
+		}
+		touch()
+		if _, err := u.Write(datagram); err != nil {
+			logWarn("Failed sending datagram to UDP target", "target", target, "error", err)
+		}
+	}
+}
+
+func startServers(httpServer, httpsServer *http.Server) error {
+	// Sockets passed by systemd take the place of the listeners, in order.
+	ln, err := listenServer(httpServer)
+	if err != nil {
+		return err
+	}
+	var tlsLn net.Listener
+	if httpsServer != nil {
+		if tlsLn, err = listenServer(httpsServer); err != nil {
+			return err
+		}
+		if len(sniRoutes) > 0 {
+			tlsLn = newSNIListener(tlsLn)
+		}
+	}
+	warnUnusedActivatedSockets()
+
+	c := make(chan error)
+	go func() { c <- httpServer.Serve(ln) }()
+	if httpsServer != nil {
+		go func() { c <- httpsServer.ServeTLS(tlsLn, "", "") }()
+	}
+	return <-c
+}
+
+// listenServer returns a listener for s, on the next socket passed by systemd if there's any left.
+func listenServer(s *http.Server) (net.Listener, error) {
+	if f := takeActivatedSocket(); f != nil {
+		return activatedListener(f)
+	}
+	return net.Listen("tcp", s.Addr)
+}
+
+func setDebugHandlers(mux *http.ServeMux) *http.ServeMux {
+	mux.HandleFunc("/generate_204", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(204) })
+	mux.HandleFunc("/success", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("success\n")) })
+	return mux
+}
+
+// NewFlagServer returns the Server of the server command, configured by its flags, which ParseServerFlags
+// parsed. It panics if they are invalid.
+func NewFlagServer() *Server {
+	loadActivatedSockets()
+	if err := setupLogging(); err != nil {
+		panic(err)
+	}
+	if *compressLevel < 1 || *compressLevel > 9 {
+		panic(fmt.Sprintf("-compress_level out of range: %d", *compressLevel))
+	}
+	if *compressMinSize < 0 {
+		panic(fmt.Sprintf("-compress_min_size out of range: %d", *compressMinSize))
+	}
+	if *bufferSize < 1 {
+		panic(fmt.Sprintf("-buffer_size out of range: %d", *bufferSize))
+	}
+	if *serverUDPIdleTimeout < 0 {
+		panic(fmt.Sprintf("-udp_idle_timeout out of range: %v", *serverUDPIdleTimeout))
+	}
+	if *backendProxyProtocol != "" && *backendProxyProtocol != "v1" && *backendProxyProtocol != "v2" {
+		panic(fmt.Sprintf("Unknown -backend_proxy_protocol: %s", *backendProxyProtocol))
+	}
+	if *http2Server && *serverCertsDir == "" {
+		panic("-http2 requires TLS, set -certs_dir")
+	}
+	if *webtransportServer && *serverCertsDir == "" {
+		panic("-webtransport requires TLS, set -certs_dir")
+	}
+
+	httpsAddr := ""
+	if *serverCertsDir != "" {
+		httpsAddr = fmt.Sprintf(":%d", *httpsPort)
+	} else if len(sniRoutes) > 0 {
+		panic("-sni_route requires -certs_dir")
+	}
+	if err := checkListenAddrs(
+		listenEndpoint{"-http_port", "tcp", fmt.Sprintf(":%d", *httpPort)},
+		listenEndpoint{"-https_port", "tcp", httpsAddr},
+	); err != nil {
+		panic(err)
+	}
+
+	var err error
+	if resolver, err = getResolver(); err != nil {
+		panic(err)
+	}
+	s, err := newServer(newRuleSet())
+	if err != nil {
+		panic(err)
+	}
+
+	httpMux := setDebugHandlers(http.NewServeMux())
+	httpServer := &http.Server{Addr: fmt.Sprintf(":%d", *httpPort), Handler: httpMux}
+	mainMux := httpMux
+
+	var httpsServer *http.Server
+	if *serverCertsDir != "" {
+		httpsMux := setDebugHandlers(http.NewServeMux())
+		mainMux = httpsMux
+		httpsServer = &http.Server{
+			Addr: fmt.Sprintf(":%d", *httpsPort), Handler: httpsMux,
+			// The next line disables the HTTP/2 of net/http, as it does not support websockets. See -http2.
+			TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
+		}
+		if httpsServer.TLSConfig, err = getServerTlsConfig(); err != nil {
+			panic(err)
+		}
+		if *http2Server {
+			serveHTTP2(httpsServer)
+		}
+	}
+
+	mainMux.Handle("/", websocketHandler(s.serveTunnel))
+	s.httpServer, s.httpsServer = httpServer, httpsServer
+	return s
+}
+
+// Run runs the server as the server command does: it serves until signaled to shut down, then lets the
+// tunnels still active drain.
+func (s *Server) Run() {
+	httpServer, httpsServer := s.httpServer, s.httpsServer
+	closeWebTransport := func() {}
+	if *webtransportServer {
+		tlscfg, err := getServerTlsConfig()
+		if err != nil {
+			panic(err)
+		}
+		if closeWebTransport, err = serveWebTransport(httpsServer.Addr, tlscfg, s); err != nil {
+			panic(err)
+		}
+	}
+
+	watchCertStores()
+	errs := make(chan error, 1)
+	go func() { errs <- startServers(httpServer, httpsServer) }()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-errs:
+		panic(err)
+	case sg := <-sig:
+		logInfo("Shutting down", "signal", sg)
+	}
+	cont := predrain(sig)
+	atomic.StoreInt32(&shuttingDown, 1)
+	// Tunnels are hijacked connections, which Shutdown leaves to drain.
+	httpServer.Shutdown(context.Background())
+	if httpsServer != nil && *http2Server {
+		// HTTP/2 connections stay active as long as the tunnels on them, and are closed once these drained.
+		go httpsServer.Shutdown(context.Background())
+	} else if httpsServer != nil {
+		httpsServer.Shutdown(context.Background())
+	}
+	if cont {
+		drain(&serverActiveTunnels, sig)
+	}
+	closeWebTransport()
+}
+
+// serveTunnel serves the tunnel of conn: a reverse forward, a multiplexed session, a UDP relay, the
+// connection to -backend, or SOCKS5.
+func (s *Server) serveTunnel(conn *wsConn) {
+	if !s.track(conn) {
+		return
+	}
+	defer s.untrack(conn)
+
+	header := conn.Request().Header
+	if listen, id := header.Get(reverseListenHeader), header.Get(reverseAcceptHeader); listen != "" || id != "" {
+		switch {
+		case !*allowReverse:
+			logWarn("Rejecting reverse forward without -allow_reverse", "remote", conn.Request().RemoteAddr)
+		case listen != "":
+			listenReverse(conn, listen)
+		default:
+			acceptReverseTunnel(conn, id)
+		}
+		return
+	}
+
+	if header.Get(muxHeader) == "yamux" {
+		session, err := yamux.Server(conn, nil)
+		if err != nil {
+			logError("Failed starting multiplexed session", "remote", conn.Request().RemoteAddr, "error", err)
+			return
+		}
+		defer session.Close()
+		for {
+			stream, err := session.AcceptStream()
+			if err != nil {
+				return
+			}
+			if atomic.LoadInt32(&shuttingDown) != 0 {
+				stream.Close()
+				continue
+			}
+			go s.serveStream(stream, conn.Request())
+		}
+	}
+
+	defer track()()
+
+	switch target := header.Get(udpTargetHeader); {
+	case *backend != "" && target != "":
+		logWarn("Rejecting UDP target, only -backend is served", "target", target)
+	case *backend != "":
+		s.forward(conn)
+	case target != "":
+		relayUDP(conn, target, s.rules)
+	default:
+		s.socks.ServeConn(conn)
+	}
+}
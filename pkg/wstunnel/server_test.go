@@ -0,0 +1,142 @@
+package wstunnel
+
+import (
+	"io"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// udpEcho returns the address of a UDP server echoing every datagram back.
+func udpEcho(t *testing.T) string {
+	u, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { u.Close() })
+	go func() {
+		buf := make([]byte, maxDatagram)
+		for {
+			n, addr, err := u.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			u.WriteTo(buf[:n], addr)
+		}
+	}()
+	return u.LocalAddr().String()
+}
+
+// udpTunnel returns a tunnel to target relayed by relayUDP as rules allow, and a channel closed once relayUDP returns.
+func udpTunnel(t *testing.T, target string, rules *RuleSet) (*wsConn, chan struct{}) {
+	done := make(chan struct{})
+	server := httptest.NewServer(websocketHandler(func(conn *wsConn) {
+		defer close(done)
+		relayUDP(conn, target, rules)
+	}))
+	t.Cleanup(server.Close)
+	config, err := getWsConfig(tunnelConfig{TargetHost: server.Listener.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunnel, err := dialTunnel(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		tunnel.ws.Close()
+		<-done
+	})
+	return tunnel.ws, done
+}
+
+func TestRelayUDPIdleTimeout(t *testing.T) {
+	defaultIdle := *serverUDPIdleTimeout
+	// Restored once the relays are done, after their cleanups.
+	t.Cleanup(func() { *serverUDPIdleTimeout = defaultIdle })
+	for _, idle := range []time.Duration{50 * time.Millisecond, 0} {
+		*serverUDPIdleTimeout = idle
+		ws, done := udpTunnel(t, udpEcho(t), &RuleSet{})
+		if err := ws.writeMessage([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		if b, err := ws.readMessage(); err != nil || string(b) != "ping" {
+			t.Fatalf("readMessage() = %q, %v, want the datagram echoed", b, err)
+		}
+
+		time.Sleep(200 * time.Millisecond)
+		ws.writeMessage([]byte("ping"))
+		b, err := ws.readMessage()
+		if idle > 0 && err == nil {
+			t.Errorf("The tunnel was still open after %v idle with -udp_idle_timeout=%v", 200*time.Millisecond, idle)
+		}
+		if idle > 0 {
+			<-done
+		}
+		if idle == 0 && (err != nil || string(b) != "ping") {
+			t.Errorf("readMessage() = %q, %v with -udp_idle_timeout=0, want the tunnel kept open", b, err)
+		}
+	}
+}
+
+// allowlist returns the rules of -target_allowlist set to patterns.
+func allowlist(patterns string) *RuleSet {
+	defer func(a string) { *targetAllowlist = a }(*targetAllowlist)
+	*targetAllowlist = patterns
+	return newRuleSet()
+}
+
+func TestTargetAllowlist(t *testing.T) {
+	defaultBackend := *backend
+	// Restored once the servers are closed, after their cleanups.
+	t.Cleanup(func() { *backend = defaultBackend })
+	target := startTarget(t)
+	for _, tt := range []struct {
+		patterns string
+		allowed  bool
+	}{
+		{"127.0.0.1", true},
+		{"10.0.0.0/8, 127.0.0.0/8", true},
+		{"localhost", false}, // Targets asked for by IP only match IPs and netmasks.
+		{"10.0.0.1,.example.com", false},
+	} {
+		rules := allowlist(tt.patterns)
+
+		*backend = ""
+		client := startTunnelTo(t, ServerConfig{Rules: rules}, ClientConfig{})
+		_, answer, err := pingThrough(t, client, target.Addr().String())
+		if allowed := err == nil && answer == "pong!"; allowed != tt.allowed {
+			t.Errorf("SOCKS5 target allowed = %v (%q, %v) with -target_allowlist=%s, want %v", allowed, answer, err, tt.patterns, tt.allowed)
+		}
+
+		*backend = target.Addr().String()
+		client = startTunnelTo(t, ServerConfig{Rules: rules}, ClientConfig{})
+		answer, err = pingDirect(client)
+		if allowed := err == nil && answer == "pong!"; allowed != tt.allowed {
+			t.Errorf("-backend allowed = %v (%q, %v) with -target_allowlist=%s, want %v", allowed, answer, err, tt.patterns, tt.allowed)
+		}
+
+		ws, _ := udpTunnel(t, udpEcho(t), rules)
+		ws.writeMessage([]byte("ping"))
+		b, err := ws.readMessage()
+		if allowed := err == nil && string(b) == "ping"; allowed != tt.allowed {
+			t.Errorf("UDP target allowed = %v (%q, %v) with -target_allowlist=%s, want %v", allowed, b, err, tt.patterns, tt.allowed)
+		}
+	}
+}
+
+// pingDirect sends a ping to the listener of client, tunneling it as is, and returns the answer.
+func pingDirect(client *Client) (string, error) {
+	conn, err := net.Dial("tcp", client.Addr().String())
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		return "", err
+	}
+	answer := make([]byte, len("pong!"))
+	_, err = io.ReadFull(conn, answer)
+	return string(answer), err
+}
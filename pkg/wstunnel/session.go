@@ -0,0 +1,63 @@
+package wstunnel
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+var sessionLogFile = clientFlags.String("session_log", "", "File to append a newline delimited JSON record to for every connection "+
+	"once it closed, with its client, duration, bytes each way and why it closed, for usage accounting. Empty to disable.")
+
+// sessionRecord is the record of a closed connection appended to the -session_log.
+type sessionRecord struct {
+	Time          time.Time     `json:"time"`
+	Type          string        `json:"type"` // Always "session_closed".
+	Tunnel        string        `json:"tunnel"`
+	Client        string        `json:"client"`
+	Server        string        `json:"server"`
+	Target        string        `json:"target,omitempty"` // The forward target, for -L and forward tunnels.
+	Start         time.Time     `json:"start"`
+	Duration      time.Duration `json:"duration_ns"`
+	BytesToServer int64         `json:"bytes_to_server"`
+	BytesToClient int64         `json:"bytes_to_client"`
+	Cause         string        `json:"cause"`
+}
+
+// sessionLog appends session records to a file. A nil *sessionLog discards them.
+type sessionLog struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// sessions is the -session_log, nil if disabled.
+var sessions *sessionLog
+
+func openSessionLog(path string) (*sessionLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Failed opening -session_log: %v", err)
+	}
+	return &sessionLog{f: f}, nil
+}
+
+func (l *sessionLog) record(r sessionRecord) {
+	if l == nil {
+		return
+	}
+	r.Time, r.Type = time.Now(), "session_closed"
+	line, err := json.Marshal(r)
+	if err != nil {
+		logError("Failed encoding session record", "error", err)
+		return
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.f.Write(line); err != nil {
+		logError("Failed writing -session_log", "error", err)
+	}
+}
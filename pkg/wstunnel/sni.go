@@ -0,0 +1,161 @@
+package wstunnel
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sniRouteFlags map the TLS server names clients ask for to the backends their connections are passed to.
+type sniRouteFlags map[string]string
+
+func (r sniRouteFlags) String() string {
+	var s []string
+	for name, backend := range r {
+		s = append(s, name+"="+backend)
+	}
+	sort.Strings(s)
+	return strings.Join(s, ",")
+}
+
+func (r sniRouteFlags) Set(v string) error {
+	i := strings.Index(v, "=")
+	if i <= 0 {
+		return fmt.Errorf("SNI route %q isn't hostname=host:port", v)
+	}
+	if _, _, err := net.SplitHostPort(v[i+1:]); err != nil {
+		return fmt.Errorf("SNI route %q: %v", v, err)
+	}
+	r[strings.ToLower(v[:i])] = v[i+1:]
+	return nil
+}
+
+var sniRoutes = sniRouteFlags{}
+
+func init() {
+	serverFlags.Var(sniRoutes, "sni_route", "Route as hostname=host:port, passing the TLS connections to -https_port asking "+
+		"for hostname as is to host:port, so that other services can share the port. Connections asking for other names "+
+		"are served as usual. Can be repeated, and requires -certs_dir.")
+}
+
+// sniTimeout bounds the time a client may take to send its TLS ClientHello.
+const sniTimeout = 10 * time.Second
+
+var errHelloRead = errors.New("ClientHello read")
+
+// sniListener is a net.Listener passing the connections that ask for a -sni_route server name to its backend,
+// and returning the others from Accept.
+type sniListener struct {
+	net.Listener
+	conns chan net.Conn
+	errs  chan error
+
+	once sync.Once
+	done chan struct{}
+}
+
+func newSNIListener(ln net.Listener) *sniListener {
+	l := &sniListener{Listener: ln, conns: make(chan net.Conn), errs: make(chan error), done: make(chan struct{})}
+	go l.serve()
+	return l
+}
+
+func (l *sniListener) serve() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errs <- err:
+			case <-l.done:
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		go l.route(conn)
+	}
+}
+
+func (l *sniListener) route(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(sniTimeout))
+	name, hello := readServerName(conn)
+	conn.SetReadDeadline(time.Time{})
+
+	if backend, ok := sniRoutes[strings.ToLower(name)]; ok {
+		defer track()()
+		defer conn.Close()
+		b, err := net.Dial("tcp", backend)
+		if err != nil {
+			logError("Failed connecting to -sni_route backend", "remote", conn.RemoteAddr(), "server_name", name, "error", err)
+			return
+		}
+		defer b.Close()
+		// Passing the ClientHello on first, so that the rest can go from connection to connection as is, spliced.
+		if _, err := b.Write(hello); err != nil {
+			return
+		}
+		splice(conn, b)
+		return
+	}
+
+	conn = helloConn{conn, io.MultiReader(bytes.NewReader(hello), conn)}
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *sniListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, errors.New("use of closed network connection")
+	}
+}
+
+func (l *sniListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// readServerName reads the TLS ClientHello from conn, returning the server name it asks for, if any,
+// and the bytes read.
+func readServerName(conn net.Conn) (string, []byte) {
+	var hello bytes.Buffer
+	var name string
+	tls.Server(readOnlyConn{helloConn{conn, io.TeeReader(conn, &hello)}}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			name = info.ServerName
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	return name, hello.Bytes()
+}
+
+// helloConn is conn read through r, for reading it ahead.
+type helloConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c helloConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+// readOnlyConn keeps the tls.Server reading the ClientHello from answering it.
+type readOnlyConn struct {
+	helloConn
+}
+
+func (readOnlyConn) Write(b []byte) (int, error) { return 0, io.ErrClosedPipe }
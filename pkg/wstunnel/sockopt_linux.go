@@ -0,0 +1,59 @@
+package wstunnel
+
+import "syscall"
+
+const (
+	optTCPFastOpen        = 0x17 // TCP_FASTOPEN
+	optTCPFastOpenConnect = 0x1e // TCP_FASTOPEN_CONNECT
+	fastOpenQueueLen      = 256  // Pending Fast Open requests a listener accepts.
+)
+
+// setFastOpen enables TCP Fast Open on c, a listening socket if listen is true, or one to connect otherwise.
+func setFastOpen(c syscall.RawConn, listen bool) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		if listen {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, optTCPFastOpen, fastOpenQueueLen)
+		} else {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, optTCPFastOpenConnect, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// setMark sets the firewall mark of c.
+func setMark(c syscall.RawConn, mark uint32) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, int(mark))
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// setBufferSize sets the send buffer of c if send is true, or its receive buffer otherwise, to size bytes.
+// It returns the size the kernel settled on, which may be clamped by net.core.{w,r}mem_max.
+func setBufferSize(c syscall.RawConn, send bool, size int) (int, error) {
+	opt := syscall.SO_RCVBUF
+	if send {
+		opt = syscall.SO_SNDBUF
+	}
+	var got int
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		if serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, opt, size); serr != nil {
+			return
+		}
+		got, serr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, opt)
+	})
+	if err != nil {
+		return 0, err
+	}
+	// Linux doubles the requested size to make room for its bookkeeping, and reports it doubled.
+	return got / 2, serr
+}
@@ -0,0 +1,166 @@
+package wstunnel
+
+import (
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// dialLoopback connects to a loopback listener with the dialer of outgoing connections.
+func dialLoopback(t *testing.T) net.Conn {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := getDialer().Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// sockopt returns the value of socket option opt at level of conn.
+func sockopt(t *testing.T, conn syscall.Conn, level, opt int) int {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	var serr error
+	if err := raw.Control(func(fd uintptr) { v, serr = syscall.GetsockoptInt(int(fd), level, opt) }); err != nil {
+		t.Fatal(err)
+	}
+	if serr != nil {
+		t.Fatal(serr)
+	}
+	return v
+}
+
+func TestTCPKeepalive(t *testing.T) {
+	defer func(idle, interval time.Duration, count int) {
+		*tcpKeepaliveIdle, *tcpKeepaliveInterval, *tcpKeepaliveCount = idle, interval, count
+	}(*tcpKeepaliveIdle, *tcpKeepaliveInterval, *tcpKeepaliveCount)
+	*tcpKeepaliveIdle, *tcpKeepaliveInterval, *tcpKeepaliveCount = 7*time.Second, 3*time.Second, 4
+
+	conn := dialLoopback(t).(*net.TCPConn)
+	for _, tt := range []struct {
+		name       string
+		level, opt int
+		want       int
+	}{
+		{"SO_KEEPALIVE", syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 1},
+		{"TCP_KEEPIDLE", syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE, 7},
+		{"TCP_KEEPINTVL", syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, 3},
+		{"TCP_KEEPCNT", syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, 4},
+	} {
+		if got := sockopt(t, conn, tt.level, tt.opt); got != tt.want {
+			t.Errorf("%s = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	// Only the flags set change the system's defaults.
+	*tcpKeepaliveIdle, *tcpKeepaliveInterval, *tcpKeepaliveCount = 0, 0, 0
+	conn = dialLoopback(t).(*net.TCPConn)
+	defaultCount := sockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT)
+	*tcpKeepaliveIdle = 9 * time.Second
+	conn = dialLoopback(t).(*net.TCPConn)
+	if got := sockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE); got != 9 {
+		t.Errorf("TCP_KEEPIDLE = %d with only -tcp_keepalive_idle set, want 9", got)
+	}
+	if got := sockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT); got != defaultCount {
+		t.Errorf("TCP_KEEPCNT = %d with only -tcp_keepalive_idle set, want the default %d", got, defaultCount)
+	}
+}
+
+func TestTCPFastOpen(t *testing.T) {
+	defer func(listen, connect bool) { *tcpFastOpen, *tcpFastOpenConnect = listen, connect }(*tcpFastOpen, *tcpFastOpenConnect)
+	*tcpFastOpen, *tcpFastOpenConnect = true, true
+
+	lc := net.ListenConfig{Control: controlListen}
+	ln, err := lc.Listen(t.Context(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if got := sockopt(t, ln.(*net.TCPListener), syscall.IPPROTO_TCP, optTCPFastOpen); got != fastOpenQueueLen {
+		t.Errorf("TCP_FASTOPEN of the listener = %d with -tcp_fastopen, want %d", got, fastOpenQueueLen)
+	}
+	if got := sockopt(t, dialLoopback(t).(*net.TCPConn), syscall.IPPROTO_TCP, optTCPFastOpenConnect); got != 1 {
+		t.Errorf("TCP_FASTOPEN_CONNECT of an outgoing connection = %d with -tcp_fastopen_connect, want 1", got)
+	}
+
+	*tcpFastOpenConnect = false
+	if got := sockopt(t, dialLoopback(t).(*net.TCPConn), syscall.IPPROTO_TCP, optTCPFastOpenConnect); got != 0 {
+		t.Errorf("TCP_FASTOPEN_CONNECT of an outgoing connection = %d without -tcp_fastopen_connect, want 0", got)
+	}
+}
+
+func TestFwmark(t *testing.T) {
+	defer func(mark uint) { *fwmark = mark }(*fwmark)
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_MARK, 1)
+	syscall.Close(fd)
+	if err == syscall.EPERM {
+		t.Skip("Setting SO_MARK requires CAP_NET_ADMIN")
+	}
+
+	*fwmark = 42
+	if got := sockopt(t, dialLoopback(t).(*net.TCPConn), syscall.SOL_SOCKET, syscall.SO_MARK); got != 42 {
+		t.Errorf("SO_MARK = %d with -fwmark=42, want 42", got)
+	}
+}
+
+func TestBufferSizes(t *testing.T) {
+	defer func(snd, rcv int, inbound bool) { *sndbuf, *rcvbuf, *bufInbound = snd, rcv, inbound }(*sndbuf, *rcvbuf, *bufInbound)
+	*sndbuf, *rcvbuf, *bufInbound = 64<<10, 32<<10, true
+
+	// Linux reports the sizes doubled, for its bookkeeping.
+	conn := dialLoopback(t).(*net.TCPConn)
+	if got := sockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_SNDBUF); got != 2*64<<10 {
+		t.Errorf("SO_SNDBUF of an outgoing connection = %d with -sndbuf=%d, want %d", got, *sndbuf, 2**sndbuf)
+	}
+	if got := sockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_RCVBUF); got != 2*32<<10 {
+		t.Errorf("SO_RCVBUF of an outgoing connection = %d with -rcvbuf=%d, want %d", got, *rcvbuf, 2**rcvbuf)
+	}
+
+	lc := net.ListenConfig{Control: controlListen}
+	ln, err := lc.Listen(t.Context(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		if conn, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+			defer conn.Close()
+			io.Copy(io.Discard, conn)
+		}
+	}()
+	accepted, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer accepted.Close()
+	if got := sockopt(t, accepted.(*net.TCPConn), syscall.SOL_SOCKET, syscall.SO_RCVBUF); got != 2*32<<10 {
+		t.Errorf("SO_RCVBUF of an accepted connection = %d with -buf_inbound, want %d", got, 2**rcvbuf)
+	}
+}
+
+func TestBufferSizeClamped(t *testing.T) {
+	defer func(snd int) { *sndbuf = snd }(*sndbuf)
+	*sndbuf = 1 << 30
+	bufferClamped = sync.Once{}
+
+	line := captureLog("logfmt", func() { dialLoopback(t) })
+	if !strings.Contains(line, "level=warn") || !strings.Contains(line, "flag=-sndbuf requested=1073741824") {
+		t.Errorf("Logged %q for a -sndbuf above net.core.wmem_max, want a warning with the size granted", line)
+	}
+}
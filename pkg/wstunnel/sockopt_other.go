@@ -0,0 +1,38 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package wstunnel
+
+import (
+	"errors"
+	"syscall"
+)
+
+func setFastOpen(c syscall.RawConn, listen bool) error {
+	return errors.New("TCP Fast Open is not supported on this platform")
+}
+
+func setMark(c syscall.RawConn, mark uint32) error {
+	return errors.New("Firewall marks are not supported on this platform")
+}
+
+// setBufferSize sets the send buffer of c if send is true, or its receive buffer otherwise, to size bytes.
+// It returns the size the kernel settled on.
+func setBufferSize(c syscall.RawConn, send bool, size int) (int, error) {
+	opt := syscall.SO_RCVBUF
+	if send {
+		opt = syscall.SO_SNDBUF
+	}
+	var got int
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		if serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, opt, size); serr != nil {
+			return
+		}
+		got, serr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, opt)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return got, serr
+}
@@ -0,0 +1,31 @@
+package wstunnel
+
+import (
+	"errors"
+	"syscall"
+)
+
+func setFastOpen(c syscall.RawConn, listen bool) error {
+	return errors.New("TCP Fast Open is not supported on this platform")
+}
+
+func setMark(c syscall.RawConn, mark uint32) error {
+	return errors.New("Firewall marks are not supported on this platform")
+}
+
+// setBufferSize sets the send buffer of c if send is true, or its receive buffer otherwise, to size bytes.
+// Windows grants any size, so it returns size.
+func setBufferSize(c syscall.RawConn, send bool, size int) (int, error) {
+	opt := syscall.SO_RCVBUF
+	if send {
+		opt = syscall.SO_SNDBUF
+	}
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, opt, size)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return size, serr
+}
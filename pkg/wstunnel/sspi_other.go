@@ -0,0 +1,10 @@
+//go:build !windows
+// +build !windows
+
+package wstunnel
+
+import "fmt"
+
+func newSSPIAuthenticator(pkg, host string) (proxyAuthenticator, error) {
+	return nil, fmt.Errorf("-proxy_auth=%s needs -proxy_user on this platform, only Windows can use the logged-on user's credentials", pkg)
+}
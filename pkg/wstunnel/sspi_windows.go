@@ -0,0 +1,123 @@
+package wstunnel
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	secur32                        = syscall.NewLazyDLL("secur32.dll")
+	procAcquireCredentialsHandleW  = secur32.NewProc("AcquireCredentialsHandleW")
+	procInitializeSecurityContextW = secur32.NewProc("InitializeSecurityContextW")
+	procCompleteAuthToken          = secur32.NewProc("CompleteAuthToken")
+	procFreeContextBuffer          = secur32.NewProc("FreeContextBuffer")
+	procDeleteSecurityContext      = secur32.NewProc("DeleteSecurityContext")
+	procFreeCredentialsHandle      = secur32.NewProc("FreeCredentialsHandle")
+)
+
+const (
+	secpkgCredOutbound      = 2
+	securityNativeDrep      = 0x10
+	iscReqAllocateMemory    = 0x100
+	secbufferVersion        = 0
+	secbufferToken          = 2
+	secIContinueNeeded      = 0x00090312
+	secICompleteNeeded      = 0x00090313
+	secICompleteAndContinue = 0x00090314
+)
+
+type secHandle struct{ lower, upper uintptr }
+
+type secBuffer struct {
+	size       uint32
+	bufferType uint32
+	buffer     *byte
+}
+
+type secBufferDesc struct {
+	version uint32
+	count   uint32
+	buffers *secBuffer
+}
+
+// sspiAuthenticator authenticates as the logged-on Windows user through SSPI, with the NTLM
+// or Negotiate (Kerberos, falling back to NTLM) security package.
+type sspiAuthenticator struct {
+	pkg    string
+	target string
+	cred   secHandle
+	ctx    *secHandle
+	done   bool
+}
+
+func newSSPIAuthenticator(pkg, host string) (proxyAuthenticator, error) {
+	a := &sspiAuthenticator{pkg: "NTLM", target: "HTTP/" + host}
+	if pkg == "negotiate" {
+		a.pkg = "Negotiate"
+	}
+	var expiry int64
+	r, _, _ := procAcquireCredentialsHandleW.Call(0, uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr(a.pkg))),
+		secpkgCredOutbound, 0, 0, 0, 0, uintptr(unsafe.Pointer(&a.cred)), uintptr(unsafe.Pointer(&expiry)))
+	if r != 0 {
+		return nil, fmt.Errorf("Failed acquiring %s credentials of the logged-on user: 0x%x", a.pkg, uint32(r))
+	}
+	return a, nil
+}
+
+func (a *sspiAuthenticator) scheme() string { return a.pkg }
+
+func (a *sspiAuthenticator) authorize(token []byte) (string, error) {
+	if a.done || (a.ctx != nil && len(token) == 0) {
+		return "", nil
+	}
+
+	var in *secBufferDesc
+	if len(token) > 0 {
+		in = &secBufferDesc{version: secbufferVersion, count: 1,
+			buffers: &secBuffer{size: uint32(len(token)), bufferType: secbufferToken, buffer: &token[0]}}
+	}
+	outBuf := secBuffer{bufferType: secbufferToken}
+	out := secBufferDesc{version: secbufferVersion, count: 1, buffers: &outBuf}
+
+	var prev uintptr
+	if a.ctx == nil {
+		a.ctx = &secHandle{}
+	} else {
+		prev = uintptr(unsafe.Pointer(a.ctx))
+	}
+	var attrs uint32
+	var expiry int64
+	r, _, _ := procInitializeSecurityContextW.Call(uintptr(unsafe.Pointer(&a.cred)), prev,
+		uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr(a.target))), iscReqAllocateMemory, 0, securityNativeDrep,
+		uintptr(unsafe.Pointer(in)), 0, uintptr(unsafe.Pointer(a.ctx)), uintptr(unsafe.Pointer(&out)),
+		uintptr(unsafe.Pointer(&attrs)), uintptr(unsafe.Pointer(&expiry)))
+	switch r {
+	case 0:
+		a.done = true
+	case secIContinueNeeded:
+	case secICompleteNeeded, secICompleteAndContinue:
+		a.done = r == secICompleteNeeded
+		if c, _, _ := procCompleteAuthToken.Call(uintptr(unsafe.Pointer(a.ctx)), uintptr(unsafe.Pointer(&out))); c != 0 {
+			return "", fmt.Errorf("Failed completing %s token: 0x%x", a.pkg, uint32(c))
+		}
+	default:
+		return "", fmt.Errorf("Failed initializing %s security context for %s: 0x%x", a.pkg, strings.TrimPrefix(a.target, "HTTP/"), uint32(r))
+	}
+	if outBuf.buffer == nil {
+		return "", nil
+	}
+	defer procFreeContextBuffer.Call(uintptr(unsafe.Pointer(outBuf.buffer)))
+	return a.pkg + " " + base64.StdEncoding.EncodeToString((*[1 << 30]byte)(unsafe.Pointer(outBuf.buffer))[:outBuf.size:outBuf.size]), nil
+}
+
+// Close releases the security context and credentials handles.
+func (a *sspiAuthenticator) Close() error {
+	if a.ctx != nil {
+		procDeleteSecurityContext.Call(uintptr(unsafe.Pointer(a.ctx)))
+	}
+	procFreeCredentialsHandle.Call(uintptr(unsafe.Pointer(&a.cred)))
+	return nil
+}
@@ -0,0 +1,63 @@
+package wstunnel
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// ConnState is a stage in the life of a connection tunneled by a Client, which goes through them in order,
+// skipping those that don't apply, e.g. StateTLS for ws:// URLs, or those after a failed dial up to StateClosing.
+type ConnState int
+
+const (
+	// StateAccepted is a connection just accepted on the client's listener.
+	StateAccepted ConnState = iota
+	// StateDialing is the client connecting to the server.
+	StateDialing
+	// StateTLS is the TLS handshake with the server, for wss:// URLs.
+	StateTLS
+	// StateUpgrading is the websocket handshake with the server.
+	StateUpgrading
+	// StateStreaming is the connection's data being tunneled.
+	StateStreaming
+	// StateClosing is the tunnel being torn down.
+	StateClosing
+	// StateClosed is the connection closed, the last state it enters.
+	StateClosed
+)
+
+var stateNames = [...]string{"accepted", "dialing", "tls", "upgrading", "streaming", "closing", "closed"}
+
+func (s ConnState) String() string {
+	if s < 0 || int(s) >= len(stateNames) {
+		return "unknown"
+	}
+	return stateNames[s]
+}
+
+// StateEvent is a connection entering a state.
+type StateEvent struct {
+	// ID tells the connection from the others of the same Client.
+	ID uint64
+	// ClientAddr is the address of the program that connected to the client.
+	ClientAddr net.Addr
+	State      ConnState
+	Time       time.Time
+}
+
+// stateReporter returns a func calling onChange as connection id from clientAddr enters each state, skipping
+// those it went past already, e.g. as the dial is retried against a fallback server.
+func stateReporter(onChange func(StateEvent), id uint64, clientAddr net.Addr) func(ConnState) {
+	var mu sync.Mutex
+	last := ConnState(-1)
+	return func(s ConnState) {
+		mu.Lock()
+		defer mu.Unlock()
+		if s <= last {
+			return
+		}
+		last = s
+		onChange(StateEvent{ID: id, ClientAddr: clientAddr, State: s, Time: time.Now()})
+	}
+}
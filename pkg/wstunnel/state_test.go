@@ -0,0 +1,103 @@
+package wstunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// collectStates returns a callback for OnStateChange, and a function waiting for the states of a
+// connection up to StateClosed.
+func collectStates(t *testing.T) (func(StateEvent), func() []StateEvent) {
+	events := make(chan StateEvent, 16)
+	wait := func() []StateEvent {
+		var got []StateEvent
+		for {
+			select {
+			case e := <-events:
+				got = append(got, e)
+				if e.State == StateClosed {
+					return got
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Timed out waiting for the connection to close, after %v", got)
+			}
+		}
+	}
+	return func(e StateEvent) { events <- e }, wait
+}
+
+func checkStates(t *testing.T, got []StateEvent, local net.Addr, want ...ConnState) {
+	var states []ConnState
+	for i, e := range got {
+		states = append(states, e.State)
+		if e.ID != got[0].ID {
+			t.Errorf("Event %d is for connection %d, want %d", i, e.ID, got[0].ID)
+		}
+		if e.ClientAddr.String() != local.String() {
+			t.Errorf("Event %d has ClientAddr %v, want %v", i, e.ClientAddr, local)
+		}
+		if i > 0 && e.Time.Before(got[i-1].Time) {
+			t.Errorf("Event %d at %v is before the previous one at %v", i, e.Time, got[i-1].Time)
+		}
+	}
+	if !reflect.DeepEqual(states, want) {
+		t.Errorf("Got states %v, want %v", states, want)
+	}
+}
+
+func TestOnStateChange(t *testing.T) {
+	target := startTarget(t)
+	onState, wait := collectStates(t)
+	client := startTunnel(t, ClientConfig{OnStateChange: onState})
+
+	local, answer, err := pingThrough(t, client, target.Addr().String())
+	if err != nil || answer != "pong!" {
+		t.Fatalf("Got %q, %v through the tunnel, want pong!", answer, err)
+	}
+	checkStates(t, wait(), local, StateAccepted, StateDialing, StateUpgrading, StateStreaming, StateClosing, StateClosed)
+}
+
+func TestOnStateChangeTLS(t *testing.T) {
+	target := startTarget(t)
+	cert, roots := selfSigned(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server, err := NewServer(ServerConfig{ListenAddr: "127.0.0.1:0", TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	onState, wait := collectStates(t)
+	client := startTunnel(t, ClientConfig{
+		ServerURL:     "wss://" + server.Addr().String() + "/",
+		TLSConfig:     &tls.Config{RootCAs: roots},
+		OnStateChange: onState,
+	})
+
+	local, answer, err := pingThrough(t, client, target.Addr().String())
+	if err != nil || answer != "pong!" {
+		t.Fatalf("Got %q, %v through the tunnel, want pong!", answer, err)
+	}
+	checkStates(t, wait(), local, StateAccepted, StateDialing, StateTLS, StateUpgrading, StateStreaming, StateClosing, StateClosed)
+}
+
+func TestOnStateChangeFailedDial(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreachable := "ws://" + ln.Addr().String() + "/"
+	ln.Close()
+	onState, wait := collectStates(t)
+	client := startTunnel(t, ClientConfig{ServerURL: unreachable, OnStateChange: onState})
+
+	local, _, _ := pingThrough(t, client, "127.0.0.1:1")
+	checkStates(t, wait(), local, StateAccepted, StateDialing, StateClosing, StateClosed)
+}
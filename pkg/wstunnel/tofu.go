@@ -0,0 +1,96 @@
+package wstunnel
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	tofuFile = clientFlags.String("tofu_file", "", "File of server certificate fingerprints trusted on first use, like SSH's known_hosts. "+
+		"The first connection to a server records its fingerprint, later ones fail if it changed. Enables TLS even without -certs_dir.")
+	tofuAcceptChanged = clientFlags.Bool("tofu_accept_changed", false, "Accept and record a changed server certificate fingerprint in -tofu_file, "+
+		"after verifying out of band that the change is legitimate")
+)
+
+// tofuStore pins server certificate fingerprints in a file, keyed by server host:port.
+type tofuStore struct {
+	file          string
+	acceptChanged bool
+
+	mu sync.Mutex
+}
+
+func fingerprint(cert []byte) string {
+	sum := sha256.Sum256(cert)
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *tofuStore) load() (map[string]string, error) {
+	known := make(map[string]string)
+	f, err := os.Open(s.file)
+	if os.IsNotExist(err) {
+		return known, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) == 2 {
+			known[fields[0]] = fields[1]
+		}
+	}
+	return known, scanner.Err()
+}
+
+func (s *tofuStore) save(known map[string]string) error {
+	var b strings.Builder
+	for host, fp := range known {
+		fmt.Fprintf(&b, "%s %s\n", host, fp)
+	}
+	return ioutil.WriteFile(s.file, []byte(b.String()), 0600)
+}
+
+// verifier returns a tls.Config.VerifyPeerCertificate function checking the leaf certificate of host.
+func (s *tofuStore) verifier(host string) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("Server presented no certificate")
+		}
+		fp := fingerprint(rawCerts[0])
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		known, err := s.load()
+		if err != nil {
+			return fmt.Errorf("Failed reading -tofu_file: %v", err)
+		}
+		switch want, ok := known[host]; {
+		case !ok:
+			logInfo("Trusting the server certificate on first use", "server", host, "fingerprint", fp)
+		case want == fp:
+			return nil
+		case s.acceptChanged:
+			logWarn("Accepting the changed server certificate", "server", host, "fingerprint", fp, "previous", want)
+		default:
+			return fmt.Errorf("Certificate of %s changed: fingerprint %s, expected %s. If this change is legitimate, "+
+				"run with -tofu_accept_changed or remove %s from %s", host, fp, want, host, s.file)
+		}
+
+		known[host] = fp
+		if err := s.save(known); err != nil {
+			return fmt.Errorf("Failed writing -tofu_file: %v", err)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,66 @@
+package wstunnel
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTOFU(t *testing.T) {
+	defer func(file string, accept bool) { *tofuFile, *tofuAcceptChanged = file, accept }(*tofuFile, *tofuAcceptChanged)
+	*tofuFile, *tofuAcceptChanged = filepath.Join(t.TempDir(), "known_servers"), false
+	server := httptest.NewTLSServer(websocketHandler(func(conn *wsConn) {}))
+	defer server.Close()
+	host := server.Listener.Addr().String()
+	known := host + " " + fingerprint(server.Certificate().Raw) + "\n"
+	changed := host + " " + strings.Repeat("0", 64) + "\n"
+
+	dial := func() error {
+		config, err := getWsConfig(tunnelConfig{TargetHost: host})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tunnel, err := dialTunnelOnce(config)
+		if err == nil {
+			tunnel.data().Close()
+		}
+		return err
+	}
+	recorded := func() string {
+		b, err := os.ReadFile(*tofuFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	if err := dial(); err != nil {
+		t.Fatalf("First connection failed: %v", err)
+	}
+	if got := recorded(); got != known {
+		t.Fatalf("-tofu_file holds %q after the first connection, want %q", got, known)
+	}
+	if err := dial(); err != nil {
+		t.Errorf("Connection with the recorded fingerprint failed: %v", err)
+	}
+
+	if err := os.WriteFile(*tofuFile, []byte(changed), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := dial(); err == nil || !strings.Contains(err.Error(), "changed") {
+		t.Errorf("Connection with a changed fingerprint = %v, want it rejected", err)
+	}
+	if got := recorded(); got != changed {
+		t.Errorf("-tofu_file holds %q after a rejected change, want it untouched", got)
+	}
+
+	*tofuAcceptChanged = true
+	if err := dial(); err != nil {
+		t.Errorf("Connection with a changed fingerprint failed with -tofu_accept_changed: %v", err)
+	}
+	if got := recorded(); got != known {
+		t.Errorf("-tofu_file holds %q after accepting the change, want %q", got, known)
+	}
+}
@@ -0,0 +1,8 @@
+package wstunnel
+
+// udpTargetHeader carries the host:port a UDP tunnel is for in the handshake request. The server relays
+// UDP datagrams to it on such tunnels, one per binary message, instead of serving SOCKS5 requests.
+const udpTargetHeader = "X-Tunnel-Udp-Target"
+
+// maxDatagram is the size of the largest UDP datagram.
+const maxDatagram = 64 * 1024
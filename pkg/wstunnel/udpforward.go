@@ -0,0 +1,127 @@
+package wstunnel
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	udp            = clientFlags.Bool("udp", false, "Forward the -L ports as UDP rather than TCP")
+	udpIdleTimeout = clientFlags.Duration("udp_idle_timeout", time.Minute, "Time after which a UDP session is closed when no datagrams went either way, "+
+		"or 0 to keep sessions open")
+)
+
+// udpSession is the tunnel of a single local UDP peer.
+type udpSession struct {
+	ws         *wsConn
+	lastActive int64 // Unix time in nanoseconds, accessed atomically.
+}
+
+func (s *udpSession) touch() {
+	atomic.StoreInt64(&s.lastActive, time.Now().UnixNano())
+}
+
+func (s *udpSession) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&s.lastActive)))
+}
+
+// serveUDP forwards the datagrams received on pc to target through the server, each local peer having
+// a tunnel of its own, until pc is closed.
+func serveUDP(pc net.PacketConn, wsConfig *websocketConfig, target string) {
+	config := withHeader(wsConfig, udpTargetHeader, target)
+
+	var mu sync.Mutex
+	sessions := map[string]*udpSession{}
+	done := make(chan struct{})
+	defer close(done)
+	go expireUDPSessions(&mu, sessions, done)
+
+	buf := make([]byte, maxDatagram)
+	for {
+		n, peer, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			break
+		}
+
+		mu.Lock()
+		s := sessions[peer.String()]
+		mu.Unlock()
+		if s == nil {
+			if !allowedSource(peer) {
+				logWarn("Dropping datagram not allowed by -allow_cidr", "peer", peer)
+				continue
+			}
+			t, err := dialTunnel(config)
+			if err != nil {
+				logWarn("Dropping datagram", "peer", peer, "error", err)
+				continue
+			}
+			s = &udpSession{ws: t.ws}
+			s.touch()
+			mu.Lock()
+			sessions[peer.String()] = s
+			mu.Unlock()
+			go relayToPeer(s, pc, peer, func() {
+				mu.Lock()
+				delete(sessions, peer.String())
+				mu.Unlock()
+			})
+		}
+
+		s.touch()
+		if err := s.ws.writeMessage(buf[:n]); err != nil {
+			logWarn("Failed sending datagram to the server", "peer", peer, "error", err)
+			s.ws.Close()
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, s := range sessions {
+		s.ws.Close()
+	}
+}
+
+// relayToPeer writes the datagrams coming back through the tunnel of s to peer, until the tunnel is closed.
+func relayToPeer(s *udpSession, pc net.PacketConn, peer net.Addr, closed func()) {
+	defer closed()
+	defer s.ws.Close()
+	for {
+		datagram, err := s.ws.readMessage()
+		if err != nil {
+			return
+		}
+		s.touch()
+		if _, err := pc.WriteTo(datagram, peer); err != nil {
+			logWarn("Failed sending datagram to the peer", "peer", peer, "error", err)
+		}
+	}
+}
+
+// expireUDPSessions closes the sessions idle for -udp_idle_timeout, until done is closed.
+func expireUDPSessions(mu *sync.Mutex, sessions map[string]*udpSession, done chan struct{}) {
+	if *udpIdleTimeout == 0 {
+		return
+	}
+	ticker := time.NewTicker(max(*udpIdleTimeout/4, time.Millisecond))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		mu.Lock()
+		for _, s := range sessions {
+			if s.idle() >= *udpIdleTimeout {
+				s.ws.Close()
+			}
+		}
+		mu.Unlock()
+	}
+}
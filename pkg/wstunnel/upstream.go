@@ -0,0 +1,149 @@
+package wstunnel
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	healthCheckInterval = clientFlags.Duration("health_check_interval", 0, "Time between health checks of each server of a "+
+		"comma-separated -target_host, new tunnels only going to the servers passing them unless none does, or 0 for no checks")
+	healthCheckPath = clientFlags.String("health_check_path", "", "Path to GET for the health checks, which servers pass with "+
+		"a 2xx response, e.g. /generate_204. Empty to check with a websocket handshake, which a server with -backend "+
+		"connects to it for.")
+	allUnhealthy = clientFlags.String("all_unhealthy", "try_anyway", "What new tunnels do while every server fails its "+
+		"health checks: try_anyway, trying the server that failed least recently first, or fail without trying any")
+)
+
+// healthCheckTimeout bounds the time a server may take to answer a health check with -health_check_path.
+const healthCheckTimeout = 10 * time.Second
+
+// watchHealth checks the health of every server of b every -health_check_interval, until the process exits.
+func (b *balancer) watchHealth() {
+	for i := range b.servers {
+		go func(i int) {
+			for {
+				b.setHealthy(i, checkServer(b.servers[i]))
+				time.Sleep(*healthCheckInterval)
+			}
+		}(i)
+	}
+}
+
+// setHealthy records the outcome of a health check of server i.
+func (b *balancer) setHealthy(i int, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	host := b.servers[i].Location.Host
+	wasDegraded := b.degraded()
+	switch {
+	case err != nil && b.healthy[i]:
+		logWarn("Server failed its health check, new tunnels go to the others", "server", host, "error", err)
+	case err == nil && !b.healthy[i]:
+		logInfo("Server passed its health check again", "server", host)
+	}
+	b.healthy[i] = err == nil
+	if err != nil {
+		b.failed[i] = time.Now()
+	}
+	switch degraded := b.degraded(); {
+	case degraded && !wasDegraded:
+		logError("Every server failed its health check", "servers", b.hosts(), "all_unhealthy", *allUnhealthy)
+	case !degraded && wasDegraded:
+		logInfo("A server passed its health check, no longer degraded", "server", host)
+	}
+}
+
+// degraded returns whether every server failed its latest health check. b.mu must be held.
+func (b *balancer) degraded() bool {
+	for _, healthy := range b.healthy {
+		if healthy {
+			return false
+		}
+	}
+	return true
+}
+
+// isDegraded returns whether every server failed its latest health check, see -all_unhealthy.
+func (b *balancer) isDegraded() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.degraded()
+}
+
+func (b *balancer) hosts() string {
+	hosts := make([]string, len(b.servers))
+	for i, s := range b.servers {
+		hosts[i] = s.Location.Host
+	}
+	return strings.Join(hosts, ",")
+}
+
+// checkServer checks the health of the server of config, with a GET of -health_check_path if set,
+// or by establishing a tunnel otherwise.
+func checkServer(config *websocketConfig) error {
+	if *healthCheckPath != "" {
+		return getHealthCheck(config)
+	}
+	if config.Transport == "webtransport" {
+		_, err := getWTSession(config)
+		return err
+	}
+	t, err := dialTunnel(config)
+	if err != nil {
+		return err
+	}
+	return t.data().Close()
+}
+
+// getHealthCheck GETs -health_check_path from the server of config, the same way tunnels reach it.
+func getHealthCheck(config *websocketConfig) error {
+	conn, err := getProxiedConn(*config.Location)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(healthCheckTimeout))
+	if config.TlsConfig != nil {
+		tlscfg := config.TlsConfig.Clone()
+		if config.Certs != nil {
+			tlscfg = config.Certs.clientConfig(config.TlsConfig)
+		}
+		tlsConn := tls.Client(conn, tlscfg)
+		if err := tlsConn.Handshake(); err != nil {
+			return err
+		}
+		conn = tlsConn
+	}
+
+	req, err := http.NewRequest("GET", "http://"+config.Location.Host+*healthCheckPath, nil)
+	if err != nil {
+		return err
+	}
+	for k, v := range config.Header {
+		req.Header[k] = v
+	}
+	auth, err := config.Authorization()
+	if err != nil {
+		return err
+	}
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Health check failed: %s", resp.Status)
+	}
+	return nil
+}
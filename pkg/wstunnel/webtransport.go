@@ -0,0 +1,279 @@
+package wstunnel
+
+// WebTransport over QUIC (HTTP/3) as an alternative to websockets: every tunnel is a bidirectional stream of a
+// WebTransport session to the server, so that a lost packet only holds up the tunnel it belongs to, rather than
+// every tunnel sharing a TCP connection as with -mux or -http2.
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/webtransport-go"
+)
+
+var (
+	transport = clientFlags.String("transport", "websocket", "How tunnels are carried to the server: websocket, or webtransport "+
+		"for streams of a WebTransport session over QUIC, which spares them each other's head-of-line blocking on lossy networks. "+
+		"webtransport requires TLS and a server with -webtransport, and goes around proxies. UDP and reverse forwards stay on websockets.")
+	webtransportServer = serverFlags.Bool("webtransport", false, "Accept WebTransport sessions over QUIC on UDP -https_port, "+
+		"for clients with -transport=webtransport. Requires -certs_dir.")
+)
+
+// wtDialTimeout bounds the time taken to establish a WebTransport session.
+const wtDialTimeout = 30 * time.Second
+
+// quicFallbackDelay is the head start of the first address family tried when dialing a dual-stack server over QUIC,
+// as net.Dialer gives it over TCP.
+const quicFallbackDelay = 300 * time.Millisecond
+
+// wtQUICConfig enables what WebTransport needs of QUIC, with keep-alives holding idle sessions open through NATs.
+var wtQUICConfig = &quic.Config{
+	EnableDatagrams:                  true,
+	EnableStreamResetPartialDelivery: true,
+	KeepAlivePeriod:                  15 * time.Second,
+}
+
+// wtSession is a WebTransport session to the server carrying tunnels as streams.
+type wtSession struct {
+	session *webtransport.Session
+	header  http.Header // The header of the server's response.
+}
+
+var (
+	wtMu       sync.Mutex
+	wtSessions = map[*websocketConfig]*wtSession{}
+)
+
+// wtStream is a stream of a WebTransport session, as a net.Conn.
+type wtStream struct {
+	*webtransport.Stream
+	session *webtransport.Session
+}
+
+func (s wtStream) LocalAddr() net.Addr  { return s.session.LocalAddr() }
+func (s wtStream) RemoteAddr() net.Addr { return s.session.RemoteAddr() }
+
+func (s wtStream) CloseWrite() error {
+	return s.Stream.Close()
+}
+
+// Close closes both sides of the stream, the peer being told to stop sending.
+func (s wtStream) Close() error {
+	s.Stream.CancelRead(0)
+	return s.Stream.Close()
+}
+
+// openWTStream returns a new stream on the session to the server of wsConfig, establishing the session if needed.
+func openWTStream(wsConfig *websocketConfig) (*tunnel, error) {
+	s, err := getWTSession(wsConfig)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), wtDialTimeout)
+	defer cancel()
+	stream, err := s.session.OpenStreamSync(ctx)
+	if err != nil {
+		s.session.CloseWithError(0, "")
+		return nil, err
+	}
+	return &tunnel{conn: wtStream{stream, s.session}, header: s.header}, nil
+}
+
+// getWTSession returns the session to the server of wsConfig, establishing it if needed.
+func getWTSession(wsConfig *websocketConfig) (*wtSession, error) {
+	wtMu.Lock()
+	defer wtMu.Unlock()
+	if s := wtSessions[wsConfig]; s != nil && s.session.Context().Err() == nil {
+		return s, nil
+	}
+
+	s, err := dialWTSession(wsConfig)
+	recordHandshake(wsConfig, err)
+	if err != nil {
+		return nil, err
+	}
+	logInfo("Connected to the server over WebTransport", "server", wsConfig.Location.Host)
+	wtSessions[wsConfig] = s
+	return s, nil
+}
+
+func dialWTSession(wsConfig *websocketConfig) (*wtSession, error) {
+	wsConfig, err := withPathToken(wsConfig)
+	if err != nil {
+		return nil, fmt.Errorf("withPathToken(): %v", err)
+	}
+	auth, err := wsConfig.Authorization()
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{"Origin": {wsConfig.Origin}}
+	for k, v := range wsConfig.Header {
+		header[k] = v
+	}
+	if auth != "" {
+		header.Set("Authorization", auth)
+	}
+
+	tlscfg := wsConfig.TlsConfig.Clone()
+	if wsConfig.Certs != nil {
+		tlscfg = wsConfig.Certs.clientConfig(wsConfig.TlsConfig)
+	}
+	tlscfg.NextProtos = []string{http3.NextProtoH3}
+	dialer := &webtransport.Transport{TLSClientConfig: tlscfg, QUICConfig: wtQUICConfig, DialAddr: dialQUIC}
+	location := *wsConfig.Location
+	location.Scheme = "https"
+
+	ctx, cancel := context.WithTimeout(context.Background(), wtDialTimeout)
+	defer cancel()
+	resp, session, err := dialer.Dial(ctx, location.String(), header)
+	if err != nil {
+		if resp != nil {
+			err = fmt.Errorf("%v (%s)", err, resp.Status)
+		}
+		return nil, fmt.Errorf("Failed WebTransport handshake: %v", err)
+	}
+	state := session.SessionState().ConnectionState.TLS
+	if err := checkTLSVersion(state); err != nil {
+		session.CloseWithError(0, "")
+		return nil, err
+	}
+	if err := checkRevocation(state); err != nil {
+		session.CloseWithError(0, "")
+		return nil, err
+	}
+	return &wtSession{session: session, header: resp.Header}, nil
+}
+
+// dialQUIC dials addr over QUIC the way getDialer dials over TCP: resolving it with -resolver, restricted by -ip_version,
+// and racing the IPv6 and IPv4 addresses of a dual-stack server, the family resolved first getting a head start
+// of quicFallbackDelay unless it fails sooner (RFC 6555).
+func dialQUIC(ctx context.Context, addr string, tlscfg *tls.Config, cfg *quic.Config) (*quic.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	r := resolver
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	ips, err := r.LookupIP(ctx, "ip"+strings.TrimPrefix(dialNetwork(), "tcp"), host)
+	if err != nil {
+		return nil, err
+	}
+	var primaries, fallbacks []net.IP
+	for _, ip := range ips {
+		if (ip.To4() == nil) == (ips[0].To4() == nil) {
+			primaries = append(primaries, ip)
+		} else {
+			fallbacks = append(fallbacks, ip)
+		}
+	}
+
+	type result struct {
+		conn *quic.Conn
+		err  error
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan result, 2)
+	race := func(ips []net.IP) {
+		var err error
+		for _, ip := range ips {
+			var conn *quic.Conn
+			if conn, err = quic.DialAddrEarly(ctx, net.JoinHostPort(ip.String(), port), tlscfg, cfg); err == nil {
+				results <- result{conn: conn}
+				return
+			}
+		}
+		results <- result{err: err}
+	}
+
+	go race(primaries)
+	racing := 1
+	var fallback <-chan time.Time
+	if len(fallbacks) > 0 {
+		fallback = time.After(quicFallbackDelay)
+	}
+	var firstErr error
+	for racing > 0 {
+		select {
+		case <-fallback:
+		case res := <-results:
+			racing--
+			if res.err == nil {
+				// Closes whatever connection the other family establishes before noticing it lost.
+				go func(n int) {
+					for ; n > 0; n-- {
+						if res := <-results; res.conn != nil {
+							res.conn.CloseWithError(0, "")
+						}
+					}
+				}(racing)
+				return res.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			if fallback == nil {
+				continue
+			}
+		}
+		fallback = nil
+		if fallbacks != nil {
+			go race(fallbacks)
+			fallbacks = nil
+			racing++
+		}
+	}
+	return nil, firstErr
+}
+
+// serveWebTransport accepts WebTransport sessions on UDP addr, serving their streams as tunnels of their own.
+// The returned function closes the server once the tunnels drained.
+func serveWebTransport(addr string, tlscfg *tls.Config, s *Server) (func(), error) {
+	udp, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	server := &webtransport.Server{
+		H3: &http3.Server{TLSConfig: http3.ConfigureTLSConfig(tlscfg), QUICConfig: wtQUICConfig},
+		// Clients are authenticated by their certificates, and don't send an Origin matching the server's name.
+		CheckOrigin: upgrader.CheckOrigin,
+	}
+	server.H3.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, err := server.Upgrade(w, r)
+		if err != nil {
+			logError("Failed WebTransport handshake", "remote", r.RemoteAddr, "error", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		defer session.CloseWithError(0, "")
+		for {
+			stream, err := session.AcceptStream(context.Background())
+			if err != nil {
+				return
+			}
+			conn := wtStream{stream, session}
+			if atomic.LoadInt32(&shuttingDown) != 0 {
+				conn.Close()
+				continue
+			}
+			go s.serveStream(conn, r)
+		}
+	})
+	go func() {
+		if err := server.Serve(udp); err != nil && err != http.ErrServerClosed {
+			logError("WebTransport server failed", "addr", addr, "error", err)
+		}
+	}()
+	return func() { server.Close() }, nil
+}
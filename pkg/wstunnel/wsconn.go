@@ -0,0 +1,152 @@
+package wstunnel
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	writeTimeout = sharedFlags.Duration("write_timeout", 0, "Time a write to a websocket may take before the connection is "+
+		"considered stuck and closed, or 0 for no limit")
+	compress = sharedFlags.Bool("compress", false, "Compress websocket messages with permessage-deflate, which pays off for "+
+		"compressible protocols over slow links. The client offers it, and the server accepts it when offered.")
+	compressLevel = sharedFlags.Int("compress_level", 1, "Deflate level of the websocket messages sent when compressing, "+
+		"from 1 for the fastest to 9 for the smallest")
+	compressMinSize = sharedFlags.Int("compress_min_size", 0, "Size in bytes under which websocket messages are sent "+
+		"uncompressed when compressing, as deflate barely shrinks small ones, if at all, for its overhead")
+)
+
+// closeTimeout bounds the time taken to send a close frame, which a dead peer would otherwise hold up.
+const closeTimeout = time.Second
+
+// wsConn is a net.Conn over a websocket connection, which tunneled data travels through as binary messages.
+// Text messages are read as data as well, as peers using golang.org/x/net/websocket send them.
+type wsConn struct {
+	*websocket.Conn
+	request *http.Request // The handshake request on the server side, nil on the client side.
+	onClose func()        // Called on Close if set.
+
+	r   io.Reader // The message being read, nil between messages.
+	wmu sync.Mutex
+}
+
+func newWSConn(ws *websocket.Conn, request *http.Request) *wsConn {
+	// Only takes effect if compression was negotiated, the level is checked at startup.
+	ws.SetCompressionLevel(*compressLevel)
+	return &wsConn{Conn: ws, request: request}
+}
+
+// Request returns the handshake request of a connection accepted by the server.
+func (c *wsConn) Request() *http.Request {
+	return c.request
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	for {
+		if c.r == nil {
+			_, r, err := c.NextReader()
+			if err != nil {
+				return 0, wsError(err)
+			}
+			c.r = r
+		}
+		n, err := c.r.Read(b)
+		if err == io.EOF {
+			c.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, wsError(err)
+	}
+}
+
+func (c *wsConn) Write(b []byte) (int, error) {
+	if err := c.writeMessage(b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// writeMessage sends b as a single binary message, e.g. a datagram.
+func (c *wsConn) writeMessage(b []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if *writeTimeout > 0 {
+		c.SetWriteDeadline(time.Now().Add(*writeTimeout))
+	}
+	if *compressMinSize > 0 {
+		// Only takes effect if compression was negotiated.
+		c.EnableWriteCompression(len(b) >= *compressMinSize)
+	}
+	return c.WriteMessage(websocket.BinaryMessage, b)
+}
+
+// readMessage returns the next message whole, e.g. a datagram.
+func (c *wsConn) readMessage() ([]byte, error) {
+	_, b, err := c.ReadMessage()
+	return b, wsError(err)
+}
+
+// Close sends the peer a close frame, and closes the connection.
+func (c *wsConn) Close() error {
+	if c.onClose != nil {
+		c.onClose()
+	}
+	c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(closeTimeout))
+	return c.Conn.Close()
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+// wsError returns io.EOF for the errors ending a websocket connection cleanly. That includes the peer
+// closing the underlying connection without a close frame, as it does to half-close the tunnel.
+func wsError(err error) error {
+	if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway,
+		websocket.CloseNoStatusReceived, websocket.CloseAbnormalClosure) {
+		return io.EOF
+	}
+	return err
+}
+
+var upgrader = websocket.Upgrader{
+	// Like golang.org/x/net/websocket, which clients may still use, only require an Origin that parses.
+	CheckOrigin: func(r *http.Request) bool {
+		_, err := url.ParseRequestURI(r.Header.Get("Origin"))
+		return err == nil
+	},
+	WriteBufferPool: wsWriteBuffers,
+}
+
+// websocketHandler accepts websocket connections and has handle serve them, closing them once it returns.
+func websocketHandler(handle func(conn *wsConn)) http.Handler {
+	upgrader := upgrader
+	upgrader.EnableCompression = *compress
+	upgrader.WriteBufferSize = *bufferSize
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var header http.Header
+		if protocols := websocket.Subprotocols(r); len(protocols) > 0 {
+			// Tunnels are the same whatever the subprotocol, which is only for whatever routes them here.
+			header = http.Header{"Sec-Websocket-Protocol": {protocols[0]}}
+		}
+		ws, err := upgrader.Upgrade(w, r, header)
+		if err != nil {
+			// The client got an error response already.
+			return
+		}
+		conn := newWSConn(ws, r)
+		defer conn.Close()
+		handle(conn)
+	})
+}
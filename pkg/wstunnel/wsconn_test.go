@@ -0,0 +1,82 @@
+package wstunnel
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// readServerFrame reads a frame sent by the server, and returns whether it's compressed and its payload.
+func readServerFrame(r *bufio.Reader) (compressed bool, payload []byte, err error) {
+	var h [2]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return false, nil, err
+	}
+	n := int(h[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return false, nil, err
+		}
+		n = int(ext[0])<<8 | int(ext[1])
+	case 127:
+		return false, nil, fmt.Errorf("unexpectedly large frame")
+	}
+	payload = make([]byte, n)
+	_, err = io.ReadFull(r, payload)
+	return h[0]&0x40 != 0, payload, err
+}
+
+func TestCompressMinSize(t *testing.T) {
+	defer func(c bool, size int) { *compress, *compressMinSize = c, size }(*compress, *compressMinSize)
+	*compress, *compressMinSize = true, 100
+	small := []byte("tiny")
+	large := bytes.Repeat([]byte("compressible "), 100)
+	server := httptest.NewServer(websocketHandler(func(conn *wsConn) {
+		conn.Write(small)
+		conn.Write(large)
+		conn.Write(small)
+	}))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\nOrigin: http://localhost/\r\n"+
+		"Sec-WebSocket-Extensions: permessage-deflate; server_no_context_takeover; client_no_context_takeover\r\n\r\n",
+		server.Listener.Addr())
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || !strings.Contains(resp.Header.Get("Sec-Websocket-Extensions"), "permessage-deflate") {
+		t.Fatalf("Got %s with extensions %q, want compression negotiated", resp.Status, resp.Header.Get("Sec-Websocket-Extensions"))
+	}
+
+	for _, want := range []struct {
+		size       int
+		compressed bool
+	}{{len(small), false}, {len(large), true}, {len(small), false}} {
+		compressed, payload, err := readServerFrame(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if compressed != want.compressed {
+			t.Errorf("A %d byte message was sent compressed=%v, want %v", want.size, compressed, want.compressed)
+		}
+		if !compressed && len(payload) != want.size || compressed && len(payload) >= want.size {
+			t.Errorf("A %d byte message was sent as %d bytes", want.size, len(payload))
+		}
+	}
+}